@@ -97,7 +97,49 @@ CREATE TABLE IF NOT EXISTS reference_fetch (
   max_age INTERVAL NOT NULL DEFAULT '24 hours'
 );
 INSERT INTO reference_fetch (key, last_fetched, max_age)
-VALUES ('toc', '2000-01-01 00:00:00', '1 week');
+VALUES ('toc', '2000-01-01 00:00:00', '1 week') ON CONFLICT (key) DO NOTHING;
+INSERT INTO reference_fetch (key, last_fetched, max_age)
+VALUES ('smart', '2000-01-01 00:00:00', '1 week') ON CONFLICT (key) DO NOTHING;
+CREATE TABLE IF NOT EXISTS schema_version (version INT PRIMARY KEY);
+INSERT INTO schema_version (version)
+VALUES (1) ON CONFLICT (version) DO NOTHING;
+CREATE TABLE IF NOT EXISTS reference_smart (
+  id SERIAL PRIMARY KEY,
+  td_area VARCHAR(2) NOT NULL,
+  from_berth VARCHAR(4),
+  to_berth VARCHAR(4),
+  from_line VARCHAR(1),
+  to_line VARCHAR(1),
+  berth_offset INT NOT NULL DEFAULT 0,
+  platform VARCHAR(3),
+  event VARCHAR(1),
+  route VARCHAR(1),
+  stanox VARCHAR(5),
+  stanme VARCHAR(9),
+  step_type VARCHAR(1),
+  comment VARCHAR(255)
+);
+CREATE INDEX IF NOT EXISTS idx_reference_smart_step ON reference_smart(td_area, from_berth, to_berth);
+CREATE TABLE IF NOT EXISTS movement (
+  train_uid VARCHAR(6) NOT NULL,
+  run_date DATE NOT NULL,
+  train_id VARCHAR(10),
+  headcode VARCHAR(4),
+  stanox VARCHAR(5) NOT NULL,
+  event_type VARCHAR(18) NOT NULL,
+  planned_time VARCHAR(5) NOT NULL DEFAULT '',
+  actual_timestamp TIMESTAMP,
+  variation INT,
+  source VARCHAR(5),
+  source_time VARCHAR(13),
+  canx_type VARCHAR(16),
+  reason_code VARCHAR(2),
+  original_stanox VARCHAR(5),
+  recorded_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+  PRIMARY KEY (train_uid, run_date, event_type, stanox, planned_time)
+) PARTITION BY RANGE (run_date);
+CREATE INDEX IF NOT EXISTS idx_movement_headcode ON movement(headcode, run_date);
+CREATE INDEX IF NOT EXISTS idx_movement_stanox ON movement(stanox, run_date);
 CREATE INDEX IF NOT EXISTS idx_tiploc_stanox ON tiploc(stanox)
 WHERE stanox IS NOT NULL;
 CREATE INDEX IF NOT EXISTS idx_tiploc_crs_code ON tiploc(crs_code)
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+
+	"github.com/jack-barr3tt/gbr-engine/src/common/bus"
+	"github.com/jack-barr3tt/gbr-engine/src/common/metrics"
+	"github.com/jack-barr3tt/gbr-engine/src/common/utils"
+	"github.com/jack-barr3tt/gbr-engine/src/data-fetcher/fetcher"
+	"github.com/jack-barr3tt/gbr-engine/src/http-api/api"
+	"github.com/jack-barr3tt/gbr-engine/src/queuer/queuer"
+	"github.com/jack-barr3tt/gbr-engine/src/td-consumer/td"
+	"github.com/jack-barr3tt/gbr-engine/src/trust-consumer/trust"
+	"github.com/jack-barr3tt/gbr-engine/src/vstp-consumer/vstp"
+)
+
+// memoryQueueLimit caps each queue on the in-memory bus. Publishers wait for
+// room in a full queue that is being consumed, and a queue nothing consumes
+// drops its oldest messages instead.
+const memoryQueueLimit = 100000
+
+// The all-in-one command runs the queuer, TRUST, VSTP and TD consumers, data
+// fetcher and HTTP API in a single process, connected by an in-memory bus.
+// By default it replays the recordings at FEED_REPLAY_PATH into embedded
+// Postgres and Redis stand-ins, but each piece can be pointed at a real
+// instance with the same variables the services use.
+func main() {
+	utils.InitLogger()
+	defer utils.SyncLogger()
+	logger := utils.GetLogger()
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	db, closeDB, err := newPostgres(ctx)
+	if err != nil {
+		logger.Fatalw("failed to connect to Postgres", "error", err)
+	}
+	defer closeDB()
+
+	rdb, closeRedis, err := newRedis()
+	if err != nil {
+		logger.Fatalw("failed to connect to Redis", "error", err)
+	}
+	defer closeRedis()
+
+	b := bus.NewMemoryBus(memoryQueueLimit)
+	defer b.Close()
+	go metrics.ServeFromEnv(ctx, logger)
+
+	feedSource := os.Getenv("FEED_SOURCE")
+	if feedSource == "" {
+		feedSource = "replay"
+	}
+	source, err := queuer.NewFeedSource(ctx, feedSource)
+	if err != nil {
+		logger.Fatalw("failed to create feed source", "error", err)
+	}
+
+	clientID := os.Getenv("NR_FEEDS_CLIENT_ID")
+	if clientID == "" {
+		clientID = "all-in-one"
+	}
+
+	httpAddr := os.Getenv("HTTP_ADDR")
+	if httpAddr == "" {
+		httpAddr = ":3000"
+	}
+
+	var wg sync.WaitGroup
+
+	// if any service stops with an error the rest are stopped too, rather than
+	// leaving the pipeline running with a piece missing
+	run := func(name string, fn func() error) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := fn(); err != nil {
+				logger.Errorw("service stopped", "service", name, "error", err)
+				stop()
+			}
+		}()
+	}
+
+	run("queuer", func() error {
+		return queuer.Run(ctx, b, rdb, source, clientID)
+	})
+	run("trust-consumer", func() error {
+		return trust.Run(ctx, db, rdb, b)
+	})
+	run("vstp-consumer", func() error {
+		return vstp.Run(ctx, db, rdb, b)
+	})
+	run("td-consumer", func() error {
+		return td.Run(ctx, db, rdb, b)
+	})
+	run("data-fetcher", func() error {
+		return fetcher.Run(ctx, db)
+	})
+	run("http-api", func() error {
+		app := api.NewApp(api.NewServerWith(db, rdb))
+		go func() {
+			<-ctx.Done()
+			app.Shutdown()
+		}()
+		return app.Listen(httpAddr)
+	})
+
+	logger.Infow("running all-in-one", "feed_source", feedSource, "http_addr", httpAddr)
+
+	<-ctx.Done()
+	wg.Wait()
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+
+	"github.com/alicebob/miniredis/v2"
+	embeddedpostgres "github.com/fergusstrange/embedded-postgres"
+	"github.com/jack-barr3tt/gbr-engine/src/common/utils"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/redis/go-redis/v9"
+)
+
+// newPostgres connects to the Postgres configured by POSTGRES_HOST and the
+// other POSTGRES_ variables, or when POSTGRES_HOST is not set starts an
+// embedded Postgres on EMBEDDED_POSTGRES_PORT (5433 by default) and applies
+// the schema from SCHEMA_FILE to it. The embedded database starts empty each
+// run unless EMBEDDED_POSTGRES_DATA names a directory to keep it in.
+func newPostgres(ctx context.Context) (*pgxpool.Pool, func(), error) {
+	logger := utils.GetLogger()
+
+	if os.Getenv("POSTGRES_HOST") != "" {
+		db, err := utils.NewPostgresConnection()
+		if err != nil {
+			return nil, nil, err
+		}
+		return db, db.Close, nil
+	}
+
+	port := 5433
+	if s := os.Getenv("EMBEDDED_POSTGRES_PORT"); s != "" {
+		parsed, err := strconv.Atoi(s)
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid EMBEDDED_POSTGRES_PORT %q: %w", s, err)
+		}
+		port = parsed
+	}
+
+	config := embeddedpostgres.DefaultConfig().
+		Port(uint32(port)).
+		Database("gbr").
+		Logger(io.Discard)
+	if dir := os.Getenv("EMBEDDED_POSTGRES_DATA"); dir != "" {
+		config = config.DataPath(dir)
+	}
+
+	logger.Infow("starting embedded Postgres", "port", port)
+	postgres := embeddedpostgres.NewDatabase(config)
+	if err := postgres.Start(); err != nil {
+		return nil, nil, fmt.Errorf("failed to start embedded Postgres: %w", err)
+	}
+	stop := func() {
+		if err := postgres.Stop(); err != nil {
+			logger.Warnw("failed to stop embedded Postgres", "error", err)
+		}
+	}
+
+	db, err := pgxpool.New(ctx, config.GetConnectionURL()+"?sslmode=disable")
+	if err != nil {
+		stop()
+		return nil, nil, err
+	}
+
+	if err := applySchema(ctx, db); err != nil {
+		db.Close()
+		stop()
+		return nil, nil, err
+	}
+
+	return db, func() {
+		db.Close()
+		stop()
+	}, nil
+}
+
+// applySchema runs the schema file, which only creates what does not already
+// exist, against the database
+func applySchema(ctx context.Context, db *pgxpool.Pool) error {
+	path := os.Getenv("SCHEMA_FILE")
+	if path == "" {
+		path = "schema.sql"
+	}
+
+	schema, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read schema: %w", err)
+	}
+
+	if _, err := db.Exec(ctx, string(schema)); err != nil {
+		return fmt.Errorf("failed to apply schema: %w", err)
+	}
+	return nil
+}
+
+// newRedis connects to the Redis at REDIS_ADDR, or when it is not set starts
+// an in-memory stand-in
+func newRedis() (*redis.Client, func(), error) {
+	if os.Getenv("REDIS_ADDR") != "" {
+		rdb := utils.NewRedisClient()
+		return rdb, func() { rdb.Close() }, nil
+	}
+
+	server, err := miniredis.Run()
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to start in-memory Redis: %w", err)
+	}
+	utils.GetLogger().Infow("started in-memory Redis", "addr", server.Addr())
+
+	rdb := redis.NewClient(&redis.Options{Addr: server.Addr()})
+	return rdb, func() {
+		rdb.Close()
+		server.Close()
+	}, nil
+}
@@ -1,3 +1,3 @@
 package api_types
 
-//go:generate go run github.com/oapi-codegen/oapi-codegen/v2/cmd/oapi-codegen --config=../types.cfg.yaml ../../../spec/openapi.yaml
+//go:generate go run github.com/oapi-codegen/oapi-codegen/v2/cmd/oapi-codegen@v2.5.0 --config=../types.cfg.yaml ../../../spec/openapi.yaml
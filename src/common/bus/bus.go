@@ -0,0 +1,262 @@
+package bus
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jack-barr3tt/gbr-engine/src/common/metrics"
+	"github.com/jack-barr3tt/gbr-engine/src/common/types"
+)
+
+// Feeds group the queues carrying messages from each Network Rail feed, and
+// each has its own dead letter queue
+const (
+	TrustFeed = "trust"
+	TDFeed    = "td"
+	VSTPFeed  = "vstp"
+)
+
+// Headers carry metadata alongside a message, such as why it was dead
+// lettered
+type Headers map[string]any
+
+// Bus carries feed messages between services. Messages are published with a
+// routing key and delivered to every queue bound with a matching key, where
+// a binding key can use * to match one word of the routing key and # to match
+// any number of words. A queue can also be limited to messages published with
+// a given header value.
+type Bus interface {
+	// DeclareQueue declares a durable queue bound with the binding key, along
+	// with the feed's dead letter queue which anything rejected from it is
+	// sent to. Every declaration of a queue must use the same options.
+	DeclareQueue(ctx context.Context, feed, queue, bindingKey string, opts ...QueueOption) error
+
+	// RetireQueue stops a queue an older release declared from receiving any
+	// more messages through the binding key, and deletes it once nothing is
+	// consuming it and it is empty. A queue that does not exist is ignored.
+	RetireQueue(ctx context.Context, queue, bindingKey string) error
+
+	// Publish sends a message with any headers, returning once the bus has
+	// accepted it
+	Publish(ctx context.Context, key string, body []byte, headers Headers) error
+
+	// DeadLetter sends a message that could not be handled to the feed's dead
+	// letter queue, recording the error that stopped it being handled
+	DeadLetter(ctx context.Context, feed string, body []byte, headers Headers, cause error) error
+
+	// Consume delivers messages from a declared queue until the context is
+	// cancelled or the bus is closed. Every delivery must be acknowledged or
+	// rejected.
+	Consume(ctx context.Context, queue string, opts ...ConsumeOption) (<-chan Delivery, error)
+
+	// Ping reports whether the bus is still able to carry messages
+	Ping(ctx context.Context) error
+
+	Close() error
+}
+
+// QueueOption changes how a declared queue behaves
+type QueueOption func(*queueOptions)
+
+type queueOptions struct {
+	singleActiveConsumer bool
+	matchHeader          string
+	matchValue           string
+}
+
+// SingleActiveConsumer delivers a queue's messages to only one of its
+// consumers at a time, failing over to another when it stops, so they are
+// handled in order however many replicas consume the queue
+func SingleActiveConsumer() QueueOption {
+	return func(o *queueOptions) {
+		o.singleActiveConsumer = true
+	}
+}
+
+// MatchHeader limits a queue to the messages matching its binding key that
+// were also published with the header set to value
+func MatchHeader(header, value string) QueueOption {
+	return func(o *queueOptions) {
+		o.matchHeader = header
+		o.matchValue = value
+	}
+}
+
+func applyQueueOptions(opts []QueueOption) queueOptions {
+	var options queueOptions
+	for _, opt := range opts {
+		opt(&options)
+	}
+	return options
+}
+
+// ConsumeOption changes how messages are delivered to a consumer
+type ConsumeOption func(*consumeOptions)
+
+type consumeOptions struct {
+	prefetch int
+}
+
+// Prefetch limits a consumer to n messages delivered but not yet acknowledged
+// or rejected, so a consumer that falls behind leaves the rest on the queue
+func Prefetch(n int) ConsumeOption {
+	return func(o *consumeOptions) {
+		o.prefetch = n
+	}
+}
+
+func applyConsumeOptions(opts []ConsumeOption) consumeOptions {
+	var options consumeOptions
+	for _, opt := range opts {
+		opt(&options)
+	}
+	return options
+}
+
+// Delivery is a message taken from a queue
+type Delivery struct {
+	Key     string
+	Body    []byte
+	Headers Headers
+
+	queue  string
+	ack    func() error
+	reject func(ctx context.Context, cause error) error
+}
+
+// Ack removes the message from its queue once it has been handled
+func (d Delivery) Ack() error {
+	metrics.ConsumedMessages.WithLabelValues(d.queue, metrics.OutcomeAcked).Inc()
+	return d.ack()
+}
+
+// Reject removes the message from its queue and sends it to the feed's dead
+// letter queue with the error that stopped it being handled
+func (d Delivery) Reject(ctx context.Context, cause error) error {
+	metrics.ConsumedMessages.WithLabelValues(d.queue, metrics.OutcomeRejected).Inc()
+	return d.reject(ctx, cause)
+}
+
+// DeadLetterQueue holds a feed's dead letters until they are inspected, and
+// requeued by moving them back to the queue named in their x-original-queue
+// header
+func DeadLetterQueue(feed string) string {
+	return feed + ".dead"
+}
+
+// New connects to the bus named by BUS. Only "rabbitmq", the default, can be
+// shared between processes; services running in a single process share a
+// MemoryBus instead.
+func New() (Bus, error) {
+	switch os.Getenv("BUS") {
+	case "", "rabbitmq":
+		return NewRabbitBus()
+	default:
+		return nil, fmt.Errorf("unknown BUS %q", os.Getenv("BUS"))
+	}
+}
+
+// TrustPartitions is how many partitions TRUST messages are split into by
+// train ID. Every message about a train goes to the same partition, so
+// partitions can be consumed in parallel without two consumers ever updating
+// the same train.
+const TrustPartitions = 8
+
+// TrustPartitionHeader carries the partition a TRUST message belongs to.
+// Partitioning by header rather than routing key leaves the routing key free
+// for consumers that bind on message type or operator.
+const TrustPartitionHeader = "trust-partition"
+
+// TrustRoutingKey routes TRUST messages as trust.<msg_type>.<toc_id>
+func TrustRoutingKey(msg *types.TrustMessage) string {
+	return routingKey(TrustFeed, string(msg.Header.MsgType), msg.Body.TOCID)
+}
+
+// TrustHeaders are published alongside a TRUST message to route it to its
+// partition, picked by TrustOrderingKey
+func TrustHeaders(msg *types.TrustMessage) Headers {
+	return Headers{TrustPartitionHeader: strconv.Itoa(TrustPartition(TrustOrderingKey(msg)))}
+}
+
+// TrustOrderingKey is the train ID whose messages a TRUST message must be
+// handled in order with. Every message about a train carries the ID it was
+// activated under as its train ID, including those sent after a change of
+// identity, so a train stays in one partition however often it is renamed.
+func TrustOrderingKey(msg *types.TrustMessage) string {
+	return strings.TrimSpace(msg.Body.TrainID)
+}
+
+// TrustPartition picks the partition for a train ID
+func TrustPartition(trainID string) int {
+	h := fnv.New32a()
+	h.Write([]byte(strings.TrimSpace(trainID)))
+	return int(h.Sum32() % TrustPartitions)
+}
+
+// LegacyTrustQueue is the single queue every TRUST message went to before
+// they were partitioned
+const LegacyTrustQueue = "trust"
+
+// TrustPartitionQueue names the queue holding one partition of TRUST messages
+func TrustPartitionQueue(partition int) string {
+	return fmt.Sprintf("%s.%d", TrustFeed, partition)
+}
+
+// DeclareTrustPartition declares the queue holding one partition of TRUST
+// messages, which only one consumer receives from at a time so they are
+// handled in order
+func DeclareTrustPartition(ctx context.Context, b Bus, partition int) error {
+	return b.DeclareQueue(ctx, TrustFeed, TrustPartitionQueue(partition), TrustFeed+".#",
+		SingleActiveConsumer(),
+		MatchHeader(TrustPartitionHeader, strconv.Itoa(partition)),
+	)
+}
+
+// TDCRoutingKey routes TD C-class messages as td.c.<area_id>.<msg_type>
+func TDCRoutingKey(msg *types.TDCMsgBody) string {
+	return routingKey(TDFeed, "c", msg.AreaID, string(msg.MsgType))
+}
+
+// TDSRoutingKey routes TD S-class messages as td.s.<area_id>.<msg_type>
+func TDSRoutingKey(msg *types.TDSMsgBody) string {
+	return routingKey(TDFeed, "s", msg.AreaID, string(msg.MsgType))
+}
+
+// VSTPRoutingKey routes VSTP messages as vstp.<transaction_type>
+func VSTPRoutingKey(msg *types.VSTPMessage) string {
+	return routingKey(VSTPFeed, strings.ToLower(msg.VSTPCIFMsgV1.Schedule.TransactionType))
+}
+
+// routingKey joins words into a routing key, replacing anything that would
+// break the key's structure
+func routingKey(words ...string) string {
+	for i, word := range words {
+		word = strings.TrimSpace(word)
+		word = strings.NewReplacer(".", "_", "*", "_", "#", "_", " ", "_").Replace(word)
+		if word == "" {
+			word = "unknown"
+		}
+		words[i] = word
+	}
+	return strings.Join(words, ".")
+}
+
+// deadLetterHeaders copies a message's headers, adding the error that stopped
+// it being handled and the queue it came from, if any
+func deadLetterHeaders(headers Headers, queue string, cause error) Headers {
+	dead := Headers{}
+	for k, v := range headers {
+		dead[k] = v
+	}
+	dead["x-error"] = cause.Error()
+	if queue != "" {
+		dead["x-original-queue"] = queue
+	}
+	dead["x-failed-at"] = time.Now().UTC().Format(time.RFC3339)
+	return dead
+}
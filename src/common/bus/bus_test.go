@@ -0,0 +1,64 @@
+package bus
+
+import (
+	"testing"
+
+	"github.com/jack-barr3tt/gbr-engine/src/common/types"
+)
+
+func TestTrustOrderingKey(t *testing.T) {
+	tests := []struct {
+		name string
+		msg  types.TrustMessage
+		want string
+	}{
+		{
+			name: "movement",
+			msg: types.TrustMessage{
+				Header: types.TrustHeader{MsgType: types.TrainMovement},
+				Body:   types.TrustBody{TrainID: " 451A23MB01 "},
+			},
+			want: "451A23MB01",
+		},
+		{
+			name: "change of identity",
+			msg: types.TrustMessage{
+				Header: types.TrustHeader{MsgType: types.ChangeOfIdentity},
+				Body:   types.TrustBody{TrainID: "451A23MB01", CurrentTrainID: "451A23MB01", RevisedTrainID: "452B45MB01"},
+			},
+			want: "451A23MB01",
+		},
+		{
+			name: "second change of identity ordered with the original ID",
+			msg: types.TrustMessage{
+				Header: types.TrustHeader{MsgType: types.ChangeOfIdentity},
+				Body:   types.TrustBody{TrainID: "451A23MB01", CurrentTrainID: "452B45MB01", RevisedTrainID: "453C67MB01"},
+			},
+			want: "451A23MB01",
+		},
+		{
+			name: "movement after a change of identity",
+			msg: types.TrustMessage{
+				Header: types.TrustHeader{MsgType: types.TrainMovement},
+				Body:   types.TrustBody{TrainID: "451A23MB01", CurrentTrainID: "452B45MB01"},
+			},
+			want: "451A23MB01",
+		},
+		{
+			name: "change of identity without a current ID",
+			msg: types.TrustMessage{
+				Header: types.TrustHeader{MsgType: types.ChangeOfIdentity},
+				Body:   types.TrustBody{TrainID: "451A23MB01", RevisedTrainID: "452B45MB01"},
+			},
+			want: "451A23MB01",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := TrustOrderingKey(&tt.msg); got != tt.want {
+				t.Errorf("TrustOrderingKey() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,412 @@
+package bus
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/jack-barr3tt/gbr-engine/src/common/metrics"
+	"github.com/jack-barr3tt/gbr-engine/src/common/utils"
+)
+
+// MemoryBus carries messages between services running in the same process,
+// routing them to queues like a topic exchange. Messages are held in memory
+// only, and leave their queue as soon as they are delivered, so anything not
+// yet handled is lost when the process stops.
+type MemoryBus struct {
+	maxLength int
+
+	mu       sync.Mutex
+	queues   map[string]*memoryQueue
+	bindings []memoryBinding
+	closed   chan struct{}
+}
+
+type memoryBinding struct {
+	pattern []string
+	queue   *memoryQueue
+
+	// matchHeader, when set, must have matchValue in a message's headers
+	matchHeader string
+	matchValue  string
+}
+
+type memoryMessage struct {
+	key     string
+	body    []byte
+	headers Headers
+}
+
+type memoryQueue struct {
+	name string
+	feed string
+
+	mu        sync.Mutex
+	messages  []memoryMessage
+	ready     chan struct{}
+	consumers int
+
+	// space is signalled when a full queue may have room again, to wake a
+	// publisher waiting on it
+	space chan struct{}
+
+	// dropping is set once a full queue with no consumer starts dropping its
+	// oldest messages, so it is only logged when it starts
+	dropping bool
+
+	// active is held by the consumer receiving messages from a queue with a
+	// single active consumer
+	active chan struct{}
+}
+
+// NewMemoryBus creates an empty bus. Publishing to a queue holding maxLength
+// messages waits for its consumers to make room, or if it has none drops its
+// oldest message, so a queue nobody consumes cannot grow without bound; 0
+// leaves queues unbounded.
+func NewMemoryBus(maxLength int) *MemoryBus {
+	return &MemoryBus{
+		maxLength: maxLength,
+		queues:    make(map[string]*memoryQueue),
+		closed:    make(chan struct{}),
+	}
+}
+
+func (b *MemoryBus) DeclareQueue(ctx context.Context, feed, queue, bindingKey string, opts ...QueueOption) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.queueLocked(DeadLetterQueue(feed), feed)
+	q := b.queueLocked(queue, feed)
+	options := applyQueueOptions(opts)
+	if options.singleActiveConsumer && q.active == nil {
+		q.active = make(chan struct{}, 1)
+	}
+
+	binding := memoryBinding{
+		pattern:     strings.Split(bindingKey, "."),
+		queue:       q,
+		matchHeader: options.matchHeader,
+		matchValue:  options.matchValue,
+	}
+	for _, existing := range b.bindings {
+		if existing.queue == q && strings.Join(existing.pattern, ".") == bindingKey &&
+			existing.matchHeader == binding.matchHeader && existing.matchValue == binding.matchValue {
+			return nil
+		}
+	}
+	b.bindings = append(b.bindings, binding)
+	return nil
+}
+
+func (b *MemoryBus) RetireQueue(ctx context.Context, queue, bindingKey string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	q, ok := b.queues[queue]
+	if !ok {
+		return nil
+	}
+
+	bindings := b.bindings[:0]
+	for _, binding := range b.bindings {
+		if binding.queue == q && strings.Join(binding.pattern, ".") == bindingKey {
+			continue
+		}
+		bindings = append(bindings, binding)
+	}
+	b.bindings = bindings
+
+	q.mu.Lock()
+	empty := len(q.messages) == 0
+	q.mu.Unlock()
+	if empty {
+		delete(b.queues, queue)
+	}
+	return nil
+}
+
+func (b *MemoryBus) queueLocked(name, feed string) *memoryQueue {
+	q, ok := b.queues[name]
+	if !ok {
+		q = &memoryQueue{name: name, feed: feed, ready: make(chan struct{}, 1), space: make(chan struct{}, 1)}
+		b.queues[name] = q
+	}
+	return q
+}
+
+func (b *MemoryBus) Publish(ctx context.Context, key string, body []byte, headers Headers) error {
+	select {
+	case <-b.closed:
+		return fmt.Errorf("bus is closed")
+	default:
+	}
+
+	words := strings.Split(key, ".")
+
+	b.mu.Lock()
+	var matched []*memoryQueue
+	for _, binding := range b.bindings {
+		if topicMatch(binding.pattern, words) && binding.matchesHeaders(headers) {
+			matched = append(matched, binding.queue)
+		}
+	}
+	b.mu.Unlock()
+
+	// a queue bound more than once still only gets one copy
+	seen := make(map[*memoryQueue]bool)
+	for _, q := range matched {
+		if seen[q] {
+			continue
+		}
+		seen[q] = true
+		if err := b.push(ctx, q, memoryMessage{key: key, body: body, headers: headers}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *MemoryBus) DeadLetter(ctx context.Context, feed string, body []byte, headers Headers, cause error) error {
+	return b.deadLetter(ctx, feed, "", memoryMessage{body: body, headers: headers}, cause)
+}
+
+func (b *MemoryBus) deadLetter(ctx context.Context, feed, queue string, msg memoryMessage, cause error) error {
+	b.mu.Lock()
+	dead, ok := b.queues[DeadLetterQueue(feed)]
+	b.mu.Unlock()
+	if !ok {
+		return fmt.Errorf("no queues have been declared for feed %s", feed)
+	}
+
+	msg.headers = deadLetterHeaders(msg.headers, queue, cause)
+	return b.push(ctx, dead, msg)
+}
+
+// push adds a message to a queue. A full queue with a consumer holds up the
+// publisher until there is room, while one with none drops its oldest message.
+func (b *MemoryBus) push(ctx context.Context, q *memoryQueue, msg memoryMessage) error {
+	for {
+		q.mu.Lock()
+		full := b.maxLength > 0 && len(q.messages) >= b.maxLength
+		if !full || q.consumers == 0 {
+			if full {
+				q.messages[0] = memoryMessage{}
+				q.messages = q.messages[1:]
+				metrics.DroppedMessages.WithLabelValues(q.name).Inc()
+				if !q.dropping {
+					utils.GetLogger().Warnw("queue is full with no consumer, dropping its oldest messages", "queue", q.name, "max_length", b.maxLength)
+				}
+			}
+			q.dropping = full
+			q.messages = append(q.messages, msg)
+			room := b.maxLength == 0 || len(q.messages) < b.maxLength
+			q.mu.Unlock()
+
+			signal(q.ready)
+			// pass the wake up on to any other publisher waiting for room
+			if room {
+				signal(q.space)
+			}
+			return nil
+		}
+		q.mu.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-b.closed:
+			return fmt.Errorf("bus is closed")
+		case <-q.space:
+		}
+	}
+}
+
+// signal wakes whatever is waiting on a channel, if anything is
+func signal(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
+func (q *memoryQueue) pop() (memoryMessage, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if len(q.messages) == 0 {
+		return memoryMessage{}, false
+	}
+	msg := q.messages[0]
+	q.messages[0] = memoryMessage{}
+	q.messages = q.messages[1:]
+
+	// wake any other consumer of the queue while there is more to deliver
+	if len(q.messages) > 0 {
+		signal(q.ready)
+	}
+	signal(q.space)
+	return msg, true
+}
+
+// consuming counts a consumer on the queue until the returned function is
+// called. Publishers waiting for room are woken once the last consumer stops,
+// since the queue then drops messages rather than waiting.
+func (q *memoryQueue) consuming() func() {
+	q.mu.Lock()
+	q.consumers++
+	q.mu.Unlock()
+
+	return func() {
+		q.mu.Lock()
+		q.consumers--
+		q.mu.Unlock()
+		signal(q.space)
+	}
+}
+
+func (b *MemoryBus) Consume(ctx context.Context, queue string, opts ...ConsumeOption) (<-chan Delivery, error) {
+	options := applyConsumeOptions(opts)
+
+	b.mu.Lock()
+	q, ok := b.queues[queue]
+	b.mu.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("queue %s has not been declared", queue)
+	}
+
+	// inflight holds a slot for each message delivered but not yet settled
+	var inflight chan struct{}
+	if options.prefetch > 0 {
+		inflight = make(chan struct{}, options.prefetch)
+	}
+
+	deliveries := make(chan Delivery)
+	stopConsuming := q.consuming()
+	go func() {
+		defer close(deliveries)
+		defer stopConsuming()
+
+		if q.active != nil {
+			select {
+			case <-ctx.Done():
+				return
+			case <-b.closed:
+				return
+			case q.active <- struct{}{}:
+			}
+			defer func() { <-q.active }()
+		}
+
+		for {
+			if inflight != nil {
+				select {
+				case <-ctx.Done():
+					return
+				case <-b.closed:
+					return
+				case inflight <- struct{}{}:
+				}
+			}
+
+			msg, ok := q.pop()
+			for !ok {
+				select {
+				case <-ctx.Done():
+					return
+				case <-b.closed:
+					return
+				case <-q.ready:
+					msg, ok = q.pop()
+				}
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-b.closed:
+				return
+			case deliveries <- b.delivery(q, msg, inflight):
+			}
+		}
+	}()
+
+	return deliveries, nil
+}
+
+// delivery wraps a message from a queue, freeing its slot in the consumer's
+// prefetch window, if it has one, once it is settled
+func (b *MemoryBus) delivery(q *memoryQueue, msg memoryMessage, inflight chan struct{}) Delivery {
+	var once sync.Once
+	settle := func() {
+		if inflight != nil {
+			once.Do(func() { <-inflight })
+		}
+	}
+
+	return Delivery{
+		Key:     msg.key,
+		Body:    msg.body,
+		Headers: msg.headers,
+		queue:   q.name,
+		ack: func() error {
+			settle()
+			return nil
+		},
+		reject: func(ctx context.Context, cause error) error {
+			defer settle()
+			return b.deadLetter(ctx, q.feed, q.name, msg, cause)
+		},
+	}
+}
+
+func (b *MemoryBus) Ping(ctx context.Context) error {
+	select {
+	case <-b.closed:
+		return fmt.Errorf("bus is closed")
+	default:
+		return nil
+	}
+}
+
+func (b *MemoryBus) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	select {
+	case <-b.closed:
+	default:
+		close(b.closed)
+	}
+	return nil
+}
+
+func (binding *memoryBinding) matchesHeaders(headers Headers) bool {
+	if binding.matchHeader == "" {
+		return true
+	}
+	value, ok := headers[binding.matchHeader].(string)
+	return ok && value == binding.matchValue
+}
+
+// topicMatch reports whether a routing key matches a binding pattern, where *
+// matches exactly one word and # matches zero or more
+func topicMatch(pattern, words []string) bool {
+	if len(pattern) == 0 {
+		return len(words) == 0
+	}
+
+	switch pattern[0] {
+	case "#":
+		for i := 0; i <= len(words); i++ {
+			if topicMatch(pattern[1:], words[i:]) {
+				return true
+			}
+		}
+		return false
+	case "*":
+		return len(words) > 0 && topicMatch(pattern[1:], words[1:])
+	default:
+		return len(words) > 0 && pattern[0] == words[0] && topicMatch(pattern[1:], words[1:])
+	}
+}
@@ -0,0 +1,232 @@
+package bus
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTopicMatch(t *testing.T) {
+	tests := []struct {
+		pattern string
+		key     string
+		want    bool
+	}{
+		{"trust.#", "trust.0003.25", true},
+		{"trust.#", "trust", true},
+		{"trust.#", "vstp.create", false},
+		{"trust.0001.*", "trust.0001.25", true},
+		{"trust.0001.*", "trust.0003.25", false},
+		{"trust.0001.*", "trust.0001", false},
+		{"trust.*", "trust.0003.25", false},
+		{"td.c.#", "td.c.SK", true},
+		{"td.c.#", "td.s.SK", false},
+		{"#", "anything.at.all", true},
+		{"#.25", "trust.0003.25", true},
+		{"#.25", "25", true},
+		{"#.25", "trust.0003.26", false},
+		{"trust.#.25", "trust.25", true},
+		{"*", "trust", true},
+		{"*", "trust.0003", false},
+		{"vstp", "vstp", true},
+		{"vstp", "vstpx", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.pattern+" "+tt.key, func(t *testing.T) {
+			got := topicMatch(strings.Split(tt.pattern, "."), strings.Split(tt.key, "."))
+			if got != tt.want {
+				t.Errorf("topicMatch(%q, %q) = %v, want %v", tt.pattern, tt.key, got, tt.want)
+			}
+		})
+	}
+}
+
+// quiet is how long a test waits to be sure nothing is delivered
+const quiet = 50 * time.Millisecond
+
+func receive(t *testing.T, deliveries <-chan Delivery) Delivery {
+	t.Helper()
+	select {
+	case d, ok := <-deliveries:
+		if !ok {
+			t.Fatal("deliveries closed")
+		}
+		return d
+	case <-time.After(time.Second):
+		t.Fatal("no message delivered")
+		return Delivery{}
+	}
+}
+
+func expectNothing(t *testing.T, deliveries <-chan Delivery) {
+	t.Helper()
+	select {
+	case d := <-deliveries:
+		t.Fatalf("unexpected message %q delivered", d.Body)
+	case <-time.After(quiet):
+	}
+}
+
+func newTestBus(t *testing.T, maxLength int, opts ...QueueOption) *MemoryBus {
+	t.Helper()
+	b := NewMemoryBus(maxLength)
+	t.Cleanup(func() { b.Close() })
+	if err := b.DeclareQueue(context.Background(), "test", "q", "test.#", opts...); err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func publish(t *testing.T, b *MemoryBus, bodies ...string) {
+	t.Helper()
+	for _, body := range bodies {
+		if err := b.Publish(context.Background(), "test.key", []byte(body), nil); err != nil {
+			t.Fatalf("Publish(%q) error = %v", body, err)
+		}
+	}
+}
+
+func TestMemoryBusPrefetch(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	b := newTestBus(t, 0)
+	publish(t, b, "1", "2", "3")
+
+	deliveries, err := b.Consume(ctx, "q", Prefetch(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	first := receive(t, deliveries)
+	receive(t, deliveries)
+	expectNothing(t, deliveries)
+
+	first.Ack()
+	if d := receive(t, deliveries); string(d.Body) != "3" {
+		t.Errorf("delivered %q once a slot was freed, want 3", d.Body)
+	}
+}
+
+func TestMemoryBusBackPressure(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	b := newTestBus(t, 1)
+
+	deliveries, err := b.Consume(ctx, "q")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the consumer holds the first message until it is received, so the
+	// second fills the queue
+	publish(t, b, "1", "2")
+
+	timeout, cancelTimeout := context.WithTimeout(ctx, quiet)
+	defer cancelTimeout()
+	if err := b.Publish(timeout, "test.key", []byte("3"), nil); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Publish() to a full queue = %v, want %v", err, context.DeadlineExceeded)
+	}
+
+	published := make(chan error, 1)
+	go func() { published <- b.Publish(ctx, "test.key", []byte("3"), nil) }()
+
+	for _, want := range []string{"1", "2", "3"} {
+		if d := receive(t, deliveries); string(d.Body) != want {
+			t.Errorf("delivered %q, want %q", d.Body, want)
+		}
+	}
+	if err := <-published; err != nil {
+		t.Errorf("Publish() once there was room = %v", err)
+	}
+}
+
+func TestMemoryBusDropOldest(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	b := newTestBus(t, 2)
+
+	// nothing consumes the queue, so publishing never waits
+	publish(t, b, "1", "2", "3", "4")
+
+	deliveries, err := b.Consume(ctx, "q")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"3", "4"} {
+		if d := receive(t, deliveries); string(d.Body) != want {
+			t.Errorf("delivered %q, want %q", d.Body, want)
+		}
+	}
+	expectNothing(t, deliveries)
+}
+
+func TestMemoryBusSingleActiveConsumer(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	b := newTestBus(t, 0, SingleActiveConsumer())
+
+	firstCtx, stopFirst := context.WithCancel(ctx)
+	first, err := b.Consume(firstCtx, "q")
+	if err != nil {
+		t.Fatal(err)
+	}
+	publish(t, b, "1")
+	receive(t, first)
+
+	second, err := b.Consume(ctx, "q")
+	if err != nil {
+		t.Fatal(err)
+	}
+	publish(t, b, "2")
+	if d := receive(t, first); string(d.Body) != "2" {
+		t.Errorf("active consumer received %q, want 2", d.Body)
+	}
+	expectNothing(t, second)
+
+	stopFirst()
+	for range first {
+	}
+	publish(t, b, "3")
+	if d := receive(t, second); string(d.Body) != "3" {
+		t.Errorf("consumer taking over received %q, want 3", d.Body)
+	}
+}
+
+func TestMemoryBusMatchHeader(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	b := NewMemoryBus(0)
+	defer b.Close()
+
+	partitions := make([]<-chan Delivery, 2)
+	for i := range partitions {
+		queue := fmt.Sprintf("trust.%d", i)
+		if err := b.DeclareQueue(ctx, TrustFeed, queue, "trust.#", MatchHeader(TrustPartitionHeader, fmt.Sprint(i))); err != nil {
+			t.Fatal(err)
+		}
+		deliveries, err := b.Consume(ctx, queue)
+		if err != nil {
+			t.Fatal(err)
+		}
+		partitions[i] = deliveries
+	}
+
+	publishHeaders := func(body string, headers Headers) {
+		if err := b.Publish(ctx, "trust.0003.25", []byte(body), headers); err != nil {
+			t.Fatal(err)
+		}
+	}
+	publishHeaders("no header", nil)
+	publishHeaders("wrong type", Headers{TrustPartitionHeader: 1})
+	publishHeaders("partition 1", Headers{TrustPartitionHeader: "1"})
+
+	if d := receive(t, partitions[1]); string(d.Body) != "partition 1" {
+		t.Errorf("partition 1 received %q", d.Body)
+	}
+	expectNothing(t, partitions[0])
+	expectNothing(t, partitions[1])
+}
@@ -0,0 +1,517 @@
+package bus
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/jack-barr3tt/gbr-engine/src/common/utils"
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// FeedExchange is the topic exchange every feed message is published to, so
+// consumers can bind queues for just the messages they need
+const FeedExchange = "feeds"
+
+const (
+	publishAttempts = 5
+	publishTimeout  = 5 * time.Second
+
+	minReconnectBackoff = 1 * time.Second
+	maxReconnectBackoff = 2 * time.Minute
+)
+
+// DeadLetterExchange is where messages from a feed that could not be handled
+// are sent, along with the error that stopped them being handled
+func DeadLetterExchange(feed string) string {
+	return feed + ".dlx"
+}
+
+// RabbitBus carries messages over RabbitMQ. Messages are persistent and
+// published on a channel in confirm mode, so Publish only returns once the
+// broker has them, and each queue is consumed on its own channel. If the
+// connection is lost the bus redials the broker with exponential backoff, and
+// consumers carry on from the new connection once it is up.
+type RabbitBus struct {
+	mu      sync.Mutex
+	conn    *amqp.Connection
+	channel *amqp.Channel
+	feeds   map[string]string
+	closed  chan struct{}
+}
+
+// NewRabbitBus connects to the broker configured by MQ_HOST, MQ_PORT, MQ_USER
+// and MQ_PASSWORD
+func NewRabbitBus() (*RabbitBus, error) {
+	conn, channel, err := dialRabbit()
+	if err != nil {
+		return nil, err
+	}
+
+	b := &RabbitBus{conn: conn, channel: channel, feeds: make(map[string]string), closed: make(chan struct{})}
+	go b.reconnect(conn, channel)
+	return b, nil
+}
+
+// dialRabbit connects to the broker and opens the channel messages are
+// published on
+func dialRabbit() (*amqp.Connection, *amqp.Channel, error) {
+	conn, err := utils.NewRabbitConnectionOnly()
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to connect to RabbitMQ: %w", err)
+	}
+
+	channel, err := conn.Channel()
+	if err != nil {
+		conn.Close()
+		return nil, nil, fmt.Errorf("failed to open RabbitMQ channel: %w", err)
+	}
+	if err := channel.Confirm(false); err != nil {
+		conn.Close()
+		return nil, nil, fmt.Errorf("failed to put channel in confirm mode: %w", err)
+	}
+
+	return conn, channel, nil
+}
+
+// reconnect waits for the connection or the publishing channel to close, then
+// dials the broker again with exponential backoff until it succeeds, over and
+// over until the bus is closed
+func (b *RabbitBus) reconnect(conn *amqp.Connection, channel *amqp.Channel) {
+	logger := utils.GetLogger()
+
+	for {
+		connClosed := conn.NotifyClose(make(chan *amqp.Error, 1))
+		channelClosed := channel.NotifyClose(make(chan *amqp.Error, 1))
+
+		var err *amqp.Error
+		select {
+		case <-b.closed:
+			return
+		case err = <-connClosed:
+		case err = <-channelClosed:
+		}
+		select {
+		case <-b.closed:
+			return
+		default:
+		}
+		logger.Warnw("RabbitMQ connection lost, reconnecting", "error", err)
+		conn.Close()
+
+		backoff := minReconnectBackoff
+		for {
+			select {
+			case <-b.closed:
+				return
+			case <-time.After(backoff):
+			}
+
+			var dialErr error
+			if conn, channel, dialErr = dialRabbit(); dialErr == nil {
+				break
+			}
+			backoff = min(backoff*2, maxReconnectBackoff)
+			logger.Warnw("failed to reconnect to RabbitMQ", "backoff", backoff, "error", dialErr)
+		}
+
+		b.mu.Lock()
+		b.conn, b.channel = conn, channel
+		b.mu.Unlock()
+		logger.Infow("reconnected to RabbitMQ")
+	}
+}
+
+// connection returns the current connection to the broker
+func (b *RabbitBus) connection() *amqp.Connection {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.conn
+}
+
+// publishChannel returns the channel messages are currently published on
+func (b *RabbitBus) publishChannel() *amqp.Channel {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.channel
+}
+
+func (b *RabbitBus) DeclareQueue(ctx context.Context, feed, queue, bindingKey string, opts ...QueueOption) error {
+	options := applyQueueOptions(opts)
+
+	// declarations get their own channel, since a failed one closes the
+	// channel it was made on
+	channel, err := b.connection().Channel()
+	if err != nil {
+		return fmt.Errorf("failed to open RabbitMQ channel: %w", err)
+	}
+	defer channel.Close()
+
+	if err := b.declareDeadLetter(channel, feed); err != nil {
+		return err
+	}
+
+	if err := channel.ExchangeDeclare(FeedExchange, amqp.ExchangeTopic, true, false, false, false, nil); err != nil {
+		return fmt.Errorf("failed to declare feed exchange: %w", err)
+	}
+
+	args := amqp.Table{
+		"x-dead-letter-exchange": DeadLetterExchange(feed),
+	}
+	if options.singleActiveConsumer {
+		args["x-single-active-consumer"] = true
+	}
+
+	if err := b.declareQueue(queue, args); err != nil {
+		return fmt.Errorf("failed to declare %s queue: %w", queue, err)
+	}
+
+	if err := bindQueue(channel, queue, bindingKey, options); err != nil {
+		return fmt.Errorf("failed to bind %s queue: %w", queue, err)
+	}
+
+	b.mu.Lock()
+	b.feeds[queue] = feed
+	b.mu.Unlock()
+	return nil
+}
+
+// bindQueue binds a queue to the feed exchange. A queue matching a header is
+// bound through a headers exchange of its own, which is bound to the feed
+// exchange with the queue's binding key, so it only receives messages matching
+// both.
+func bindQueue(channel *amqp.Channel, queue, bindingKey string, options queueOptions) error {
+	if options.matchHeader == "" {
+		return channel.QueueBind(queue, bindingKey, FeedExchange, false, nil)
+	}
+
+	exchange := queue + ".headers"
+	if err := channel.ExchangeDeclare(exchange, amqp.ExchangeHeaders, true, false, false, false, nil); err != nil {
+		return err
+	}
+	if err := channel.ExchangeBind(exchange, bindingKey, FeedExchange, false, nil); err != nil {
+		return err
+	}
+	return channel.QueueBind(queue, "", exchange, false, amqp.Table{
+		"x-match":           "all",
+		options.matchHeader: options.matchValue,
+	})
+}
+
+// declareQueue declares a durable queue. A queue left by an older release
+// with other arguments, such as the non-durable queues feeds were first sent
+// to, cannot be declared again, so it is deleted and declared afresh as long
+// as nothing is still consuming it and it is empty. A queue still holding
+// messages is only replaced, losing them, if REPLACE_MISMATCHED_QUEUES is
+// true.
+func (b *RabbitBus) declareQueue(queue string, args amqp.Table) error {
+	channel, err := b.connection().Channel()
+	if err != nil {
+		return err
+	}
+	_, err = channel.QueueDeclare(queue, true, false, false, false, args)
+	channel.Close()
+
+	var amqpErr *amqp.Error
+	if err == nil || !errors.As(err, &amqpErr) || amqpErr.Code != amqp.PreconditionFailed {
+		return err
+	}
+
+	channel, err = b.connection().Channel()
+	if err != nil {
+		return err
+	}
+	defer channel.Close()
+
+	ifEmpty := os.Getenv("REPLACE_MISMATCHED_QUEUES") != "true"
+	dropped, err := channel.QueueDelete(queue, true, ifEmpty, false)
+	if err != nil {
+		if ifEmpty {
+			return fmt.Errorf("queue was declared differently and is still in use or holds messages; stop its consumers and drain it, or set REPLACE_MISMATCHED_QUEUES=true to drop them: %w", err)
+		}
+		return fmt.Errorf("queue was declared differently and could not be replaced: %w", err)
+	}
+	utils.GetLogger().Warnw("replaced queue declared differently by an older release", "queue", queue, "dropped_messages", dropped)
+
+	_, err = channel.QueueDeclare(queue, true, false, false, false, args)
+	return err
+}
+
+func (b *RabbitBus) RetireQueue(ctx context.Context, queue, bindingKey string) error {
+	// a missing queue closes the channel it was looked up on
+	channel, err := b.connection().Channel()
+	if err != nil {
+		return fmt.Errorf("failed to open RabbitMQ channel: %w", err)
+	}
+	_, err = channel.QueueDeclarePassive(queue, false, false, false, false, nil)
+	channel.Close()
+
+	var amqpErr *amqp.Error
+	if errors.As(err, &amqpErr) && amqpErr.Code == amqp.NotFound {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to look up %s queue: %w", queue, err)
+	}
+
+	channel, err = b.connection().Channel()
+	if err != nil {
+		return fmt.Errorf("failed to open RabbitMQ channel: %w", err)
+	}
+	defer channel.Close()
+
+	if err := channel.QueueUnbind(queue, bindingKey, FeedExchange, nil); err != nil {
+		return fmt.Errorf("failed to unbind %s queue: %w", queue, err)
+	}
+
+	// a queue still being drained, or that nobody drains, is left for now
+	if _, err := channel.QueueDelete(queue, true, true, false); err != nil {
+		utils.GetLogger().Warnw("retired queue still in use or not empty, leaving it in place", "queue", queue, "error", err)
+		return nil
+	}
+	utils.GetLogger().Infow("deleted retired queue", "queue", queue)
+	return nil
+}
+
+// declareDeadLetter declares the dead letter exchange for a feed and the queue
+// that collects everything sent to it
+func (b *RabbitBus) declareDeadLetter(channel *amqp.Channel, feed string) error {
+	exchange := DeadLetterExchange(feed)
+	if err := channel.ExchangeDeclare(exchange, amqp.ExchangeFanout, true, false, false, false, nil); err != nil {
+		return fmt.Errorf("failed to declare dead letter exchange: %w", err)
+	}
+
+	queue := DeadLetterQueue(feed)
+	if _, err := channel.QueueDeclare(queue, true, false, false, false, nil); err != nil {
+		return fmt.Errorf("failed to declare dead letter queue: %w", err)
+	}
+
+	if err := channel.QueueBind(queue, "", exchange, false, nil); err != nil {
+		return fmt.Errorf("failed to bind dead letter queue: %w", err)
+	}
+
+	b.mu.Lock()
+	b.feeds[queue] = feed
+	b.mu.Unlock()
+	return nil
+}
+
+func (b *RabbitBus) Publish(ctx context.Context, key string, body []byte, headers Headers) error {
+	return b.publishConfirmed(ctx, FeedExchange, key, amqp.Publishing{
+		ContentType: "application/json",
+		Headers:     amqp.Table(headers),
+		Body:        body,
+	})
+}
+
+func (b *RabbitBus) DeadLetter(ctx context.Context, feed string, body []byte, headers Headers, cause error) error {
+	return b.deadLetter(ctx, feed, "", body, headers, cause)
+}
+
+func (b *RabbitBus) deadLetter(ctx context.Context, feed, queue string, body []byte, headers Headers, cause error) error {
+	return b.publishConfirmed(ctx, DeadLetterExchange(feed), "", amqp.Publishing{
+		ContentType: "application/json",
+		Headers:     amqp.Table(deadLetterHeaders(headers, queue, cause)),
+		Body:        body,
+	})
+}
+
+// publishConfirmed publishes a persistent message and waits for the broker to
+// confirm it, retrying with backoff if it is not confirmed
+func (b *RabbitBus) publishConfirmed(ctx context.Context, exchange, key string, msg amqp.Publishing) error {
+	msg.DeliveryMode = amqp.Persistent
+	if msg.Timestamp.IsZero() {
+		msg.Timestamp = time.Now()
+	}
+
+	backoff := 100 * time.Millisecond
+	var err error
+	for attempt := 1; attempt <= publishAttempts; attempt++ {
+		if err = b.publishOnce(ctx, exchange, key, msg); err == nil {
+			return nil
+		}
+
+		if attempt == publishAttempts {
+			break
+		}
+		utils.GetLogger().Debugw("retrying publish", "exchange", exchange, "key", key, "attempt", attempt, "error", err)
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+
+	return fmt.Errorf("failed to publish after %d attempts: %w", publishAttempts, err)
+}
+
+func (b *RabbitBus) publishOnce(ctx context.Context, exchange, key string, msg amqp.Publishing) error {
+	ctx, cancel := context.WithTimeout(ctx, publishTimeout)
+	defer cancel()
+
+	confirm, err := b.publishChannel().PublishWithDeferredConfirmWithContext(ctx, exchange, key, false, false, msg)
+	if err != nil {
+		return err
+	}
+
+	acked, err := confirm.WaitContext(ctx)
+	if err != nil {
+		return err
+	}
+	if !acked {
+		return fmt.Errorf("broker rejected message")
+	}
+	return nil
+}
+
+// Consume delivers messages from a queue until the context is cancelled or the
+// bus is closed. If the channel it is consumed on closes, such as when the
+// connection is lost, the queue is consumed again with exponential backoff;
+// messages delivered but not yet settled on the old channel are redelivered.
+func (b *RabbitBus) Consume(ctx context.Context, queue string, opts ...ConsumeOption) (<-chan Delivery, error) {
+	options := applyConsumeOptions(opts)
+
+	b.mu.Lock()
+	feed, ok := b.feeds[queue]
+	b.mu.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("queue %s has not been declared", queue)
+	}
+
+	channel, msgs, err := b.consume(queue, options)
+	if err != nil {
+		return nil, err
+	}
+
+	deliveries := make(chan Delivery)
+	go func() {
+		defer close(deliveries)
+
+		backoff := minReconnectBackoff
+		for {
+			if b.forward(ctx, feed, queue, msgs, deliveries) {
+				backoff = minReconnectBackoff
+			}
+			channel.Close()
+
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case <-b.closed:
+					return
+				case <-time.After(backoff):
+				}
+
+				channel, msgs, err = b.consume(queue, options)
+				if err == nil {
+					break
+				}
+				backoff = min(backoff*2, maxReconnectBackoff)
+				utils.GetLogger().Warnw("failed to consume queue again", "queue", queue, "backoff", backoff, "error", err)
+			}
+			utils.GetLogger().Infow("consuming queue again", "queue", queue)
+		}
+	}()
+
+	return deliveries, nil
+}
+
+// consume opens a channel on the current connection and starts consuming a
+// queue on it
+func (b *RabbitBus) consume(queue string, options consumeOptions) (*amqp.Channel, <-chan amqp.Delivery, error) {
+	channel, err := b.connection().Channel()
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to open RabbitMQ channel: %w", err)
+	}
+
+	if options.prefetch > 0 {
+		if err := channel.Qos(options.prefetch, 0, false); err != nil {
+			channel.Close()
+			return nil, nil, fmt.Errorf("failed to set prefetch for %s queue: %w", queue, err)
+		}
+	}
+
+	msgs, err := channel.Consume(queue, "", false, false, false, false, nil)
+	if err != nil {
+		channel.Close()
+		return nil, nil, fmt.Errorf("failed to consume %s queue: %w", queue, err)
+	}
+	return channel, msgs, nil
+}
+
+// forward passes messages from a channel's consumer on until it stops or the
+// context is cancelled, reporting whether any were passed on
+func (b *RabbitBus) forward(ctx context.Context, feed, queue string, msgs <-chan amqp.Delivery, deliveries chan<- Delivery) bool {
+	forwarded := false
+	for {
+		select {
+		case <-ctx.Done():
+			return forwarded
+		case msg, ok := <-msgs:
+			if !ok {
+				return forwarded
+			}
+
+			select {
+			case <-ctx.Done():
+				return forwarded
+			case deliveries <- b.delivery(feed, queue, msg):
+				forwarded = true
+			}
+		}
+	}
+}
+
+// delivery wraps a message from a queue. If a rejected message cannot be
+// dead lettered it is rejected by the broker instead, so the queue's dead
+// letter exchange still captures it, just without the error.
+func (b *RabbitBus) delivery(feed, queue string, msg amqp.Delivery) Delivery {
+	return Delivery{
+		Key:     msg.RoutingKey,
+		Body:    msg.Body,
+		Headers: Headers(msg.Headers),
+		queue:   queue,
+		ack: func() error {
+			return msg.Ack(false)
+		},
+		reject: func(ctx context.Context, cause error) error {
+			if err := b.deadLetter(ctx, feed, queue, msg.Body, Headers(msg.Headers), cause); err != nil {
+				utils.GetLogger().Warnw("failed to dead letter message", "feed", feed, "error", err)
+				return msg.Nack(false, false)
+			}
+			return msg.Ack(false)
+		},
+	}
+}
+
+func (b *RabbitBus) Ping(ctx context.Context) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.conn.IsClosed() {
+		return fmt.Errorf("connection to RabbitMQ is closed")
+	}
+	if b.channel.IsClosed() {
+		return fmt.Errorf("publishing channel is closed")
+	}
+	return nil
+}
+
+func (b *RabbitBus) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	select {
+	case <-b.closed:
+		return nil
+	default:
+		close(b.closed)
+	}
+	return b.conn.Close()
+}
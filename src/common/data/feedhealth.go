@@ -0,0 +1,65 @@
+package data
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	api_types "github.com/jack-barr3tt/gbr-engine/src/common/api-types"
+	"github.com/jack-barr3tt/gbr-engine/src/common/utils"
+)
+
+// GetFeedHealth reports the health of each feed topic and TD area as last
+// stored by the queuer, flagging any that have been silent for longer than
+// staleAfter. A topic that has never received a message is always stale.
+func (dc *DataClient) GetFeedHealth(staleAfter time.Duration) (*api_types.FeedHealthResponse, error) {
+	ctx := context.Background()
+
+	topics, heartbeats, err := utils.LoadFeedHealth(ctx, dc.rdb)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	status := "healthy"
+
+	response := &api_types.FeedHealthResponse{
+		StaleAfterSeconds: int(staleAfter.Seconds()),
+		Topics:            []api_types.FeedTopicHealth{},
+		TdAreas:           []api_types.TDAreaHealth{},
+	}
+
+	for _, topic := range topics {
+		health := api_types.FeedTopicHealth{
+			Topic:             topic.Topic,
+			MessagesPerMinute: topic.MessagesPerMinute,
+			Total:             topic.Total,
+			Stale:             topic.LastMessage.IsZero() || now.Sub(topic.LastMessage) > staleAfter,
+		}
+		if !topic.LastMessage.IsZero() {
+			last := topic.LastMessage
+			health.LastMessage = &last
+		}
+		if health.Stale {
+			status = "stale"
+		}
+		response.Topics = append(response.Topics, health)
+	}
+	sort.Slice(response.Topics, func(i, j int) bool { return response.Topics[i].Topic < response.Topics[j].Topic })
+
+	for areaID, at := range heartbeats {
+		health := api_types.TDAreaHealth{
+			AreaId:        areaID,
+			LastHeartbeat: at,
+			Stale:         now.Sub(at) > staleAfter,
+		}
+		if health.Stale {
+			status = "stale"
+		}
+		response.TdAreas = append(response.TdAreas, health)
+	}
+	sort.Slice(response.TdAreas, func(i, j int) bool { return response.TdAreas[i].AreaId < response.TdAreas[j].AreaId })
+
+	response.Status = status
+	return response, nil
+}
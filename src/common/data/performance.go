@@ -0,0 +1,327 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"time"
+
+	api_types "github.com/jack-barr3tt/gbr-engine/src/common/api-types"
+	"github.com/jack-barr3tt/gbr-engine/src/common/metrics"
+	"github.com/jack-barr3tt/gbr-engine/src/common/types"
+	"github.com/jack-barr3tt/gbr-engine/src/common/utils"
+	openapi_types "github.com/oapi-codegen/runtime/types"
+)
+
+type PerformanceFilters struct {
+	TrainUID        *string
+	Headcode        *string
+	Origin          string
+	Destination     string
+	DateFrom        time.Time
+	DateTo          time.Time
+	OnTimeThreshold int
+}
+
+type performanceDay struct {
+	day    api_types.ServicePerformanceDay
+	points []archivedPoint
+}
+
+type archivedPoint struct {
+	stanox    string
+	eventType string
+	planned   string
+	actual    *time.Time
+	variation *int
+	source    sql.NullString
+}
+
+// GetServicePerformance builds the day by day performance of the services
+// matching the filters from the movement archive, summarising punctuality at
+// the destination (or the last recorded timing point if none is given)
+func (dc *DataClient) GetServicePerformance(filters PerformanceFilters) (*api_types.ServicePerformanceResponse, error) {
+	defer metrics.QueryTimer("get_service_performance").ObserveDuration()
+
+	ctx := context.Background()
+
+	conditions := []string{"m.run_date BETWEEN $1 AND $2"}
+	args := []interface{}{filters.DateFrom, filters.DateTo}
+
+	if filters.TrainUID != nil {
+		args = append(args, *filters.TrainUID)
+		conditions = append(conditions, fmt.Sprintf("m.train_uid = $%d", len(args)))
+	}
+
+	if filters.Origin != "" || filters.Destination != "" {
+		// narrow down to the services scheduled between the two locations
+		serviceFilters := ServiceFilters{Headcode: filters.Headcode}
+		for _, stanox := range []string{filters.Origin, filters.Destination} {
+			if stanox != "" {
+				serviceFilters.PassesThrough = append(serviceFilters.PassesThrough, LocationFilter{Stanox: stanox})
+			}
+		}
+
+		trainUIDs, err := dc.getTrainUIDs(serviceFilters)
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, trainUIDs)
+		conditions = append(conditions, fmt.Sprintf("m.train_uid = ANY($%d)", len(args)))
+	} else if filters.Headcode != nil {
+		args = append(args, *filters.Headcode)
+		conditions = append(conditions, fmt.Sprintf("m.headcode = $%d", len(args)))
+	}
+
+	rows, err := dc.pg.Query(ctx, fmt.Sprintf(`
+		SELECT m.run_date, m.train_uid, m.headcode, m.stanox, m.event_type, m.planned_time,
+		       m.actual_timestamp, m.variation, m.source, m.canx_type, m.reason_code
+		FROM movement m
+		WHERE %s
+		ORDER BY m.run_date, m.train_uid, m.recorded_at
+	`, strings.Join(conditions, " AND ")), args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query movement archive: %w", err)
+	}
+	defer rows.Close()
+
+	var days []*performanceDay
+	var current *performanceDay
+	for rows.Next() {
+		var runDate time.Time
+		var trainUID, stanox, eventType, planned string
+		var headcode, source, canxType, reasonCode sql.NullString
+		var actual *time.Time
+		var variation *int
+
+		if err := rows.Scan(&runDate, &trainUID, &headcode, &stanox, &eventType, &planned,
+			&actual, &variation, &source, &canxType, &reasonCode); err != nil {
+			return nil, fmt.Errorf("failed to scan movement row: %w", err)
+		}
+
+		if current == nil || current.day.TrainUid != trainUID || !current.day.RunDate.Time.Equal(runDate) {
+			current = &performanceDay{
+				day: api_types.ServicePerformanceDay{
+					RunDate:      openapi_types.Date{Time: runDate},
+					TrainUid:     trainUID,
+					TimingPoints: []api_types.TimingPointPerformance{},
+				},
+			}
+			days = append(days, current)
+		}
+		if current.day.Headcode == nil && headcode.Valid {
+			current.day.Headcode = &headcode.String
+		}
+
+		switch eventType {
+		case types.MovementCancellation:
+			current.day.Cancelled = true
+			current.day.CancellationType = utils.NullString(canxType.String)
+			current.day.CancellationReasonCode = utils.NullString(reasonCode.String)
+		case types.MovementReinstatement:
+			current.day.Cancelled = false
+			current.day.CancellationType = nil
+			current.day.CancellationReasonCode = nil
+		case types.MovementArrival, types.MovementDeparture, types.MovementPass:
+			current.points = append(current.points, archivedPoint{
+				stanox:    stanox,
+				eventType: eventType,
+				planned:   planned,
+				actual:    actual,
+				variation: variation,
+				source:    source,
+			})
+		}
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating movement rows: %w", err)
+	}
+
+	locations := make(map[string]api_types.Location)
+
+	response := &api_types.ServicePerformanceResponse{
+		Days: make([]api_types.ServicePerformanceDay, 0, len(days)),
+	}
+
+	for _, pd := range days {
+		sort.SliceStable(pd.points, func(i, j int) bool {
+			a, b := pd.points[i].actual, pd.points[j].actual
+			if a == nil || b == nil {
+				return a != nil
+			}
+			return a.Before(*b)
+		})
+		normaliseLateness(pd.day.RunDate.Time, pd.points)
+
+		for _, point := range sectionPoints(pd.points, filters.Origin, filters.Destination) {
+			location, ok := locations[point.stanox]
+			if !ok {
+				if details, err := dc.GetLocationDetails(point.stanox); err == nil {
+					location = *details
+				} else {
+					location = api_types.Location{TiplocCodes: []string{}}
+				}
+				location.Stanox = point.stanox
+				locations[point.stanox] = location
+			}
+
+			timingPoint := api_types.TimingPointPerformance{
+				Location:  location,
+				EventType: point.eventType,
+				Planned:   utils.NullString(point.planned),
+				Lateness:  point.variation,
+			}
+			if point.actual != nil {
+				timingPoint.Actual = utils.Ptr(point.actual.Format("15:04"))
+			}
+			if point.source.Valid {
+				timingPoint.Source = &point.source.String
+			}
+			pd.day.TimingPoints = append(pd.day.TimingPoints, timingPoint)
+
+			if point.variation != nil && (filters.Destination == "" || point.stanox == filters.Destination) {
+				pd.day.Lateness = point.variation
+			}
+		}
+
+		response.Days = append(response.Days, pd.day)
+	}
+
+	response.Summary = summarisePerformance(response.Days, filters.OnTimeThreshold)
+
+	return response, nil
+}
+
+// summarisePerformance works out the punctuality of a set of journeys. A
+// journey is on time if its lateness is within the threshold either side of
+// the planned time, so running exactly the threshold early or late is still
+// on time. Cancelled journeys count as not on time, and journeys with no
+// lateness recorded are left out of the percentage.
+func summarisePerformance(days []api_types.ServicePerformanceDay, threshold int) api_types.PerformanceSummary {
+	summary := api_types.PerformanceSummary{DaysRun: len(days)}
+
+	var delays []int
+	onTime := 0
+	for _, day := range days {
+		if day.Cancelled {
+			summary.Cancellations++
+			continue
+		}
+		if day.Lateness == nil {
+			continue
+		}
+
+		lateness := *day.Lateness
+		delays = append(delays, max(lateness, 0))
+		// a train running further ahead of time than the threshold is no
+		// more on time than one running that far behind
+		if lateness <= threshold && lateness >= -threshold {
+			onTime++
+		}
+	}
+
+	if judged := len(delays) + summary.Cancellations; judged > 0 {
+		summary.OnTimePercentage = float32(onTime) * 100 / float32(judged)
+	}
+	if len(delays) > 0 {
+		total := 0
+		for _, delay := range delays {
+			total += delay
+		}
+		sort.Ints(delays)
+
+		summary.MeanDelay = float32(total) / float32(len(delays))
+		summary.P90Delay = delays[int(math.Ceil(0.9*float64(len(delays))))-1]
+	}
+
+	return summary
+}
+
+// normaliseLateness works out the lateness of each timing point from when it
+// was actually reported and the date and time it was planned for, rather than
+// the times of day alone, so trains running across midnight are not a day
+// out. Points planned earlier in the day than the first are planned for the
+// day after the run date. Points without an actual or planned time keep the
+// lateness they were archived with.
+func normaliseLateness(runDate time.Time, points []archivedPoint) {
+	var first time.Time
+	for _, point := range points {
+		if planned, err := time.Parse("15:04", point.planned); err == nil {
+			first = planned
+			break
+		}
+	}
+
+	for i := range points {
+		point := &points[i]
+		planned, err := time.Parse("15:04", point.planned)
+		if err != nil || point.actual == nil {
+			continue
+		}
+
+		dayOffset := 0
+		if planned.Before(first) {
+			dayOffset = 1
+		}
+		// actuals hold UK local time as if it were UTC, as planned times do
+		plannedAt := time.Date(runDate.Year(), runDate.Month(), runDate.Day()+dayOffset,
+			planned.Hour(), planned.Minute(), 0, 0, time.UTC)
+		point.variation = utils.Ptr(int(point.actual.UTC().Sub(plannedAt).Minutes()))
+	}
+}
+
+// sectionPoints trims timing points to those between the first report at the
+// origin and the last report at the destination, when either is given
+func sectionPoints(points []archivedPoint, origin, destination string) []archivedPoint {
+	from, to := 0, len(points)
+	if origin != "" {
+		for i, point := range points {
+			if point.stanox == origin {
+				from = i
+				break
+			}
+		}
+	}
+	if destination != "" {
+		for i := len(points) - 1; i >= from; i-- {
+			if points[i].stanox == destination {
+				to = i + 1
+				break
+			}
+		}
+	}
+	return points[from:to]
+}
+
+// getTrainUIDs returns the distinct train UIDs of the schedules matching the
+// filters
+func (dc *DataClient) getTrainUIDs(filters ServiceFilters) ([]string, error) {
+	defer metrics.QueryTimer("get_train_uids").ObserveDuration()
+
+	filter, args := dc.buildServiceFilter(filters)
+
+	rows, err := dc.pg.Query(context.Background(), fmt.Sprintf(`
+		SELECT DISTINCT s.train_uid
+		FROM schedule s
+		%s
+	`, filter), args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to execute service query: %w", err)
+	}
+	defer rows.Close()
+
+	trainUIDs := []string{}
+	for rows.Next() {
+		var trainUID string
+		if err := rows.Scan(&trainUID); err != nil {
+			return nil, fmt.Errorf("failed to scan service row: %w", err)
+		}
+		trainUIDs = append(trainUIDs, trainUID)
+	}
+
+	return trainUIDs, rows.Err()
+}
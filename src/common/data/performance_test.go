@@ -0,0 +1,79 @@
+package data
+
+import (
+	"testing"
+
+	api_types "github.com/jack-barr3tt/gbr-engine/src/common/api-types"
+	"github.com/jack-barr3tt/gbr-engine/src/common/utils"
+)
+
+func TestSummarisePerformance(t *testing.T) {
+	ran := func(lateness int) api_types.ServicePerformanceDay {
+		return api_types.ServicePerformanceDay{Lateness: utils.Ptr(lateness)}
+	}
+	cancelled := api_types.ServicePerformanceDay{Cancelled: true, Lateness: utils.Ptr(0)}
+
+	tests := []struct {
+		name string
+		days []api_types.ServicePerformanceDay
+		want api_types.PerformanceSummary
+	}{
+		{
+			name: "no journeys",
+			want: api_types.PerformanceSummary{},
+		},
+		{
+			name: "right time",
+			days: []api_types.ServicePerformanceDay{ran(0)},
+			want: api_types.PerformanceSummary{DaysRun: 1, OnTimePercentage: 100},
+		},
+		{
+			name: "late within the threshold",
+			days: []api_types.ServicePerformanceDay{ran(4)},
+			want: api_types.PerformanceSummary{DaysRun: 1, OnTimePercentage: 100, MeanDelay: 4, P90Delay: 4},
+		},
+		{
+			name: "late on the threshold",
+			days: []api_types.ServicePerformanceDay{ran(5)},
+			want: api_types.PerformanceSummary{DaysRun: 1, OnTimePercentage: 100, MeanDelay: 5, P90Delay: 5},
+		},
+		{
+			name: "late beyond the threshold",
+			days: []api_types.ServicePerformanceDay{ran(6)},
+			want: api_types.PerformanceSummary{DaysRun: 1, OnTimePercentage: 0, MeanDelay: 6, P90Delay: 6},
+		},
+		{
+			name: "early on the threshold",
+			days: []api_types.ServicePerformanceDay{ran(-5)},
+			want: api_types.PerformanceSummary{DaysRun: 1, OnTimePercentage: 100},
+		},
+		{
+			name: "early beyond the threshold",
+			days: []api_types.ServicePerformanceDay{ran(-6)},
+			want: api_types.PerformanceSummary{DaysRun: 1, OnTimePercentage: 0},
+		},
+		{
+			name: "cancelled",
+			days: []api_types.ServicePerformanceDay{cancelled},
+			want: api_types.PerformanceSummary{DaysRun: 1, Cancellations: 1, OnTimePercentage: 0},
+		},
+		{
+			name: "no lateness recorded",
+			days: []api_types.ServicePerformanceDay{{}, ran(0)},
+			want: api_types.PerformanceSummary{DaysRun: 2, OnTimePercentage: 100},
+		},
+		{
+			name: "mixed",
+			days: []api_types.ServicePerformanceDay{ran(-6), ran(-2), ran(5), ran(10), cancelled},
+			want: api_types.PerformanceSummary{DaysRun: 5, Cancellations: 1, OnTimePercentage: 40, MeanDelay: 3.75, P90Delay: 10},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := summarisePerformance(tt.days, 5); got != tt.want {
+				t.Errorf("summarisePerformance() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
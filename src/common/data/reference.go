@@ -5,9 +5,13 @@ import (
 	"database/sql"
 
 	api_types "github.com/jack-barr3tt/gbr-engine/src/common/api-types"
+	"github.com/jack-barr3tt/gbr-engine/src/common/metrics"
+	"github.com/jack-barr3tt/gbr-engine/src/common/types"
 )
 
 func (dc *DataClient) GetAllLocations() ([]api_types.Location, error) {
+	defer metrics.QueryTimer("get_locations").ObserveDuration()
+
 	rows, err := dc.pg.Query(context.Background(), `
 		SELECT DISTINCT stanox, crs_code, description
 		FROM tiploc
@@ -59,6 +63,8 @@ func (dc *DataClient) GetAllLocations() ([]api_types.Location, error) {
 }
 
 func (dc *DataClient) GetAllOperators() ([]api_types.Operator, error) {
+	defer metrics.QueryTimer("get_operators").ObserveDuration()
+
 	rows, err := dc.pg.Query(context.Background(), `
 		SELECT code, name
 		FROM reference_toc
@@ -85,3 +91,40 @@ func (dc *DataClient) GetAllOperators() ([]api_types.Operator, error) {
 
 	return operators, nil
 }
+
+func (dc *DataClient) GetSMARTSteps() ([]types.SMARTStep, error) {
+	defer metrics.QueryTimer("get_smart_steps").ObserveDuration()
+
+	rows, err := dc.pg.Query(context.Background(), `
+		SELECT td_area, from_berth, to_berth, step_type, event, stanox, platform, berth_offset
+		FROM reference_smart
+		WHERE stanox IS NOT NULL AND event IS NOT NULL
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	steps := []types.SMARTStep{}
+
+	for rows.Next() {
+		var step types.SMARTStep
+		var fromBerth, toBerth, stepType, platform sql.NullString
+
+		if err := rows.Scan(&step.TDArea, &fromBerth, &toBerth, &stepType, &step.Event, &step.Stanox, &platform, &step.BerthOffset); err != nil {
+			return nil, err
+		}
+
+		step.FromBerth = fromBerth.String
+		step.ToBerth = toBerth.String
+		step.StepType = stepType.String
+		step.Platform = platform.String
+		steps = append(steps, step)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return steps, nil
+}
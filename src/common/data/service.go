@@ -9,6 +9,7 @@ import (
 	"time"
 
 	api_types "github.com/jack-barr3tt/gbr-engine/src/common/api-types"
+	"github.com/jack-barr3tt/gbr-engine/src/common/metrics"
 	"github.com/jack-barr3tt/gbr-engine/src/common/types"
 	"github.com/jack-barr3tt/gbr-engine/src/common/utils"
 	openapi_types "github.com/oapi-codegen/runtime/types"
@@ -102,6 +103,8 @@ func (dc *DataClient) buildServiceFilter(filters ServiceFilters) (string, []inte
 }
 
 func (dc *DataClient) GetServicesWithFilters(filters ServiceFilters) ([]api_types.ServiceResponse, error) {
+	defer metrics.QueryTimer("get_services").ObserveDuration()
+
 	filter, args := dc.buildServiceFilter(filters)
 
 	query := fmt.Sprintf(`
@@ -223,6 +226,8 @@ func (dc *DataClient) GetServicesWithFilters(filters ServiceFilters) ([]api_type
 
 // fetchScheduleLocations fetches all schedule locations for the given schedule IDs
 func (dc *DataClient) fetchScheduleLocations(scheduleIDs ...int) (map[int][]api_types.ScheduleLocation, error) {
+	defer metrics.QueryTimer("get_schedule_locations").ObserveDuration()
+
 	if len(scheduleIDs) == 0 {
 		return make(map[int][]api_types.ScheduleLocation), nil
 	}
@@ -231,7 +236,7 @@ func (dc *DataClient) fetchScheduleLocations(scheduleIDs ...int) (map[int][]api_
 		SELECT sl.schedule_id, sl.id, sl.location_type, sl.tiploc_code,
 			   sl.arrival::text, sl.public_arrival::text,
 			   sl.departure::text, sl.public_departure::text,
-			   sl.platform, sl.location_order,
+			   sl.pass::text, sl.platform, sl.location_order,
 			   t.stanox, t.crs_code, t.description
 		FROM schedule_location sl
 		LEFT JOIN tiploc t ON sl.tiploc_code = t.tiploc_code
@@ -262,6 +267,7 @@ func (dc *DataClient) fetchScheduleLocations(scheduleIDs ...int) (map[int][]api_
 			&location.PublicArrival,
 			&location.Departure,
 			&location.PublicDeparture,
+			&location.Pass,
 			&location.Platform,
 			&location.LocationOrder,
 			&stanox,
@@ -295,6 +301,8 @@ func (dc *DataClient) fetchScheduleLocations(scheduleIDs ...int) (map[int][]api_
 
 // GetLocationDetails retrieves full location details for a given stanox
 func (dc *DataClient) GetLocationDetails(stanox string) (*api_types.Location, error) {
+	defer metrics.QueryTimer("get_location").ObserveDuration()
+
 	rows, err := dc.pg.Query(context.Background(), `
 		SELECT description, crs_code, tiploc_code FROM tiploc 
 		WHERE stanox = $1
@@ -464,17 +472,27 @@ func matchesLocationFilters(service api_types.ServiceResponse, filters []Locatio
 	return true
 }
 
-func (dc *DataClient) AddRealtimeData(services []api_types.ServiceResponse, date time.Time) {
+// AddRealtimeData attaches realtime data to services seen on the given date.
+// When stanox is set, each service's run date is resolved from its call there,
+// so trains that crossed midnight before reaching it use the previous day's
+// journey.
+func (dc *DataClient) AddRealtimeData(services []api_types.ServiceResponse, date time.Time, stanox string) {
 	if len(services) == 0 {
 		return
 	}
 
-	runDate := utils.FormatRunDate(date)
+	type journeyRef struct {
+		uid     string
+		runDate string
+	}
 
-	trainUIDs := make(map[string]bool)
+	runDates := make([]string, len(services))
+	journeyRefs := make(map[string]journeyRef)
 	for i := range services {
+		runDates[i] = serviceRunDate(services[i], date, stanox)
 		if services[i].TrainUid != "" {
-			trainUIDs[strings.TrimSpace(services[i].TrainUid)] = true
+			uid := strings.TrimSpace(services[i].TrainUid)
+			journeyRefs[utils.BuildJourneyKey(uid, runDates[i])] = journeyRef{uid: uid, runDate: runDates[i]}
 		}
 	}
 	journeys := make(map[string]types.TrainJourney)
@@ -482,20 +500,20 @@ func (dc *DataClient) AddRealtimeData(services []api_types.ServiceResponse, date
 	journeyWg := &sync.WaitGroup{}
 	semaphore := make(chan struct{}, 50)
 
-	for trainUID := range trainUIDs {
+	for key, ref := range journeyRefs {
 		journeyWg.Add(1)
-		go func(uid string) {
+		go func(key string, ref journeyRef) {
 			defer journeyWg.Done()
 			semaphore <- struct{}{}
 			defer func() { <-semaphore }()
 
-			journey, err := utils.LoadTrainJourney(context.Background(), dc.pg, dc.rdb, uid, runDate)
+			journey, err := utils.LoadTrainJourney(context.Background(), dc.pg, dc.rdb, ref.uid, ref.runDate)
 			if err == nil {
 				journeyMutex.Lock()
-				journeys[uid] = journey
+				journeys[key] = journey
 				journeyMutex.Unlock()
 			}
-		}(trainUID)
+		}(key, ref)
 	}
 	journeyWg.Wait()
 	tiplocs := make(map[string]bool)
@@ -532,15 +550,14 @@ func (dc *DataClient) AddRealtimeData(services []api_types.ServiceResponse, date
 
 	for i := range services {
 		trainUid := strings.TrimSpace(services[i].TrainUid)
-		journey, hasJourney := journeys[trainUid]
+		journey, hasJourney := journeys[utils.BuildJourneyKey(trainUid, runDates[i])]
 		if !hasJourney {
 			continue
 		}
 
-		stanoxToStop := make(map[string]types.Stop)
-		for _, stop := range journey.Stops {
-			stanoxToStop[stop.Stanox] = stop
-		}
+		// Locations and journey stops are both in schedule order, so walk them
+		// together to keep repeated calls at the same stanox apart
+		nextStop := 0
 
 		for j := range services[i].Locations {
 			location := &services[i].Locations[j]
@@ -556,10 +573,25 @@ func (dc *DataClient) AddRealtimeData(services []api_types.ServiceResponse, date
 				continue
 			}
 
-			stop, found := stanoxToStop[stanox]
-			if !found {
+			stopIndex := -1
+			for k := nextStop; k < len(journey.Stops); k++ {
+				if journey.Stops[k].Stanox == stanox {
+					stopIndex = k
+					break
+				}
+			}
+			if stopIndex == -1 {
 				continue
 			}
+			nextStop = stopIndex + 1
+			stop := journey.Stops[stopIndex]
+
+			if stop.Cancelled && journey.Cancellation != nil {
+				cancelled := true
+				services[i].Locations[j].Cancelled = &cancelled
+				services[i].Locations[j].CancellationType = &journey.Cancellation.Type
+				services[i].Locations[j].CancellationReasonCode = &journey.Cancellation.ReasonCode
+			}
 
 			if stop.ActualArr != "" {
 				formattedTime := utils.FormatActualTime(stop.ActualArr)
@@ -580,6 +612,42 @@ func (dc *DataClient) AddRealtimeData(services []api_types.ServiceResponse, date
 					services[i].Locations[j].DepartureLateness = &lateness
 				}
 			}
+
+			if stop.ActualPass != "" {
+				formattedTime := utils.FormatActualTime(stop.ActualPass)
+				services[i].Locations[j].ActualPass = &formattedTime
+
+				if location.Pass != nil && *location.Pass != "" {
+					lateness := utils.CalculateLateness(*location.Pass, stop.ActualPass)
+					services[i].Locations[j].PassLateness = &lateness
+				}
+			}
 		}
 	}
 }
+
+// serviceRunDate resolves the run date of a service calling at stanox on the
+// given date, using the same rule as TRUST activations: the day the train
+// departed its origin
+func serviceRunDate(service api_types.ServiceResponse, date time.Time, stanox string) string {
+	if stanox == "" || len(service.Locations) == 0 || service.Locations[0].Departure == nil {
+		return utils.FormatRunDate(date)
+	}
+
+	for _, loc := range service.Locations {
+		if loc.Location.Stanox != stanox {
+			continue
+		}
+
+		callTime := loc.Departure
+		if callTime == nil || *callTime == "" {
+			callTime = loc.Arrival
+		}
+		if callTime == nil {
+			break
+		}
+		return utils.ResolveRunDate(date, *service.Locations[0].Departure, *callTime)
+	}
+
+	return utils.FormatRunDate(date)
+}
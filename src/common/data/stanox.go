@@ -3,9 +3,13 @@ package data
 import (
 	"context"
 	"database/sql"
+
+	"github.com/jack-barr3tt/gbr-engine/src/common/metrics"
 )
 
 func (dc *DataClient) GetStanoxByTiploc(tiploc string) (string, error) {
+	defer metrics.QueryTimer("get_stanox_by_tiploc").ObserveDuration()
+
 	var stanox sql.NullString
 	err := dc.pg.QueryRow(context.Background(), `
 		SELECT stanox FROM tiploc 
@@ -23,6 +27,8 @@ func (dc *DataClient) GetStanoxByTiploc(tiploc string) (string, error) {
 }
 
 func (dc *DataClient) GetStanoxByCRS(crsCode string) (string, error) {
+	defer metrics.QueryTimer("get_stanox_by_crs").ObserveDuration()
+
 	var stanox sql.NullString
 	err := dc.pg.QueryRow(context.Background(), `
 		SELECT stanox FROM tiploc 
@@ -41,6 +47,8 @@ func (dc *DataClient) GetStanoxByCRS(crsCode string) (string, error) {
 }
 
 func (dc *DataClient) GetStanoxByLocationName(name string) (string, error) {
+	defer metrics.QueryTimer("get_stanox_by_name").ObserveDuration()
+
 	rows, err := dc.pg.Query(context.Background(), `
 		SELECT stanox, description, tps_description FROM tiploc 
 		WHERE description ILIKE $1 OR tps_description ILIKE $1
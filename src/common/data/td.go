@@ -0,0 +1,138 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	api_types "github.com/jack-barr3tt/gbr-engine/src/common/api-types"
+	"github.com/jack-barr3tt/gbr-engine/src/common/types"
+	"github.com/jack-barr3tt/gbr-engine/src/common/utils"
+	"github.com/redis/go-redis/v9"
+)
+
+// GetSignallingState reads the current byte at an address in a TD area's
+// signalling state, along with the recent changes recorded for it
+func (dc *DataClient) GetSignallingState(areaID string, address int, historyLimit int) (*api_types.SignallingStateResponse, error) {
+	ctx := context.Background()
+	stateKey := utils.BuildSignallingKey(areaID)
+
+	exists, err := dc.rdb.Exists(ctx, stateKey).Result()
+	if err != nil {
+		return nil, err
+	}
+	if exists == 0 {
+		return nil, sql.ErrNoRows
+	}
+
+	raw, err := dc.rdb.GetRange(ctx, stateKey, int64(address), int64(address)).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	var value byte
+	if len(raw) > 0 {
+		value = raw[0]
+	}
+
+	bits := make([]bool, 8)
+	for i := range bits {
+		bits[i] = value&(1<<i) != 0
+	}
+
+	addressHex := fmt.Sprintf("%02X", address)
+	entries, err := dc.rdb.LRange(ctx, utils.BuildSignallingHistoryKey(areaID), 0, -1).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	history := []api_types.SignallingChange{}
+	for _, entry := range entries {
+		if len(history) >= historyLimit {
+			break
+		}
+
+		var change types.SignallingChange
+		if err := json.Unmarshal([]byte(entry), &change); err != nil {
+			continue
+		}
+		if change.Address != addressHex {
+			continue
+		}
+
+		history = append(history, api_types.SignallingChange{
+			Time:    change.Time,
+			MsgType: string(change.MsgType),
+			Old:     change.Old,
+			New:     change.New,
+		})
+	}
+
+	return &api_types.SignallingStateResponse{
+		AreaId:  areaID,
+		Address: addressHex,
+		Data:    fmt.Sprintf("%02X", value),
+		Bits:    bits,
+		History: history,
+	}, nil
+}
+
+// GetBerthOccupancy reads the description held in each occupied berth of a TD
+// area, ordered by berth
+func (dc *DataClient) GetBerthOccupancy(areaID string) (*api_types.BerthOccupancyResponse, error) {
+	ctx := context.Background()
+
+	entries, err := dc.rdb.HGetAll(ctx, utils.BuildBerthKey(areaID)).Result()
+	if err != nil {
+		return nil, err
+	}
+	if len(entries) == 0 {
+		return nil, sql.ErrNoRows
+	}
+
+	berths := make([]api_types.BerthOccupancy, 0, len(entries))
+	for berth, raw := range entries {
+		var occupancy types.BerthOccupancy
+		if err := json.Unmarshal([]byte(raw), &occupancy); err != nil {
+			continue
+		}
+		berths = append(berths, api_types.BerthOccupancy{
+			Berth:    berth,
+			Headcode: occupancy.Headcode,
+			Updated:  occupancy.Updated,
+		})
+	}
+	sort.Slice(berths, func(i, j int) bool { return berths[i].Berth < berths[j].Berth })
+
+	return &api_types.BerthOccupancyResponse{
+		AreaId: areaID,
+		Berths: berths,
+	}, nil
+}
+
+// GetTrainBerth reads the berth a headcode was last seen in within a TD area
+func (dc *DataClient) GetTrainBerth(areaID, headcode string) (*api_types.TrainBerthResponse, error) {
+	ctx := context.Background()
+
+	raw, err := dc.rdb.Get(ctx, utils.BuildTrainBerthKey(areaID, headcode)).Result()
+	if err == redis.Nil {
+		return nil, sql.ErrNoRows
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var position types.TrainBerth
+	if err := json.Unmarshal([]byte(raw), &position); err != nil {
+		return nil, fmt.Errorf("failed to parse train berth: %w", err)
+	}
+
+	return &api_types.TrainBerthResponse{
+		Headcode: headcode,
+		AreaId:   position.AreaID,
+		Berth:    position.Berth,
+		Updated:  position.Updated,
+	}, nil
+}
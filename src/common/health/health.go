@@ -0,0 +1,196 @@
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/jack-barr3tt/gbr-engine/src/common/bus"
+	"github.com/jack-barr3tt/gbr-engine/src/common/utils"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/redis/go-redis/v9"
+)
+
+const checkTimeout = 2 * time.Second
+
+const (
+	StatusOK     = "ok"
+	StatusFailed = "failed"
+)
+
+// Check tests that a single dependency is usable
+type Check struct {
+	Name string
+	Run  func(ctx context.Context) error
+}
+
+// ComponentStatus is the outcome of a single check
+type ComponentStatus struct {
+	Name      string  `json:"name"`
+	Status    string  `json:"status"`
+	Error     *string `json:"error,omitempty"`
+	LatencyMs int64   `json:"latency_ms"`
+}
+
+// Report is the outcome of every check, and is ready only if all of them
+// passed
+type Report struct {
+	Ready      bool              `json:"-"`
+	Status     string            `json:"status"`
+	Components []ComponentStatus `json:"components"`
+}
+
+// Checker runs a set of checks together, each with its own timeout
+type Checker struct {
+	checks []Check
+}
+
+func NewChecker(checks ...Check) *Checker {
+	return &Checker{checks: checks}
+}
+
+// Check runs every check concurrently and reports their outcomes in the order
+// the checks were given
+func (c *Checker) Check(ctx context.Context) Report {
+	components := make([]ComponentStatus, len(c.checks))
+
+	var wg sync.WaitGroup
+	for i, check := range c.checks {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			ctx, cancel := context.WithTimeout(ctx, checkTimeout)
+			defer cancel()
+
+			start := time.Now()
+			err := check.Run(ctx)
+			component := ComponentStatus{
+				Name:      check.Name,
+				Status:    StatusOK,
+				LatencyMs: time.Since(start).Milliseconds(),
+			}
+			if err != nil {
+				msg := err.Error()
+				component.Status = StatusFailed
+				component.Error = &msg
+			}
+			components[i] = component
+		}()
+	}
+	wg.Wait()
+
+	report := Report{Ready: true, Status: "ready", Components: components}
+	for _, component := range components {
+		if component.Status != StatusOK {
+			report.Ready = false
+			report.Status = "not_ready"
+		}
+	}
+	return report
+}
+
+// Postgres checks a connection can be taken from the pool
+func Postgres(db *pgxpool.Pool) Check {
+	return Check{Name: "postgres", Run: db.Ping}
+}
+
+// Redis checks Redis answers a ping
+func Redis(rdb *redis.Client) Check {
+	return Check{Name: "redis", Run: func(ctx context.Context) error {
+		return rdb.Ping(ctx).Err()
+	}}
+}
+
+// Bus checks the message bus is connected
+func Bus(b bus.Bus) Check {
+	return Check{Name: "bus", Run: b.Ping}
+}
+
+// SchemaVersion checks the database schema is at least the version this build
+// expects
+func SchemaVersion(db *pgxpool.Pool) Check {
+	return Check{Name: "schema", Run: func(ctx context.Context) error {
+		var version int
+		err := db.QueryRow(ctx, "SELECT COALESCE(MAX(version), 0) FROM schema_version").Scan(&version)
+		if err != nil {
+			return fmt.Errorf("failed to read schema version: %w", err)
+		}
+		if version < utils.SchemaVersion {
+			return fmt.Errorf("schema is version %d, expected %d", version, utils.SchemaVersion)
+		}
+		return nil
+	}}
+}
+
+// TimetableLoaded checks the CIF timetable has been loaded by the schedule
+// initializer. VSTP also adds schedules, but only CIF schedules have no
+// origin message, so one of those and the locations must be present.
+func TimetableLoaded(db *pgxpool.Pool) Check {
+	return Check{Name: "timetable", Run: func(ctx context.Context) error {
+		var loaded bool
+		err := db.QueryRow(ctx, `
+			SELECT EXISTS (SELECT 1 FROM tiploc)
+			   AND EXISTS (SELECT 1 FROM schedule WHERE origin_msg_id IS NULL)`,
+		).Scan(&loaded)
+		if err != nil {
+			return fmt.Errorf("failed to check timetable: %w", err)
+		}
+		if !loaded {
+			return errors.New("timetable has not been loaded")
+		}
+		return nil
+	}}
+}
+
+// Serve answers liveness checks on /live, which pass as long as the process
+// is running, and readiness checks on /ready, which run the checker, until
+// the context is cancelled
+func Serve(ctx context.Context, addr string, checker *Checker) error {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/live", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, map[string]string{"status": "alive"})
+	})
+	mux.HandleFunc("/ready", func(w http.ResponseWriter, r *http.Request) {
+		report := checker.Check(r.Context())
+		status := http.StatusOK
+		if !report.Ready {
+			status = http.StatusServiceUnavailable
+		}
+		writeJSON(w, status, report)
+	})
+
+	server := &http.Server{Addr: addr, Handler: mux}
+	go func() {
+		<-ctx.Done()
+		server.Close()
+	}()
+
+	if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+// ServeFromEnv runs Serve on HEALTH_ADDR, or :8081 if it is not set, logging
+// rather than returning any error so it can be started in the background
+func ServeFromEnv(ctx context.Context, checker *Checker) {
+	addr := os.Getenv("HEALTH_ADDR")
+	if addr == "" {
+		addr = ":8081"
+	}
+	if err := Serve(ctx, addr, checker); err != nil {
+		utils.GetLogger().Warnw("health server stopped", "addr", addr, "error", err)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
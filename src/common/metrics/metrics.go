@@ -0,0 +1,165 @@
+package metrics
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"os"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/prometheus/client_golang/prometheus/push"
+	"go.uber.org/zap"
+)
+
+var (
+	// FeedFrames counts frames received from each feed topic by the queuer,
+	// before they are parsed
+	FeedFrames = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "gbr_feed_frames_total",
+		Help: "Frames received from each feed topic",
+	}, []string{"topic"})
+
+	// PublishedMessages counts messages the queuer published to the bus from
+	// each feed, by whether the bus accepted them
+	PublishedMessages = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "gbr_bus_published_messages_total",
+		Help: "Messages published to the bus from each feed",
+	}, []string{"feed", "outcome"})
+
+	// ConsumedMessages counts messages taken from each queue, by whether they
+	// were acknowledged or rejected
+	ConsumedMessages = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "gbr_bus_consumed_messages_total",
+		Help: "Messages consumed from each queue",
+	}, []string{"queue", "outcome"})
+
+	// ConsumeRetries counts attempts to handle a message that are retried after
+	// failing, by the queue it came from
+	ConsumeRetries = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "gbr_bus_consume_retries_total",
+		Help: "Failed attempts to handle a message that were retried",
+	}, []string{"queue"})
+
+	// DroppedMessages counts messages the in-memory bus dropped from each
+	// queue nobody consumes once it was full
+	DroppedMessages = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "gbr_bus_dropped_messages_total",
+		Help: "Messages dropped from full in-memory queues with no consumer",
+	}, []string{"queue"})
+
+	// MergeOutcomes counts what happened when TRUST movements were merged into
+	// journeys
+	MergeOutcomes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "gbr_trust_merge_outcomes_total",
+		Help: "Outcomes of merging TRUST movements into journeys",
+	}, []string{"outcome"})
+
+	// JourneyCache counts journey lookups by whether the journey was already
+	// cached in Redis
+	JourneyCache = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "gbr_journey_cache_lookups_total",
+		Help: "Journey lookups by whether they were served from Redis",
+	}, []string{"result"})
+
+	// VSTPSchedules counts VSTP schedules by transaction type and whether they
+	// were stored
+	VSTPSchedules = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "gbr_vstp_schedules_total",
+		Help: "VSTP schedules processed by transaction type",
+	}, []string{"transaction_type", "outcome"})
+
+	// ReferenceFetches counts reference data refreshes by data set
+	ReferenceFetches = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "gbr_reference_fetches_total",
+		Help: "Reference data refreshes by data set",
+	}, []string{"key", "outcome"})
+
+	// TimetableRecords counts CIF timetable records loaded by the schedule
+	// initializer
+	TimetableRecords = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "gbr_timetable_records_total",
+		Help: "CIF timetable records loaded by record type",
+	}, []string{"record", "outcome"})
+
+	// DBQueryDuration times named database operations
+	DBQueryDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "gbr_db_query_duration_seconds",
+		Help:    "Time taken by database operations",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"query"})
+
+	// HTTPRequestDuration times API requests by the route that served them
+	HTTPRequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "gbr_http_request_duration_seconds",
+		Help:    "Time taken to serve API requests by route",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"method", "route", "status"})
+)
+
+// Outcomes used as labels
+const (
+	OutcomeOK     = "ok"
+	OutcomeFailed = "failed"
+
+	OutcomeAcked    = "acked"
+	OutcomeRejected = "rejected"
+
+	CacheHit  = "hit"
+	CacheMiss = "miss"
+)
+
+// Outcome labels an operation as ok or failed by its error
+func Outcome(err error) string {
+	if err != nil {
+		return OutcomeFailed
+	}
+	return OutcomeOK
+}
+
+// QueryTimer starts timing a database operation, which is recorded when
+// ObserveDuration is called on the returned timer
+func QueryTimer(query string) *prometheus.Timer {
+	return prometheus.NewTimer(DBQueryDuration.WithLabelValues(query))
+}
+
+// Serve exposes every metric on /metrics until the context is cancelled
+func Serve(ctx context.Context, addr string) error {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+
+	server := &http.Server{Addr: addr, Handler: mux}
+	go func() {
+		<-ctx.Done()
+		server.Close()
+	}()
+
+	if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+// ServeFromEnv runs Serve on METRICS_ADDR, or :9090 if it is not set, logging
+// rather than returning any error so it can be started in the background
+func ServeFromEnv(ctx context.Context, logger *zap.SugaredLogger) {
+	addr := os.Getenv("METRICS_ADDR")
+	if addr == "" {
+		addr = ":9090"
+	}
+	if err := Serve(ctx, addr); err != nil {
+		logger.Warnw("metrics server stopped", "addr", addr, "error", err)
+	}
+}
+
+// PushFromEnv pushes every metric to the Pushgateway at PUSHGATEWAY_URL under
+// the job name, for jobs that exit before they could be scraped. Nothing is
+// pushed if PUSHGATEWAY_URL is not set.
+func PushFromEnv(job string) error {
+	url := os.Getenv("PUSHGATEWAY_URL")
+	if url == "" {
+		return nil
+	}
+	return push.New(url, job).Gatherer(prometheus.DefaultGatherer).Push()
+}
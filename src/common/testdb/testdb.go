@@ -0,0 +1,91 @@
+// Package testdb starts a throwaway Postgres holding the repository's schema
+// for tests that need a real database.
+package testdb
+
+import (
+	"context"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	embeddedpostgres "github.com/fergusstrange/embedded-postgres"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// New starts an embedded Postgres on a free port, applies schema.sql from the
+// repository root to it and connects to it, stopping it again once the test
+// has finished. The test is skipped if Postgres cannot be started, such as
+// when its binaries cannot be downloaded.
+func New(t testing.TB) *pgxpool.Pool {
+	t.Helper()
+	ctx := context.Background()
+
+	schema, err := os.ReadFile(filepath.Join(repoRoot(t), "schema.sql"))
+	if err != nil {
+		t.Fatalf("failed to read schema: %v", err)
+	}
+
+	port, err := freePort()
+	if err != nil {
+		t.Fatalf("failed to find a free port: %v", err)
+	}
+
+	dir := t.TempDir()
+	config := embeddedpostgres.DefaultConfig().
+		Port(port).
+		Database("gbr").
+		RuntimePath(filepath.Join(dir, "runtime")).
+		DataPath(filepath.Join(dir, "data")).
+		Logger(io.Discard)
+
+	postgres := embeddedpostgres.NewDatabase(config)
+	if err := postgres.Start(); err != nil {
+		t.Skipf("embedded Postgres unavailable: %v", err)
+	}
+	t.Cleanup(func() {
+		if err := postgres.Stop(); err != nil {
+			t.Logf("failed to stop embedded Postgres: %v", err)
+		}
+	})
+
+	db, err := pgxpool.New(ctx, config.GetConnectionURL()+"?sslmode=disable")
+	if err != nil {
+		t.Fatalf("failed to connect to embedded Postgres: %v", err)
+	}
+	t.Cleanup(db.Close)
+
+	if _, err := db.Exec(ctx, string(schema)); err != nil {
+		t.Fatalf("failed to apply schema: %v", err)
+	}
+
+	return db
+}
+
+// repoRoot finds the directory holding go.mod above the test's package
+func repoRoot(t testing.TB) string {
+	dir, err := os.Getwd()
+	if err != nil {
+		t.Fatalf("failed to get working directory: %v", err)
+	}
+	for {
+		if _, err := os.Stat(filepath.Join(dir, "go.mod")); err == nil {
+			return dir
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			t.Fatal("go.mod not found above the working directory")
+		}
+		dir = parent
+	}
+}
+
+func freePort() (uint32, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return 0, err
+	}
+	defer listener.Close()
+	return uint32(listener.Addr().(*net.TCPAddr).Port), nil
+}
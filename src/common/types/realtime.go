@@ -1,15 +1,91 @@
 package types
 
+import "time"
+
+const (
+	FeedTRUST = "TRUST"
+	FeedTD    = "TD"
+)
+
 type Stop struct {
+	Stanox      string `json:"stanox"`
+	PlannedArr  string `json:"planned_arr,omitempty"`
+	PlannedDep  string `json:"planned_dep,omitempty"`
+	PlannedPass string `json:"planned_pass,omitempty"`
+	ActualArr   string `json:"actual_arr,omitempty"`
+	ActualDep   string `json:"actual_dep,omitempty"`
+	ActualPass  string `json:"actual_pass,omitempty"`
+	ArrSource   string `json:"arr_source,omitempty"`
+	DepSource   string `json:"dep_source,omitempty"`
+	PassSource  string `json:"pass_source,omitempty"`
+	Cancelled   bool   `json:"cancelled,omitempty"`
+
+	// Source timestamps are when the feed queued the message each actual came
+	// from, used to discard events delivered out of order
+	ArrSourceTime  string `json:"arr_source_time,omitempty"`
+	DepSourceTime  string `json:"dep_source_time,omitempty"`
+	PassSourceTime string `json:"pass_source_time,omitempty"`
+}
+
+// IsPass reports whether the train is only planned to pass this stop, with no
+// booked arrival or departure
+func (s *Stop) IsPass() bool {
+	return s.PlannedPass != "" && s.PlannedArr == "" && s.PlannedDep == ""
+}
+
+// Reached reports whether any actual has been recorded at this stop
+func (s *Stop) Reached() bool {
+	return s.ActualArr != "" || s.ActualDep != "" || s.ActualPass != ""
+}
+
+type Cancellation struct {
+	Type       string `json:"type"`
+	ReasonCode string `json:"reason_code"`
 	Stanox     string `json:"stanox"`
-	PlannedArr string `json:"planned_arr,omitempty"`
-	PlannedDep string `json:"planned_dep,omitempty"`
-	ActualArr  string `json:"actual_arr,omitempty"`
-	ActualDep  string `json:"actual_dep,omitempty"`
+	Timestamp  string `json:"timestamp"`
 }
 
 type TrainJourney struct {
-	UID     string `json:"uid"`
-	RunDate string `json:"run_date"`
-	Stops   []Stop `json:"stops"`
+	UID          string        `json:"uid"`
+	RunDate      string        `json:"run_date"`
+	Stops        []Stop        `json:"stops"`
+	Cancellation *Cancellation `json:"cancellation,omitempty"`
+}
+
+const (
+	MovementArrival          = "ARRIVAL"
+	MovementDeparture        = "DEPARTURE"
+	MovementPass             = "PASS"
+	MovementCancellation     = "CANCELLATION"
+	MovementReinstatement    = "REINSTATEMENT"
+	MovementChangeOfOrigin   = "CHANGE_OF_ORIGIN"
+	MovementChangeOfLocation = "CHANGE_OF_LOCATION"
+)
+
+// Movement is a realtime event as recorded in the Postgres movement archive.
+// Actual timestamps are TRUST style epoch milliseconds, and planned times are
+// HH:MM as held on journey stops.
+type Movement struct {
+	TrainUID        string
+	RunDate         string
+	TrainID         string
+	Stanox          string
+	EventType       string
+	PlannedTime     string
+	ActualTimestamp string
+	Variation       *int
+	Source          string
+	SourceTime      string
+	CanxType        string
+	ReasonCode      string
+	OriginalStanox  string
+}
+
+// FeedTopicStatus is the queuer's record of the messages it has received on
+// a feed topic since it started
+type FeedTopicStatus struct {
+	Topic             string    `json:"topic"`
+	LastMessage       time.Time `json:"last_message"`
+	MessagesPerMinute float64   `json:"messages_per_minute"`
+	Total             int64     `json:"total"`
 }
@@ -19,3 +19,34 @@ type TOCEntry struct {
 	TOC   string `json:"toc"`
 	Value string `json:"Value"`
 }
+
+type SMARTReference struct {
+	BerthData []SMARTEntry `json:"BERTHDATA"`
+}
+
+type SMARTEntry struct {
+	TD          string `json:"TD"`
+	FromBerth   string `json:"FROMBERTH"`
+	ToBerth     string `json:"TOBERTH"`
+	FromLine    string `json:"FROMLINE"`
+	ToLine      string `json:"TOLINE"`
+	BerthOffset string `json:"BERTHOFFSET"`
+	Platform    string `json:"PLATFORM"`
+	Event       string `json:"EVENT"`
+	Route       string `json:"ROUTE"`
+	Stanox      string `json:"STANOX"`
+	Stanme      string `json:"STANME"`
+	StepType    string `json:"STEPTYPE"`
+	Comment     string `json:"COMMENT"`
+}
+
+type SMARTStep struct {
+	TDArea      string
+	FromBerth   string
+	ToBerth     string
+	StepType    string
+	Event       string
+	Stanox      string
+	Platform    string
+	BerthOffset int
+}
@@ -47,3 +47,22 @@ type TDSMsgEnvelope struct {
 	SGMsgBody *TDSMsgBody `json:"SG_MSG,omitempty"`
 	SHMsgBody *TDSMsgBody `json:"SH_MSG,omitempty"`
 }
+
+type BerthOccupancy struct {
+	Headcode string `json:"headcode"`
+	Updated  string `json:"updated"`
+}
+
+type TrainBerth struct {
+	AreaID  string `json:"area_id"`
+	Berth   string `json:"berth"`
+	Updated string `json:"updated"`
+}
+
+type SignallingChange struct {
+	Time    string     `json:"time"`
+	MsgType TDSMsgType `json:"msg_type"`
+	Address string     `json:"address"`
+	Old     string     `json:"old"`
+	New     string     `json:"new"`
+}
@@ -53,4 +53,30 @@ type TrustBody struct {
 	DelayMonitoringPoint string `json:"delay_monitoring_point"`
 	ReportingStanox      string `json:"reporting_stanox"`
 	AutoExpected         string `json:"auto_expected"`
+
+	CanxTimestamp          string `json:"canx_timestamp"`
+	CanxReasonCode         string `json:"canx_reason_code"`
+	CanxType               string `json:"canx_type"`
+	OrigLocStanox          string `json:"orig_loc_stanox"`
+	OrigLocTimestamp       string `json:"orig_loc_timestamp"`
+	DepTimestamp           string `json:"dep_timestamp"`
+	ReinstatementTimestamp string `json:"reinstatement_timestamp"`
+
+	ReasonCode           string `json:"reason_code"`
+	CooTimestamp         string `json:"coo_timestamp"`
+	OriginalLocStanox    string `json:"original_loc_stanox"`
+	OriginalLocTimestamp string `json:"original_loc_timestamp"`
+	CurrentTrainID       string `json:"current_train_id"`
+	RevisedTrainID       string `json:"revised_train_id"`
+	EventTimestamp       string `json:"event_timestamp"`
+
+	ScheduleEndDate    string `json:"schedule_end_date"`
+	TpOriginTimestamp  string `json:"tp_origin_timestamp"`
+	OriginDepTimestamp string `json:"origin_dep_timestamp"`
+}
+
+type Activation struct {
+	TrainUID          string `json:"train_uid"`
+	RunDate           string `json:"run_date"`
+	ScheduleStartDate string `json:"schedule_start_date,omitempty"`
 }
@@ -0,0 +1,348 @@
+package utils
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jack-barr3tt/gbr-engine/src/common/metrics"
+	"github.com/jack-barr3tt/gbr-engine/src/common/types"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// movementPartitions remembers which monthly partitions of the movement table
+// this process has already created, so the DDL only runs once per month
+var movementPartitions sync.Map
+
+const movementPartitionFormat = "movement_y2006m01"
+
+// MovementRetention is how long archived movements are kept, taken from
+// MOVEMENT_RETENTION_DAYS and defaulting to 90 days
+func MovementRetention() time.Duration {
+	days, err := strconv.Atoi(os.Getenv("MOVEMENT_RETENTION_DAYS"))
+	if err != nil || days <= 0 {
+		days = 90
+	}
+	return time.Duration(days) * 24 * time.Hour
+}
+
+// ensureMovementPartition creates the monthly partition of the movement table
+// that holds the given run date, if it does not already exist
+func ensureMovementPartition(ctx context.Context, db *pgxpool.Pool, runDate time.Time) error {
+	monthStart := time.Date(runDate.Year(), runDate.Month(), 1, 0, 0, 0, 0, time.UTC)
+	name := monthStart.Format(movementPartitionFormat)
+	if _, ok := movementPartitions.Load(name); ok {
+		return nil
+	}
+
+	_, err := db.Exec(ctx, fmt.Sprintf(
+		`CREATE TABLE IF NOT EXISTS %s PARTITION OF movement FOR VALUES FROM ('%s') TO ('%s')`,
+		name, monthStart.Format("2006-01-02"), monthStart.AddDate(0, 1, 0).Format("2006-01-02"),
+	))
+	if err != nil {
+		return fmt.Errorf("failed to create movement partition %s: %w", name, err)
+	}
+
+	movementPartitions.Store(name, struct{}{})
+	return nil
+}
+
+// ArchiveMovement persists a realtime event to the movement archive. Events
+// are keyed by train, run date, location and planned time, so a later report
+// of the same event (such as a correction) replaces the earlier one. A
+// replaced actual keeps the time it was first recorded, so replaying the
+// archive still applies it in the order it originally arrived, but a repeated
+// cancellation or reinstatement is recorded again, since it undoes whichever
+// of the two came in between.
+func ArchiveMovement(ctx context.Context, db *pgxpool.Pool, movement *types.Movement) error {
+	defer metrics.QueryTimer("archive_movement").ObserveDuration()
+
+	runDate, err := time.Parse("20060102", movement.RunDate)
+	if err != nil {
+		return fmt.Errorf("invalid run date: %w", err)
+	}
+
+	if err := ensureMovementPartition(ctx, db, runDate); err != nil {
+		return err
+	}
+
+	var actual *time.Time
+	if actualMs := ParseIntOrZero(movement.ActualTimestamp); actualMs > 0 {
+		actual = Ptr(time.UnixMilli(int64(actualMs)).UTC())
+	}
+
+	_, err = db.Exec(ctx, `
+		INSERT INTO movement (
+			train_uid, run_date, train_id, headcode, stanox, event_type, planned_time,
+			actual_timestamp, variation, source, source_time, canx_type, reason_code,
+			original_stanox, recorded_at
+		) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, now())
+		ON CONFLICT (train_uid, run_date, event_type, stanox, planned_time) DO UPDATE SET
+			train_id = EXCLUDED.train_id,
+			headcode = EXCLUDED.headcode,
+			actual_timestamp = EXCLUDED.actual_timestamp,
+			variation = EXCLUDED.variation,
+			source = EXCLUDED.source,
+			source_time = EXCLUDED.source_time,
+			canx_type = EXCLUDED.canx_type,
+			reason_code = EXCLUDED.reason_code,
+			original_stanox = EXCLUDED.original_stanox,
+			recorded_at = CASE
+				WHEN EXCLUDED.event_type IN ($15, $16) THEN EXCLUDED.recorded_at
+				ELSE movement.recorded_at
+			END
+	`,
+		movement.TrainUID,
+		runDate,
+		NullString(movement.TrainID),
+		NullString(HeadcodeFromTrainID(movement.TrainID)),
+		movement.Stanox,
+		movement.EventType,
+		movement.PlannedTime,
+		actual,
+		movement.Variation,
+		NullString(movement.Source),
+		NullString(movement.SourceTime),
+		NullString(movement.CanxType),
+		NullString(movement.ReasonCode),
+		NullString(movement.OriginalStanox),
+		types.MovementCancellation,
+		types.MovementReinstatement,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to archive movement: %w", err)
+	}
+
+	return nil
+}
+
+// DeleteArchivedMovement removes the archived event with the same train, run
+// date, location, type and planned time as the given movement, if there is one
+func DeleteArchivedMovement(ctx context.Context, db *pgxpool.Pool, movement *types.Movement) error {
+	defer metrics.QueryTimer("delete_archived_movement").ObserveDuration()
+
+	runDate, err := time.Parse("20060102", movement.RunDate)
+	if err != nil {
+		return fmt.Errorf("invalid run date: %w", err)
+	}
+
+	_, err = db.Exec(ctx, `
+		DELETE FROM movement
+		WHERE train_uid = $1 AND run_date = $2 AND event_type = $3 AND stanox = $4 AND planned_time = $5
+	`, movement.TrainUID, runDate, movement.EventType, movement.Stanox, movement.PlannedTime)
+	if err != nil {
+		return fmt.Errorf("failed to delete archived movement: %w", err)
+	}
+
+	return nil
+}
+
+// StopMovement builds the archive record for the actual held on a journey stop
+// after an event of the given type has been merged into it
+func StopMovement(journey *types.TrainJourney, i int, eventType, trainID string) *types.Movement {
+	stop := &journey.Stops[i]
+	movement := &types.Movement{
+		TrainUID: journey.UID,
+		RunDate:  journey.RunDate,
+		TrainID:  trainID,
+		Stanox:   stop.Stanox,
+	}
+
+	switch {
+	case stop.IsPass():
+		movement.EventType = types.MovementPass
+		movement.PlannedTime = stop.PlannedPass
+		movement.ActualTimestamp = stop.ActualPass
+		movement.Source = stop.PassSource
+		movement.SourceTime = stop.PassSourceTime
+	case eventType == "ARRIVAL":
+		movement.EventType = types.MovementArrival
+		movement.PlannedTime = stop.PlannedArr
+		movement.ActualTimestamp = stop.ActualArr
+		movement.Source = stop.ArrSource
+		movement.SourceTime = stop.ArrSourceTime
+	default:
+		movement.EventType = types.MovementDeparture
+		movement.PlannedTime = stop.PlannedDep
+		movement.ActualTimestamp = stop.ActualDep
+		movement.Source = stop.DepSource
+		movement.SourceTime = stop.DepSourceTime
+	}
+
+	if movement.PlannedTime != "" {
+		movement.Variation = Ptr(CalculateLateness(movement.PlannedTime, movement.ActualTimestamp))
+	}
+
+	return movement
+}
+
+// LoadArchivedMovements reads every archived event for a journey in the order
+// they were recorded
+func LoadArchivedMovements(ctx context.Context, db *pgxpool.Pool, trainUID, runDateStr string) ([]types.Movement, error) {
+	defer metrics.QueryTimer("load_archived_movements").ObserveDuration()
+
+	runDate, err := time.Parse("20060102", runDateStr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid run date: %w", err)
+	}
+
+	rows, err := db.Query(ctx, `
+		SELECT stanox, event_type, planned_time, actual_timestamp, variation, train_id,
+		       source, source_time, canx_type, reason_code, original_stanox
+		FROM movement
+		WHERE train_uid = $1 AND run_date = $2
+		ORDER BY recorded_at
+	`, trainUID, runDate)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load archived movements: %w", err)
+	}
+	defer rows.Close()
+
+	var movements []types.Movement
+	for rows.Next() {
+		var actual *time.Time
+		var trainID, source, sourceTime, canxType, reasonCode, originalStanox sql.NullString
+		movement := types.Movement{TrainUID: trainUID, RunDate: runDateStr}
+
+		if err := rows.Scan(
+			&movement.Stanox, &movement.EventType, &movement.PlannedTime, &actual, &movement.Variation, &trainID,
+			&source, &sourceTime, &canxType, &reasonCode, &originalStanox,
+		); err != nil {
+			return nil, fmt.Errorf("failed to scan archived movement: %w", err)
+		}
+
+		if actual != nil {
+			movement.ActualTimestamp = strconv.FormatInt(actual.UnixMilli(), 10)
+		}
+		movement.TrainID = trainID.String
+		movement.Source = source.String
+		movement.SourceTime = sourceTime.String
+		movement.CanxType = canxType.String
+		movement.ReasonCode = reasonCode.String
+		movement.OriginalStanox = originalStanox.String
+		movements = append(movements, movement)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating archived movements: %w", err)
+	}
+
+	return movements, nil
+}
+
+// ReplayMovements rebuilds the realtime state of a journey from its archived
+// events, so it can be restored after the cached copy has been lost
+func ReplayMovements(journey *types.TrainJourney, movements []types.Movement) {
+	for _, movement := range movements {
+		trust := &types.TrustBody{
+			LocStanox:         movement.Stanox,
+			CanxType:          movement.CanxType,
+			CanxReasonCode:    movement.ReasonCode,
+			CanxTimestamp:     movement.ActualTimestamp,
+			OriginalLocStanox: movement.OriginalStanox,
+		}
+
+		switch movement.EventType {
+		case types.MovementCancellation:
+			ApplyCancellation(journey, trust)
+		case types.MovementReinstatement:
+			ApplyReinstatement(journey, trust)
+		case types.MovementChangeOfOrigin:
+			ApplyChangeOfOrigin(journey, trust)
+		case types.MovementChangeOfLocation:
+			ApplyChangeOfLocation(journey, trust)
+		default:
+			replayActual(journey, &movement)
+		}
+	}
+}
+
+func replayActual(journey *types.TrainJourney, movement *types.Movement) {
+	i := -1
+	for j := range journey.Stops {
+		stop := &journey.Stops[j]
+		if stop.Stanox != movement.Stanox {
+			continue
+		}
+		if i == -1 {
+			i = j
+		}
+		if movement.PlannedTime != "" && (stop.PlannedArr == movement.PlannedTime ||
+			stop.PlannedDep == movement.PlannedTime || stop.PlannedPass == movement.PlannedTime) {
+			i = j
+			break
+		}
+	}
+	if i == -1 {
+		return
+	}
+
+	eventType := movement.EventType
+	if eventType == types.MovementPass {
+		eventType = "ARRIVAL"
+	}
+	actual, source, recorded := stopActual(&journey.Stops[i], eventType)
+	if actual == nil {
+		return
+	}
+
+	*actual = movement.ActualTimestamp
+	*source = movement.Source
+	*recorded = movement.SourceTime
+}
+
+// PruneMovementArchive drops monthly partitions of the movement table whose
+// run dates all fall outside the retention period
+func PruneMovementArchive(ctx context.Context, db *pgxpool.Pool, retention time.Duration) ([]string, error) {
+	defer metrics.QueryTimer("prune_movement_archive").ObserveDuration()
+
+	rows, err := db.Query(ctx, `
+		SELECT c.relname
+		FROM pg_inherits i
+		JOIN pg_class c ON c.oid = i.inhrelid
+		JOIN pg_class p ON p.oid = i.inhparent
+		WHERE p.relname = 'movement'
+	`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list movement partitions: %w", err)
+	}
+
+	var partitions []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("failed to scan movement partition: %w", err)
+		}
+		partitions = append(partitions, name)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating movement partitions: %w", err)
+	}
+
+	cutoff := time.Now().UTC().Add(-retention)
+	var dropped []string
+	for _, name := range partitions {
+		monthStart, err := time.Parse(movementPartitionFormat, strings.ToLower(name))
+		if err != nil {
+			continue
+		}
+		if !monthStart.AddDate(0, 1, 0).Before(cutoff) {
+			continue
+		}
+
+		if _, err := db.Exec(ctx, fmt.Sprintf(`DROP TABLE IF EXISTS %s`, name)); err != nil {
+			return dropped, fmt.Errorf("failed to drop movement partition %s: %w", name, err)
+		}
+		movementPartitions.Delete(name)
+		dropped = append(dropped, name)
+	}
+
+	return dropped, nil
+}
@@ -0,0 +1,224 @@
+package utils
+
+import (
+	"context"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/jack-barr3tt/gbr-engine/src/common/testdb"
+	"github.com/jack-barr3tt/gbr-engine/src/common/types"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/redis/go-redis/v9"
+)
+
+// loopMovements are the archived events of loopJourney departing A, passing
+// B, arriving back at A and being cancelled at C, in the order recorded
+func loopMovements() []types.Movement {
+	return []types.Movement{
+		{TrainUID: "C12345", RunDate: "20260101", Stanox: "A", EventType: types.MovementDeparture, PlannedTime: "10:00",
+			ActualTimestamp: trustTimestamp("10:01"), Source: types.FeedTRUST, SourceTime: "100"},
+		{TrainUID: "C12345", RunDate: "20260101", Stanox: "B", EventType: types.MovementPass, PlannedTime: "10:10",
+			ActualTimestamp: trustTimestamp("10:12"), Source: types.FeedTD, SourceTime: "200"},
+		{TrainUID: "C12345", RunDate: "20260101", Stanox: "A", EventType: types.MovementArrival, PlannedTime: "10:20",
+			ActualTimestamp: trustTimestamp("10:23"), Source: types.FeedTRUST, SourceTime: "300"},
+		{TrainUID: "C12345", RunDate: "20260101", Stanox: "C", EventType: types.MovementCancellation,
+			ActualTimestamp: trustTimestamp("10:25"), Source: types.FeedTRUST, CanxType: "EN ROUTE", ReasonCode: "YI"},
+	}
+}
+
+// checkReplayed checks that a journey holds the realtime state of loopMovements
+func checkReplayed(t *testing.T, journey *types.TrainJourney) {
+	t.Helper()
+
+	stops := journey.Stops
+	if len(stops) != 4 {
+		t.Fatalf("journey has %d stops, want 4", len(stops))
+	}
+	if stops[0].ActualDep != trustTimestamp("10:01") || stops[0].DepSource != types.FeedTRUST || stops[0].DepSourceTime != "100" {
+		t.Errorf("departure from the origin not replayed: %+v", stops[0])
+	}
+	if stops[1].ActualPass != trustTimestamp("10:12") || stops[1].PassSource != types.FeedTD {
+		t.Errorf("pass not replayed: %+v", stops[1])
+	}
+	if stops[0].ActualArr != "" || stops[2].ActualArr != trustTimestamp("10:23") {
+		t.Errorf("arrival not replayed onto the second call at A: %+v, %+v", stops[0], stops[2])
+	}
+	if stops[2].Cancelled || !stops[3].Cancelled {
+		t.Errorf("cancellation not replayed from C: %+v, %+v", stops[2], stops[3])
+	}
+	if journey.Cancellation == nil || journey.Cancellation.Type != "EN ROUTE" || journey.Cancellation.ReasonCode != "YI" {
+		t.Errorf("cancellation = %+v, want EN ROUTE for YI", journey.Cancellation)
+	}
+}
+
+// insertLoopSchedule stores loopJourney as a schedule, calling at TIPLOCs
+// named after their stanox
+func insertLoopSchedule(t *testing.T, db *pgxpool.Pool) {
+	t.Helper()
+
+	_, err := db.Exec(context.Background(), `
+		INSERT INTO tiploc (tiploc_code, nalco, stanox, tps_description) VALUES
+			('A', '1', 'A', 'A'), ('B', '2', 'B', 'B'), ('C', '3', 'C', 'C');
+		WITH s AS (
+			INSERT INTO schedule (
+				train_uid, transaction_type, stp_indicator, schedule_days_runs, schedule_start_date,
+				schedule_end_date, train_status, signalling_id, train_category, headcode,
+				course_indicator, train_service_code
+			) VALUES ('C12345', 'Create', 'P', '1111111', '2025-12-01', '2026-02-01', '1', '1A23', 'OO', '1A23', 1, '12345678')
+			RETURNING id
+		)
+		INSERT INTO schedule_location (schedule_id, location_type, record_identity, tiploc_code, arrival, departure, pass, location_order)
+		SELECT s.id, l.type, l.type, l.tiploc, l.arrival::time, l.departure::time, l.pass::time, l.ord
+		FROM s, (VALUES
+			('LO', 'A', NULL, '10:00', NULL, 1),
+			('LI', 'B', NULL, NULL, '10:10', 2),
+			('LI', 'A', '10:20', '10:22', NULL, 3),
+			('LT', 'C', '10:30', NULL, NULL, 4)
+		) AS l(type, tiploc, arrival, departure, pass, ord)
+	`)
+	if err != nil {
+		t.Fatalf("failed to insert schedule: %v", err)
+	}
+}
+
+func TestReplayMovements(t *testing.T) {
+	journey := loopJourney()
+	movements := append(loopMovements(), types.Movement{
+		Stanox: "Z", EventType: types.MovementArrival, PlannedTime: "11:00", ActualTimestamp: trustTimestamp("11:00"),
+	})
+
+	ReplayMovements(&journey, movements)
+
+	checkReplayed(t, &journey)
+}
+
+func TestReplayAfterCacheMiss(t *testing.T) {
+	ctx := context.Background()
+	db := testdb.New(t)
+
+	server := miniredis.RunT(t)
+	rdb := redis.NewClient(&redis.Options{Addr: server.Addr()})
+	defer rdb.Close()
+
+	insertLoopSchedule(t, db)
+
+	for _, movement := range loopMovements() {
+		if err := ArchiveMovement(ctx, db, &movement); err != nil {
+			t.Fatalf("ArchiveMovement() error = %v", err)
+		}
+	}
+
+	// the journey was never cached, or has since been lost
+	if server.Exists(BuildJourneyKey("C12345", "20260101")) {
+		t.Fatal("journey cached before it was loaded")
+	}
+
+	journey, err := LoadTrainJourney(ctx, db, rdb, "C12345", "20260101")
+	if err != nil {
+		t.Fatalf("LoadTrainJourney() error = %v", err)
+	}
+	checkReplayed(t, &journey)
+
+	// the replayed state is cached along with the journey
+	server.FlushAll()
+	journey, err = LoadTrainJourney(ctx, db, rdb, "C12345", "20260101")
+	if err != nil {
+		t.Fatalf("LoadTrainJourney() after losing the cache error = %v", err)
+	}
+	checkReplayed(t, &journey)
+}
+
+func TestArchiveAgainKeepsReplayOrder(t *testing.T) {
+	ctx := context.Background()
+	db := testdb.New(t)
+
+	movements := loopMovements()
+	for _, movement := range movements {
+		if err := ArchiveMovement(ctx, db, &movement); err != nil {
+			t.Fatalf("ArchiveMovement() error = %v", err)
+		}
+	}
+
+	// a redelivery of the departure, and a correction of it, both arrive
+	// after every other event was recorded
+	redelivered := movements[0]
+	if err := ArchiveMovement(ctx, db, &redelivered); err != nil {
+		t.Fatalf("ArchiveMovement() redelivery error = %v", err)
+	}
+	corrected := movements[0]
+	corrected.ActualTimestamp = trustTimestamp("10:02")
+	if err := ArchiveMovement(ctx, db, &corrected); err != nil {
+		t.Fatalf("ArchiveMovement() correction error = %v", err)
+	}
+
+	archived, err := LoadArchivedMovements(ctx, db, "C12345", "20260101")
+	if err != nil {
+		t.Fatalf("LoadArchivedMovements() error = %v", err)
+	}
+	if len(archived) != len(movements) {
+		t.Fatalf("loaded %d movements, want %d", len(archived), len(movements))
+	}
+	for i, movement := range archived {
+		if movement.Stanox != movements[i].Stanox || movement.EventType != movements[i].EventType {
+			t.Errorf("movement %d = %s at %s, want %s at %s",
+				i, movement.EventType, movement.Stanox, movements[i].EventType, movements[i].Stanox)
+		}
+	}
+	if archived[0].ActualTimestamp != corrected.ActualTimestamp {
+		t.Errorf("departure actual = %s, want the corrected %s", archived[0].ActualTimestamp, corrected.ActualTimestamp)
+	}
+}
+
+func TestArchiveCancelReinstateCancel(t *testing.T) {
+	ctx := context.Background()
+	db := testdb.New(t)
+
+	movements := loopMovements()
+	cancellation := movements[len(movements)-1]
+	reinstatement := types.Movement{TrainUID: "C12345", RunDate: "20260101", Stanox: "C",
+		EventType: types.MovementReinstatement, ActualTimestamp: trustTimestamp("10:26"), Source: types.FeedTRUST}
+
+	// the train is cancelled, reinstated, then cancelled again at the same place
+	for _, movement := range append(movements, reinstatement, cancellation) {
+		if err := ArchiveMovement(ctx, db, &movement); err != nil {
+			t.Fatalf("ArchiveMovement() error = %v", err)
+		}
+	}
+
+	archived, err := LoadArchivedMovements(ctx, db, "C12345", "20260101")
+	if err != nil {
+		t.Fatalf("LoadArchivedMovements() error = %v", err)
+	}
+	if len(archived) != len(movements)+1 {
+		t.Fatalf("loaded %d movements, want %d", len(archived), len(movements)+1)
+	}
+	if last := archived[len(archived)-1]; last.EventType != types.MovementCancellation {
+		t.Errorf("last archived movement = %s, want the repeated cancellation", last.EventType)
+	}
+
+	journey := loopJourney()
+	ReplayMovements(&journey, archived)
+	checkReplayed(t, &journey)
+}
+
+func TestLoadJourneyArchiveError(t *testing.T) {
+	ctx := context.Background()
+	db := testdb.New(t)
+	insertLoopSchedule(t, db)
+
+	server := miniredis.RunT(t)
+	rdb := redis.NewClient(&redis.Options{Addr: server.Addr()})
+	defer rdb.Close()
+
+	// the schedule loads but its archived movements can't be read
+	if _, err := db.Exec(ctx, `ALTER TABLE movement RENAME TO movement_unavailable`); err != nil {
+		t.Fatalf("failed to rename movement: %v", err)
+	}
+
+	if _, err := LoadTrainJourney(ctx, db, rdb, "C12345", "20260101"); err == nil {
+		t.Fatal("LoadTrainJourney() succeeded without the archive")
+	}
+	if server.Exists(BuildJourneyKey("C12345", "20260101")) {
+		t.Error("journey cached without its archived movements")
+	}
+}
@@ -12,29 +12,6 @@ import (
 	"github.com/redis/go-redis/v9"
 )
 
-func NewRabbitConnection() (*amqp.Connection, *amqp.Channel, error) {
-	mqUser := os.Getenv("MQ_USER")
-	mqPassword := os.Getenv("MQ_PASSWORD")
-	mqHost := os.Getenv("MQ_HOST")
-	mqPort := os.Getenv("MQ_PORT")
-
-	config := amqp.Config{
-		Heartbeat: 60 * time.Second,
-		Locale:    "en_US",
-	}
-
-	connection, err := amqp.DialConfig(fmt.Sprintf("amqp://%s:%s@%s:%s/", mqUser, mqPassword, mqHost, mqPort), config)
-	if err != nil {
-		return nil, nil, err
-	}
-	channel, err := connection.Channel()
-	if err != nil {
-		return nil, nil, err
-	}
-
-	return connection, channel, nil
-}
-
 func NewRabbitConnectionOnly() (*amqp.Connection, error) {
 	mqUser := os.Getenv("MQ_USER")
 	mqPassword := os.Getenv("MQ_PASSWORD")
@@ -54,13 +31,18 @@ func NewRabbitConnectionOnly() (*amqp.Connection, error) {
 	return connection, nil
 }
 
-func NewNRStompConnection() (*stomp.Conn, error) {
+// NewNRStompConnection connects to the Network Rail feeds broker. The client
+// ID identifies the connection to the broker so durable subscriptions made on
+// it survive a reconnect.
+func NewNRStompConnection(clientID string) (*stomp.Conn, error) {
 	url := os.Getenv("NR_FEEDS_ENDPOINT")
 	username := os.Getenv("NR_FEEDS_USERNAME")
 	password := os.Getenv("NR_FEEDS_PASSWORD")
 
 	conn, err := stomp.Dial("tcp", url,
 		stomp.ConnOpt.Login(username, password),
+		stomp.ConnOpt.Header("client-id", clientID),
+		stomp.ConnOpt.HeartBeat(15*time.Second, 15*time.Second),
 	)
 	if err != nil {
 		return nil, err
@@ -84,6 +66,10 @@ func NewRedisClient() *redis.Client {
 	return rdb
 }
 
+// SchemaVersion is the version of schema.sql this build expects, to be bumped
+// alongside the version it records in schema_version
+const SchemaVersion = 1
+
 func NewPostgresConnection() (*pgxpool.Pool, error) {
 	host := os.Getenv("POSTGRES_HOST")
 	port := os.Getenv("POSTGRES_PORT")
@@ -0,0 +1,90 @@
+package utils
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/jack-barr3tt/gbr-engine/src/common/types"
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	// feedTopicsKey holds a FeedTopicStatus for each topic the queuer
+	// subscribes to, keyed by topic
+	feedTopicsKey = "feed_health:topics"
+
+	// feedHeartbeatsKey holds when the queuer last received a CT heartbeat
+	// from each TD area, keyed by area ID
+	feedHeartbeatsKey = "feed_health:td_heartbeats"
+)
+
+// FeedStaleAfter is how long a feed topic or TD area can be silent before it
+// is considered stale, taken from FEED_STALE_AFTER and defaulting to 10
+// minutes
+func FeedStaleAfter() time.Duration {
+	window, err := time.ParseDuration(os.Getenv("FEED_STALE_AFTER"))
+	if err != nil || window <= 0 {
+		return 10 * time.Minute
+	}
+	return window
+}
+
+// StoreFeedHealth records the state of each feed topic and the last heartbeat
+// from each TD area
+func StoreFeedHealth(ctx context.Context, rdb *redis.Client, topics []types.FeedTopicStatus, heartbeats map[string]time.Time) error {
+	pipe := rdb.TxPipeline()
+
+	for _, topic := range topics {
+		b, err := json.Marshal(topic)
+		if err != nil {
+			return fmt.Errorf("failed to marshal topic status: %w", err)
+		}
+		pipe.HSet(ctx, feedTopicsKey, topic.Topic, b)
+	}
+
+	for areaID, at := range heartbeats {
+		pipe.HSet(ctx, feedHeartbeatsKey, areaID, at.UTC().Format(time.RFC3339))
+	}
+
+	if _, err := pipe.Exec(ctx); err != nil {
+		return fmt.Errorf("failed to store feed health: %w", err)
+	}
+	return nil
+}
+
+// LoadFeedHealth reads the state of each feed topic and the last heartbeat
+// from each TD area, as last stored by the queuer
+func LoadFeedHealth(ctx context.Context, rdb *redis.Client) ([]types.FeedTopicStatus, map[string]time.Time, error) {
+	rawTopics, err := rdb.HGetAll(ctx, feedTopicsKey).Result()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	topics := make([]types.FeedTopicStatus, 0, len(rawTopics))
+	for _, raw := range rawTopics {
+		var topic types.FeedTopicStatus
+		if err := json.Unmarshal([]byte(raw), &topic); err != nil {
+			continue
+		}
+		topics = append(topics, topic)
+	}
+
+	rawHeartbeats, err := rdb.HGetAll(ctx, feedHeartbeatsKey).Result()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	heartbeats := make(map[string]time.Time, len(rawHeartbeats))
+	for areaID, raw := range rawHeartbeats {
+		at, err := time.Parse(time.RFC3339, raw)
+		if err != nil {
+			continue
+		}
+		heartbeats[areaID] = at
+	}
+
+	return topics, heartbeats, nil
+}
@@ -0,0 +1,270 @@
+package utils
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/jack-barr3tt/gbr-engine/src/common/types"
+	"github.com/redis/go-redis/v9"
+)
+
+// ActivationRunDate works out which day's schedule an activated train is
+// running, which is the day it departs its origin rather than the day any
+// later message happens to arrive
+func ActivationRunDate(trust *types.TrustBody) string {
+	if originDate, err := time.Parse("2006-01-02", strings.TrimSpace(trust.TpOriginTimestamp)); err == nil {
+		return FormatRunDate(originDate)
+	}
+
+	// TRUST timestamps are UK local time expressed as epoch milliseconds
+	if originDepMs := ParseIntOrZero(trust.OriginDepTimestamp); originDepMs > 0 {
+		return FormatRunDate(time.UnixMilli(int64(originDepMs)).UTC())
+	}
+
+	return FormatRunDate(UKDate(time.Now()))
+}
+
+// LoadActivation reads the activation stored for a train ID. Activations
+// stored before run dates were recorded hold just the train UID, and are
+// assumed to be running today in the UK.
+func LoadActivation(ctx context.Context, rdb *redis.Client, trainID string) (types.Activation, error) {
+	raw, err := rdb.Get(ctx, BuildActivationKey(trainID)).Result()
+	if err != nil {
+		return types.Activation{}, err
+	}
+
+	var activation types.Activation
+	if err := json.Unmarshal([]byte(raw), &activation); err != nil || activation.TrainUID == "" {
+		activation = types.Activation{TrainUID: raw}
+	}
+	activation.TrainUID = strings.TrimSpace(activation.TrainUID)
+	if activation.RunDate == "" {
+		activation.RunDate = FormatRunDate(UKDate(time.Now()))
+	}
+
+	return activation, nil
+}
+
+// ResolveRunDate returns the run date of a train seen calling somewhere on the
+// given date. A call earlier in the day than the train's origin departure
+// means it crossed midnight, so it started running the day before.
+func ResolveRunDate(date time.Time, originDep, callTime string) string {
+	origin, err := ParseTimeForComparison(originDep)
+	if err != nil {
+		return FormatRunDate(date)
+	}
+
+	call, err := ParseTimeForComparison(callTime)
+	if err != nil {
+		return FormatRunDate(date)
+	}
+
+	if call.Before(origin) {
+		return FormatRunDate(date.AddDate(0, 0, -1))
+	}
+	return FormatRunDate(date)
+}
+
+// matchLocationIndex picks which occurrence of a stanox a cancellation or
+// other change to the journey refers to. A stop planned at the given TRUST
+// timestamp wins; otherwise the first occurrence at or beyond the train's
+// progress is used, falling back to the last. It returns -1 if the stanox is
+// not in the journey.
+func matchLocationIndex(journey *types.TrainJourney, stanox, plannedTimestamp string) int {
+	candidates := stopsAt(journey, stanox)
+	if len(candidates) == 0 {
+		return -1
+	}
+
+	if i := plannedStopIndex(journey, candidates, plannedTimestamp); i != -1 {
+		return i
+	}
+
+	progress := journeyProgress(journey)
+	for _, i := range candidates {
+		if i >= progress {
+			return i
+		}
+	}
+	return candidates[len(candidates)-1]
+}
+
+// stopsAt returns the index of every stop at the given stanox
+func stopsAt(journey *types.TrainJourney, stanox string) []int {
+	var indexes []int
+	for i, stop := range journey.Stops {
+		if stop.Stanox == stanox {
+			indexes = append(indexes, i)
+		}
+	}
+	return indexes
+}
+
+// plannedStopIndex returns whichever of the candidate stops has any planned
+// time matching the TRUST timestamp, or -1
+func plannedStopIndex(journey *types.TrainJourney, candidates []int, plannedTimestamp string) int {
+	planned := FormatTrustTime(plannedTimestamp)
+	if planned == "" {
+		return -1
+	}
+	for _, i := range candidates {
+		stop := &journey.Stops[i]
+		if stop.PlannedArr == planned || stop.PlannedDep == planned || stop.PlannedPass == planned {
+			return i
+		}
+	}
+	return -1
+}
+
+// journeyProgress returns the index of the furthest stop the train has been
+// reported at, or 0 if it has not been reported anywhere
+func journeyProgress(journey *types.TrainJourney) int {
+	progress := 0
+	for i, stop := range journey.Stops {
+		if stop.Reached() {
+			progress = i
+		}
+	}
+	return progress
+}
+
+// ApplyCancellation records a TRUST cancellation on the journey and marks every
+// stop from the cancellation location onwards that the train has not yet
+// reached. Cancellations at origin cover the whole journey, while any other
+// cancellation at a location not in the journey marks no stops.
+func ApplyCancellation(journey *types.TrainJourney, trust *types.TrustBody) {
+	canxType := strings.TrimSpace(trust.CanxType)
+	journey.Cancellation = &types.Cancellation{
+		Type:       canxType,
+		ReasonCode: strings.TrimSpace(trust.CanxReasonCode),
+		Stanox:     trust.LocStanox,
+		Timestamp:  trust.CanxTimestamp,
+	}
+
+	from := matchLocationIndex(journey, trust.LocStanox, trust.DepTimestamp)
+	if canxType == "AT ORIGIN" || canxType == "ON CALL" {
+		from = 0
+	}
+	if from == -1 {
+		return
+	}
+
+	for i := from; i < len(journey.Stops); i++ {
+		if journey.Stops[i].Reached() {
+			continue
+		}
+		journey.Stops[i].Cancelled = true
+	}
+}
+
+// ApplyReinstatement reverses a cancellation from the reinstatement location
+// onwards, clearing the journey's cancellation once no stops remain cancelled.
+// A reinstatement at a location not in the journey reverses no stops.
+func ApplyReinstatement(journey *types.TrainJourney, trust *types.TrustBody) {
+	if from := matchLocationIndex(journey, trust.LocStanox, trust.DepTimestamp); from != -1 {
+		for i := from; i < len(journey.Stops); i++ {
+			journey.Stops[i].Cancelled = false
+		}
+	}
+
+	for _, stop := range journey.Stops {
+		if stop.Cancelled {
+			return
+		}
+	}
+	journey.Cancellation = nil
+}
+
+// ApplyChangeOfOrigin truncates the journey so it starts at the new origin,
+// dropping the calls the train will no longer make
+func ApplyChangeOfOrigin(journey *types.TrainJourney, trust *types.TrustBody) bool {
+	from := matchLocationIndex(journey, trust.LocStanox, trust.DepTimestamp)
+	if from == -1 {
+		return false
+	}
+
+	journey.Stops = journey.Stops[from:]
+	return true
+}
+
+// ApplyChangeOfLocation moves the actuals TRUST reported against the wrong
+// location onto the stop it has since corrected them to, leaving the planned
+// locations of both stops as they were. It returns the indexes of the stop the
+// actuals were reported at and the stop they belong to, or -1 for either that
+// is not in the journey, and whether any actuals were moved.
+func ApplyChangeOfLocation(journey *types.TrainJourney, trust *types.TrustBody) (from, to int, moved bool) {
+	from = reportedStopIndex(journey, trust.OriginalLocStanox, trust.OriginalLocTimestamp)
+	if from == -1 {
+		return -1, -1, false
+	}
+
+	candidates := stopsAt(journey, trust.LocStanox)
+	to = plannedStopIndex(journey, candidates, trust.DepTimestamp)
+	if to == -1 {
+		// the correct location is most likely the occurrence nearest where
+		// the train was wrongly reported
+		for _, i := range candidates {
+			if to == -1 || absInt(i-from) < absInt(to-from) {
+				to = i
+			}
+		}
+	}
+	if to == -1 || to == from {
+		return from, to, false
+	}
+
+	source, target := &journey.Stops[from], &journey.Stops[to]
+	for _, actual := range []struct {
+		eventType                string
+		actual, feed, sourceTime *string
+	}{
+		{"ARRIVAL", &source.ActualArr, &source.ArrSource, &source.ArrSourceTime},
+		{"DEPARTURE", &source.ActualDep, &source.DepSource, &source.DepSourceTime},
+		// passes are recorded as arrivals at stops the train calls at, as
+		// they are when replayed from the archive
+		{"ARRIVAL", &source.ActualPass, &source.PassSource, &source.PassSourceTime},
+	} {
+		if *actual.actual == "" {
+			continue
+		}
+		targetActual, targetFeed, targetSourceTime := stopActual(target, actual.eventType)
+		*targetActual, *targetFeed, *targetSourceTime = *actual.actual, *actual.feed, *actual.sourceTime
+		*actual.actual, *actual.feed, *actual.sourceTime = "", "", ""
+		moved = true
+	}
+	return from, to, moved
+}
+
+// reportedStopIndex picks which occurrence of a stanox the train was reported
+// at, preferring one planned at the given TRUST timestamp and then the latest
+// one holding an actual
+func reportedStopIndex(journey *types.TrainJourney, stanox, plannedTimestamp string) int {
+	candidates := stopsAt(journey, stanox)
+	if i := plannedStopIndex(journey, candidates, plannedTimestamp); i != -1 {
+		return i
+	}
+	for j := len(candidates) - 1; j >= 0; j-- {
+		if journey.Stops[candidates[j]].Reached() {
+			return candidates[j]
+		}
+	}
+	return matchLocationIndex(journey, stanox, "")
+}
+
+func absInt(n int) int {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
+
+// HeadcodeFromTrainID extracts the four character headcode embedded in a
+// TRUST train ID
+func HeadcodeFromTrainID(trainID string) string {
+	if len(trainID) < 6 {
+		return ""
+	}
+	return trainID[2:6]
+}
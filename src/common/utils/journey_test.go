@@ -0,0 +1,343 @@
+package utils
+
+import (
+	"testing"
+
+	"github.com/jack-barr3tt/gbr-engine/src/common/types"
+)
+
+// cancelledStops reports which stops of a journey are cancelled
+func cancelledStops(journey *types.TrainJourney) []bool {
+	cancelled := make([]bool, len(journey.Stops))
+	for i, stop := range journey.Stops {
+		cancelled[i] = stop.Cancelled
+	}
+	return cancelled
+}
+
+func equalBools(a, b []bool) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestApplyCancellation(t *testing.T) {
+	tests := []struct {
+		name          string
+		setup         func(*types.TrainJourney)
+		trust         types.TrustBody
+		wantCancelled []bool
+	}{
+		{
+			name:          "at origin cancels every stop",
+			trust:         types.TrustBody{LocStanox: "C", CanxType: "AT ORIGIN"},
+			wantCancelled: []bool{true, true, true, true},
+		},
+		{
+			name:          "on call cancels every stop",
+			trust:         types.TrustBody{LocStanox: "C", CanxType: "ON CALL"},
+			wantCancelled: []bool{true, true, true, true},
+		},
+		{
+			name:          "en route cancels from the location",
+			trust:         types.TrustBody{LocStanox: "C", CanxType: "EN ROUTE"},
+			wantCancelled: []bool{false, false, false, true},
+		},
+		{
+			name: "en route leaves stops already reached",
+			setup: func(j *types.TrainJourney) {
+				j.Stops[0].ActualDep = "1"
+				j.Stops[1].ActualPass = "2"
+			},
+			trust:         types.TrustBody{LocStanox: "B", CanxType: "EN ROUTE"},
+			wantCancelled: []bool{false, false, true, true},
+		},
+		{
+			name:          "en route at a repeated location matched by planned time",
+			trust:         types.TrustBody{LocStanox: "A", CanxType: "EN ROUTE", DepTimestamp: trustTimestamp("10:22")},
+			wantCancelled: []bool{false, false, true, true},
+		},
+		{
+			name: "en route at a repeated location matched by progress",
+			setup: func(j *types.TrainJourney) {
+				j.Stops[0].ActualDep = "1"
+				j.Stops[1].ActualPass = "2"
+			},
+			trust:         types.TrustBody{LocStanox: "A", CanxType: "EN ROUTE"},
+			wantCancelled: []bool{false, false, true, true},
+		},
+		{
+			name:          "en route at a location not in the journey",
+			trust:         types.TrustBody{LocStanox: "Z", CanxType: "EN ROUTE"},
+			wantCancelled: []bool{false, false, false, false},
+		},
+		{
+			name:          "out of plan at a location not in the journey",
+			trust:         types.TrustBody{LocStanox: "Z", CanxType: "OUT OF PLAN"},
+			wantCancelled: []bool{false, false, false, false},
+		},
+		{
+			name:          "at origin reported at a location not in the journey",
+			trust:         types.TrustBody{LocStanox: "Z", CanxType: "AT ORIGIN"},
+			wantCancelled: []bool{true, true, true, true},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			journey := loopJourney()
+			if tt.setup != nil {
+				tt.setup(&journey)
+			}
+
+			ApplyCancellation(&journey, &tt.trust)
+
+			if got := cancelledStops(&journey); !equalBools(got, tt.wantCancelled) {
+				t.Errorf("cancelled stops = %v, want %v", got, tt.wantCancelled)
+			}
+			if journey.Cancellation == nil || journey.Cancellation.Type != tt.trust.CanxType {
+				t.Errorf("cancellation = %+v, want type %s", journey.Cancellation, tt.trust.CanxType)
+			}
+		})
+	}
+}
+
+func TestApplyReinstatement(t *testing.T) {
+	tests := []struct {
+		name             string
+		trust            types.TrustBody
+		wantCancelled    []bool
+		wantCancellation bool
+	}{
+		{
+			name:             "after the cancelled location",
+			trust:            types.TrustBody{LocStanox: "C"},
+			wantCancelled:    []bool{false, true, true, false},
+			wantCancellation: true,
+		},
+		{
+			name:             "at a repeated location matched by planned time",
+			trust:            types.TrustBody{LocStanox: "A", DepTimestamp: trustTimestamp("10:22")},
+			wantCancelled:    []bool{false, true, false, false},
+			wantCancellation: true,
+		},
+		{
+			name:          "at the cancelled location",
+			trust:         types.TrustBody{LocStanox: "B"},
+			wantCancelled: []bool{false, false, false, false},
+		},
+		{
+			name:             "at a location not in the journey",
+			trust:            types.TrustBody{LocStanox: "Z"},
+			wantCancelled:    []bool{false, true, true, true},
+			wantCancellation: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			journey := loopJourney()
+			journey.Stops[0].ActualDep = "1"
+			ApplyCancellation(&journey, &types.TrustBody{LocStanox: "B", CanxType: "EN ROUTE"})
+
+			ApplyReinstatement(&journey, &tt.trust)
+
+			if got := cancelledStops(&journey); !equalBools(got, tt.wantCancelled) {
+				t.Errorf("cancelled stops = %v, want %v", got, tt.wantCancelled)
+			}
+			if (journey.Cancellation != nil) != tt.wantCancellation {
+				t.Errorf("cancellation = %+v, want one recorded: %v", journey.Cancellation, tt.wantCancellation)
+			}
+		})
+	}
+}
+
+func TestReinstatementOfCancellationNotInJourney(t *testing.T) {
+	journey := loopJourney()
+	ApplyCancellation(&journey, &types.TrustBody{LocStanox: "Z", CanxType: "EN ROUTE"})
+	if journey.Cancellation == nil {
+		t.Fatal("cancellation not recorded")
+	}
+
+	ApplyReinstatement(&journey, &types.TrustBody{LocStanox: "Z"})
+
+	if journey.Cancellation != nil {
+		t.Errorf("cancellation = %+v, want it cleared with no stops cancelled", journey.Cancellation)
+	}
+}
+
+func TestApplyChangeOfOrigin(t *testing.T) {
+	tests := []struct {
+		name       string
+		trust      types.TrustBody
+		wantOK     bool
+		wantStanox []string
+	}{
+		{
+			name:       "truncates to the new origin",
+			trust:      types.TrustBody{LocStanox: "B"},
+			wantOK:     true,
+			wantStanox: []string{"B", "A", "C"},
+		},
+		{
+			name:       "repeated location matched by planned time",
+			trust:      types.TrustBody{LocStanox: "A", DepTimestamp: trustTimestamp("10:22")},
+			wantOK:     true,
+			wantStanox: []string{"A", "C"},
+		},
+		{
+			name:       "repeated location before the train has started",
+			trust:      types.TrustBody{LocStanox: "A"},
+			wantOK:     true,
+			wantStanox: []string{"A", "B", "A", "C"},
+		},
+		{
+			name:       "location not in the journey",
+			trust:      types.TrustBody{LocStanox: "Z"},
+			wantStanox: []string{"A", "B", "A", "C"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			journey := loopJourney()
+
+			if ok := ApplyChangeOfOrigin(&journey, &tt.trust); ok != tt.wantOK {
+				t.Errorf("ApplyChangeOfOrigin() = %v, want %v", ok, tt.wantOK)
+			}
+
+			var got []string
+			for _, stop := range journey.Stops {
+				got = append(got, stop.Stanox)
+			}
+			if len(got) != len(tt.wantStanox) {
+				t.Fatalf("stops = %v, want %v", got, tt.wantStanox)
+			}
+			for i := range got {
+				if got[i] != tt.wantStanox[i] {
+					t.Fatalf("stops = %v, want %v", got, tt.wantStanox)
+				}
+			}
+		})
+	}
+}
+
+func TestApplyChangeOfLocation(t *testing.T) {
+	tests := []struct {
+		name      string
+		setup     func(*types.TrainJourney)
+		trust     types.TrustBody
+		wantFrom  int
+		wantTo    int
+		wantMoved bool
+		check     func(*testing.T, *types.TrainJourney)
+	}{
+		{
+			name: "arrival moved to the nearest occurrence of a repeated location",
+			setup: func(j *types.TrainJourney) {
+				j.Stops[3].ActualArr, j.Stops[3].ArrSource, j.Stops[3].ArrSourceTime = "5", types.FeedTRUST, "100"
+			},
+			trust:     types.TrustBody{OriginalLocStanox: "C", LocStanox: "A"},
+			wantFrom:  3,
+			wantTo:    2,
+			wantMoved: true,
+			check: func(t *testing.T, j *types.TrainJourney) {
+				if j.Stops[2].ActualArr != "5" || j.Stops[2].ArrSource != types.FeedTRUST || j.Stops[2].ArrSourceTime != "100" {
+					t.Errorf("arrival not moved onto the corrected stop: %+v", j.Stops[2])
+				}
+				if j.Stops[3].ActualArr != "" || j.Stops[3].ArrSource != "" || j.Stops[3].ArrSourceTime != "" {
+					t.Errorf("arrival left on the wrong stop: %+v", j.Stops[3])
+				}
+			},
+		},
+		{
+			name: "pass moved to a repeated location matched by planned time",
+			setup: func(j *types.TrainJourney) {
+				j.Stops[1].ActualPass, j.Stops[1].PassSource = "2", types.FeedTRUST
+			},
+			trust:     types.TrustBody{OriginalLocStanox: "B", LocStanox: "A", DepTimestamp: trustTimestamp("10:22")},
+			wantFrom:  1,
+			wantTo:    2,
+			wantMoved: true,
+			check: func(t *testing.T, j *types.TrainJourney) {
+				if j.Stops[2].ActualArr != "2" || j.Stops[1].ActualPass != "" {
+					t.Errorf("pass not moved as an arrival: %+v, %+v", j.Stops[1], j.Stops[2])
+				}
+				if j.Stops[0].ActualArr != "" || j.Stops[0].ActualDep != "" {
+					t.Errorf("pass moved to the wrong occurrence: %+v", j.Stops[0])
+				}
+			},
+		},
+		{
+			name: "wrong location matched by its planned time",
+			setup: func(j *types.TrainJourney) {
+				j.Stops[0].ActualDep = "1"
+				j.Stops[2].ActualDep = "3"
+			},
+			trust:     types.TrustBody{OriginalLocStanox: "A", OriginalLocTimestamp: trustTimestamp("10:00"), LocStanox: "B"},
+			wantFrom:  0,
+			wantTo:    1,
+			wantMoved: true,
+			check: func(t *testing.T, j *types.TrainJourney) {
+				if j.Stops[0].ActualDep != "" || j.Stops[2].ActualDep != "3" {
+					t.Errorf("wrong departure moved: %+v, %+v", j.Stops[0], j.Stops[2])
+				}
+				if j.Stops[1].ActualPass != "1" {
+					t.Errorf("departure not recorded as a pass: %+v", j.Stops[1])
+				}
+			},
+		},
+		{
+			name: "corrected to the same stop",
+			setup: func(j *types.TrainJourney) {
+				j.Stops[0].ActualDep = "1"
+			},
+			trust:    types.TrustBody{OriginalLocStanox: "A", LocStanox: "A"},
+			wantFrom: 0,
+			wantTo:   0,
+		},
+		{
+			name:     "original location not in the journey",
+			trust:    types.TrustBody{OriginalLocStanox: "Z", LocStanox: "A"},
+			wantFrom: -1,
+			wantTo:   -1,
+		},
+		{
+			name: "corrected location not in the journey",
+			setup: func(j *types.TrainJourney) {
+				j.Stops[3].ActualArr = "5"
+			},
+			trust:    types.TrustBody{OriginalLocStanox: "C", LocStanox: "Z"},
+			wantFrom: 3,
+			wantTo:   -1,
+			check: func(t *testing.T, j *types.TrainJourney) {
+				if j.Stops[3].ActualArr != "5" {
+					t.Errorf("arrival removed without a stop to move it to: %+v", j.Stops[3])
+				}
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			journey := loopJourney()
+			if tt.setup != nil {
+				tt.setup(&journey)
+			}
+
+			from, to, moved := ApplyChangeOfLocation(&journey, &tt.trust)
+			if from != tt.wantFrom || to != tt.wantTo || moved != tt.wantMoved {
+				t.Fatalf("ApplyChangeOfLocation() = %d, %d, %v, want %d, %d, %v", from, to, moved, tt.wantFrom, tt.wantTo, tt.wantMoved)
+			}
+			if tt.check != nil {
+				tt.check(t, &journey)
+			}
+		})
+	}
+}
@@ -0,0 +1,346 @@
+package utils
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"strconv"
+	"time"
+
+	"github.com/jack-barr3tt/gbr-engine/src/common/metrics"
+	"github.com/jack-barr3tt/gbr-engine/src/common/types"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/redis/go-redis/v9"
+)
+
+// Journeys are cached in Redis as a hash holding each stop in its own field,
+// alongside the journey's metadata, its number of stops and a version that
+// every write increments. Writes are made by a script that only applies them
+// if the journey is still at the version the writer read, so concurrent
+// writers retry on top of each other's changes rather than overwriting them,
+// and only the stops a writer changed are written.
+
+const (
+	journeyTTL            = 48 * time.Hour
+	journeyUpdateAttempts = 10
+
+	journeyMetaField    = "meta"
+	journeyStopsField   = "stops"
+	journeyVersionField = "version"
+)
+
+// ErrJourneyNotFound is returned when a journey is not cached and there is no
+// schedule to build it from
+var ErrJourneyNotFound = errors.New("journey not found")
+
+// ErrJourneyConflict is returned when other writers kept changing a journey
+// until an update ran out of attempts
+var ErrJourneyConflict = errors.New("journey kept changing while being updated")
+
+// errJourneyVersion is returned by writeJourney when the journey is no longer
+// at the version it was read at
+var errJourneyVersion = errors.New("journey version changed")
+
+// writeJourneyScript writes journey fields if the journey is still at the
+// version in ARGV[1] (0 meaning it must not exist yet), removing stops beyond
+// the new number of stops in ARGV[3] and extending its expiry to at least
+// ARGV[2] seconds. It returns the new version, or -1 if the version differed.
+var writeJourneyScript = redis.NewScript(`
+local key = KEYS[1]
+local current = tonumber(redis.call('HGET', key, 'version') or '0')
+if current ~= tonumber(ARGV[1]) then
+	return -1
+end
+
+local count = tonumber(ARGV[3])
+local previous = tonumber(redis.call('HGET', key, 'stops') or '0')
+for i = count, previous - 1 do
+	redis.call('HDEL', key, 'stop:' .. i)
+end
+
+for i = 4, #ARGV, 2 do
+	redis.call('HSET', key, ARGV[i], ARGV[i + 1])
+end
+redis.call('HSET', key, 'stops', count)
+local version = redis.call('HINCRBY', key, 'version', 1)
+
+local ttl = tonumber(ARGV[2])
+if redis.call('TTL', key) < ttl then
+	redis.call('EXPIRE', key, ttl)
+end
+return version
+`)
+
+type journeyMeta struct {
+	UID          string              `json:"uid"`
+	RunDate      string              `json:"run_date"`
+	Cancellation *types.Cancellation `json:"cancellation,omitempty"`
+}
+
+func journeyStopField(i int) string {
+	return "stop:" + strconv.Itoa(i)
+}
+
+// LoadTrainJourney reads a journey from Redis, building it from the timetable
+// and the movement archive if it is not cached
+func LoadTrainJourney(ctx context.Context, db *pgxpool.Pool, rdb *redis.Client, trainUID, runDate string) (types.TrainJourney, error) {
+	journey, _, err := loadJourney(ctx, db, rdb, trainUID, runDate)
+	return journey, err
+}
+
+// UpdateTrainJourney loads a journey as LoadTrainJourney does, applies update
+// to it and stores the stops it changed. update returns false if it made no
+// change worth storing. If another writer changes the journey first, update
+// is applied again to their version of it, so it must not have effects
+// outside the journey it is given.
+func UpdateTrainJourney(ctx context.Context, db *pgxpool.Pool, rdb *redis.Client, trainUID, runDate string, update func(*types.TrainJourney) bool) (types.TrainJourney, error) {
+	key := BuildJourneyKey(trainUID, runDate)
+
+	for attempt := 0; attempt < journeyUpdateAttempts; attempt++ {
+		before, version, err := loadJourney(ctx, db, rdb, trainUID, runDate)
+		if err != nil {
+			return types.TrainJourney{}, err
+		}
+
+		after := cloneJourney(&before)
+		if !update(&after) {
+			return after, nil
+		}
+
+		err = writeJourney(ctx, rdb, key, version, &before, &after, journeyTTL)
+		if errors.Is(err, errJourneyVersion) {
+			if err := backOffJourneyRetry(ctx, attempt); err != nil {
+				return types.TrainJourney{}, err
+			}
+			continue
+		}
+		if err != nil {
+			return types.TrainJourney{}, err
+		}
+		return after, nil
+	}
+
+	return types.TrainJourney{}, ErrJourneyConflict
+}
+
+// ReplaceTrainJourney caches a journey built from a new schedule in place of
+// any already cached, keeping the realtime state recorded at the stops the two
+// have in common
+func ReplaceTrainJourney(ctx context.Context, rdb *redis.Client, journey *types.TrainJourney, ttl time.Duration) error {
+	key := BuildJourneyKey(journey.UID, journey.RunDate)
+
+	for attempt := 0; attempt < journeyUpdateAttempts; attempt++ {
+		current, version, err := readJourney(ctx, rdb, key)
+		if err != nil {
+			return err
+		}
+
+		replacement := cloneJourney(journey)
+		var before *types.TrainJourney
+		if version > 0 {
+			CarryRealtime(&current, &replacement)
+			before = &current
+		}
+
+		err = writeJourney(ctx, rdb, key, version, before, &replacement, ttl)
+		if errors.Is(err, errJourneyVersion) {
+			if err := backOffJourneyRetry(ctx, attempt); err != nil {
+				return err
+			}
+			continue
+		}
+		return err
+	}
+
+	return ErrJourneyConflict
+}
+
+// DeleteTrainJourney removes a cached journey, so it is built again from the
+// timetable the next time it is needed
+func DeleteTrainJourney(ctx context.Context, rdb *redis.Client, trainUID, runDate string) error {
+	if err := rdb.Del(ctx, BuildJourneyKey(trainUID, runDate)).Err(); err != nil {
+		return fmt.Errorf("failed to delete journey: %w", err)
+	}
+	return nil
+}
+
+// CarryRealtime copies the actuals, cancellations and their sources from one
+// version of a journey onto another, matching stops by stanox in journey
+// order so a location visited twice keeps each visit's state
+func CarryRealtime(from, to *types.TrainJourney) {
+	next := 0
+	for i := range to.Stops {
+		for j := next; j < len(from.Stops); j++ {
+			if from.Stops[j].Stanox != to.Stops[i].Stanox {
+				continue
+			}
+
+			old, stop := &from.Stops[j], &to.Stops[i]
+			stop.ActualArr, stop.ArrSource, stop.ArrSourceTime = old.ActualArr, old.ArrSource, old.ArrSourceTime
+			stop.ActualDep, stop.DepSource, stop.DepSourceTime = old.ActualDep, old.DepSource, old.DepSourceTime
+			stop.ActualPass, stop.PassSource, stop.PassSourceTime = old.ActualPass, old.PassSource, old.PassSourceTime
+			stop.Cancelled = old.Cancelled
+			next = j + 1
+			break
+		}
+	}
+
+	if to.Cancellation == nil {
+		to.Cancellation = from.Cancellation
+	}
+}
+
+// loadJourney reads a journey and its version from Redis, or builds it and
+// caches it if it is not there
+func loadJourney(ctx context.Context, db *pgxpool.Pool, rdb *redis.Client, trainUID, runDate string) (types.TrainJourney, int64, error) {
+	key := BuildJourneyKey(trainUID, runDate)
+
+	for attempt := 0; attempt < journeyUpdateAttempts; attempt++ {
+		journey, version, err := readJourney(ctx, rdb, key)
+		if err != nil {
+			return types.TrainJourney{}, 0, err
+		}
+		if version > 0 {
+			metrics.JourneyCache.WithLabelValues(metrics.CacheHit).Inc()
+			return journey, version, nil
+		}
+
+		metrics.JourneyCache.WithLabelValues(metrics.CacheMiss).Inc()
+		journey, err = LoadScheduleFromDatabase(ctx, db, trainUID, runDate)
+		if err != nil {
+			return types.TrainJourney{}, 0, err
+		}
+
+		// restore any realtime state already recorded in the archive, in case
+		// the cached journey was lost rather than never created. Caching the
+		// journey without it would lose that state for good.
+		movements, err := LoadArchivedMovements(ctx, db, trainUID, runDate)
+		if err != nil {
+			return types.TrainJourney{}, 0, err
+		}
+		ReplayMovements(&journey, movements)
+
+		// if another writer cached the journey first, use theirs
+		err = writeJourney(ctx, rdb, key, 0, nil, &journey, journeyTTL)
+		if errors.Is(err, errJourneyVersion) {
+			continue
+		}
+		if err != nil {
+			return types.TrainJourney{}, 0, err
+		}
+		return journey, 1, nil
+	}
+
+	return types.TrainJourney{}, 0, ErrJourneyConflict
+}
+
+// readJourney reads a cached journey, returning version 0 if it is not cached
+func readJourney(ctx context.Context, rdb *redis.Client, key string) (types.TrainJourney, int64, error) {
+	fields, err := rdb.HGetAll(ctx, key).Result()
+	if err != nil {
+		return types.TrainJourney{}, 0, fmt.Errorf("failed to read journey: %w", err)
+	}
+	if len(fields) == 0 {
+		return types.TrainJourney{}, 0, nil
+	}
+
+	version, err := strconv.ParseInt(fields[journeyVersionField], 10, 64)
+	if err != nil {
+		return types.TrainJourney{}, 0, fmt.Errorf("invalid journey version: %w", err)
+	}
+
+	var meta journeyMeta
+	if err := json.Unmarshal([]byte(fields[journeyMetaField]), &meta); err != nil {
+		return types.TrainJourney{}, 0, fmt.Errorf("failed to unmarshal journey: %w", err)
+	}
+
+	count, err := strconv.Atoi(fields[journeyStopsField])
+	if err != nil {
+		return types.TrainJourney{}, 0, fmt.Errorf("invalid journey stop count: %w", err)
+	}
+
+	stops := make([]types.Stop, count)
+	for i := range stops {
+		if err := json.Unmarshal([]byte(fields[journeyStopField(i)]), &stops[i]); err != nil {
+			return types.TrainJourney{}, 0, fmt.Errorf("failed to unmarshal journey stop %d: %w", i, err)
+		}
+	}
+
+	return types.TrainJourney{
+		UID:          meta.UID,
+		RunDate:      meta.RunDate,
+		Stops:        stops,
+		Cancellation: meta.Cancellation,
+	}, version, nil
+}
+
+// writeJourney writes whatever differs between two versions of a journey, as
+// long as the cached journey is still at the given version. With no earlier
+// version every field is written.
+func writeJourney(ctx context.Context, rdb *redis.Client, key string, version int64, before, after *types.TrainJourney, ttl time.Duration) error {
+	args := []any{version, int64(ttl.Seconds()), len(after.Stops)}
+
+	if before == nil || metaChanged(before, after) {
+		meta, err := json.Marshal(journeyMeta{UID: after.UID, RunDate: after.RunDate, Cancellation: after.Cancellation})
+		if err != nil {
+			return fmt.Errorf("failed to marshal journey: %w", err)
+		}
+		args = append(args, journeyMetaField, meta)
+	}
+
+	for i, stop := range after.Stops {
+		if before != nil && i < len(before.Stops) && before.Stops[i] == stop {
+			continue
+		}
+		b, err := json.Marshal(stop)
+		if err != nil {
+			return fmt.Errorf("failed to marshal journey stop: %w", err)
+		}
+		args = append(args, journeyStopField(i), b)
+	}
+
+	result, err := writeJourneyScript.Run(ctx, rdb, []string{key}, args...).Int64()
+	if err != nil {
+		return fmt.Errorf("failed to write journey: %w", err)
+	}
+	if result < 0 {
+		return errJourneyVersion
+	}
+	return nil
+}
+
+// backOffJourneyRetry waits a short random time before a conflicting write is
+// retried, so writers that collided are unlikely to collide again
+func backOffJourneyRetry(ctx context.Context, attempt int) error {
+	wait := time.Duration(rand.Int64N(int64(attempt+1) * int64(5*time.Millisecond)))
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(wait):
+		return nil
+	}
+}
+
+func metaChanged(before, after *types.TrainJourney) bool {
+	if before.UID != after.UID || before.RunDate != after.RunDate {
+		return true
+	}
+	if before.Cancellation == nil || after.Cancellation == nil {
+		return before.Cancellation != after.Cancellation
+	}
+	return *before.Cancellation != *after.Cancellation
+}
+
+// cloneJourney copies a journey so it can be changed without changing the
+// original
+func cloneJourney(journey *types.TrainJourney) types.TrainJourney {
+	clone := *journey
+	clone.Stops = append([]types.Stop(nil), journey.Stops...)
+	if journey.Cancellation != nil {
+		cancellation := *journey.Cancellation
+		clone.Cancellation = &cancellation
+	}
+	return clone
+}
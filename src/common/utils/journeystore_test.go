@@ -0,0 +1,252 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/jack-barr3tt/gbr-engine/src/common/types"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/redis/go-redis/v9"
+)
+
+func TestUpdateTrainJourneyDatabaseError(t *testing.T) {
+	ctx := context.Background()
+
+	server := miniredis.RunT(t)
+	rdb := redis.NewClient(&redis.Options{Addr: server.Addr()})
+	defer rdb.Close()
+
+	// nothing listens on port 1, so loading the schedule fails to connect
+	db, err := pgxpool.New(ctx, "postgres://gbr@127.0.0.1:1/gbr?connect_timeout=1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	_, err = UpdateTrainJourney(ctx, db, rdb, "C12345", "20260101", func(*types.TrainJourney) bool {
+		t.Error("update called without a journey")
+		return false
+	})
+	if err == nil {
+		t.Fatal("UpdateTrainJourney() succeeded without a database")
+	}
+	if errors.Is(err, ErrJourneyNotFound) {
+		t.Errorf("UpdateTrainJourney() = %v, want an error other than ErrJourneyNotFound so the message is retried", err)
+	}
+	if server.Exists(BuildJourneyKey("C12345", "20260101")) {
+		t.Error("journey cached without a schedule")
+	}
+}
+
+// cachedJourney caches loopJourney in a fresh Redis, so it can be updated
+// without a database
+func cachedJourney(t *testing.T) (*miniredis.Miniredis, *redis.Client) {
+	t.Helper()
+
+	server := miniredis.RunT(t)
+	rdb := redis.NewClient(&redis.Options{Addr: server.Addr()})
+	t.Cleanup(func() { rdb.Close() })
+
+	journey := loopJourney()
+	if err := ReplaceTrainJourney(context.Background(), rdb, &journey, journeyTTL); err != nil {
+		t.Fatalf("ReplaceTrainJourney() error = %v", err)
+	}
+	return server, rdb
+}
+
+func TestWriteJourneyRejectsStaleVersion(t *testing.T) {
+	ctx := context.Background()
+	_, rdb := cachedJourney(t)
+	key := BuildJourneyKey("C12345", "20260101")
+
+	before, version, err := readJourney(ctx, rdb, key)
+	if err != nil {
+		t.Fatalf("readJourney() error = %v", err)
+	}
+
+	first := cloneJourney(&before)
+	first.Stops[0].ActualDep = "1"
+	if err := writeJourney(ctx, rdb, key, version, &before, &first, journeyTTL); err != nil {
+		t.Fatalf("first writeJourney() error = %v", err)
+	}
+
+	// a second writer that read the same version is now behind
+	stale := cloneJourney(&before)
+	stale.Stops[0].ActualDep = "2"
+	err = writeJourney(ctx, rdb, key, version, &before, &stale, journeyTTL)
+	if !errors.Is(err, errJourneyVersion) {
+		t.Fatalf("stale writeJourney() error = %v, want errJourneyVersion", err)
+	}
+
+	after, afterVersion, err := readJourney(ctx, rdb, key)
+	if err != nil {
+		t.Fatalf("readJourney() error = %v", err)
+	}
+	if afterVersion != version+1 {
+		t.Errorf("version = %d, want %d", afterVersion, version+1)
+	}
+	if after.Stops[0].ActualDep != "1" {
+		t.Errorf("departure = %q, want the first writer's %q", after.Stops[0].ActualDep, "1")
+	}
+}
+
+func TestUpdateTrainJourneyRetriesInterleavedWrite(t *testing.T) {
+	ctx := context.Background()
+	_, rdb := cachedJourney(t)
+
+	// the first time its update runs, another writer changes the journey
+	// between it being read and written
+	calls := 0
+	journey, err := UpdateTrainJourney(ctx, nil, rdb, "C12345", "20260101", func(journey *types.TrainJourney) bool {
+		calls++
+		if calls == 1 {
+			_, err := UpdateTrainJourney(ctx, nil, rdb, "C12345", "20260101", func(journey *types.TrainJourney) bool {
+				journey.Stops[0].ActualDep = "1"
+				return true
+			})
+			if err != nil {
+				t.Fatalf("interleaved UpdateTrainJourney() error = %v", err)
+			}
+		}
+		journey.Stops[1].ActualPass = "2"
+		return true
+	})
+	if err != nil {
+		t.Fatalf("UpdateTrainJourney() error = %v", err)
+	}
+	if calls != 2 {
+		t.Errorf("update called %d times, want 2", calls)
+	}
+
+	stored, err := LoadTrainJourney(ctx, nil, rdb, "C12345", "20260101")
+	if err != nil {
+		t.Fatalf("LoadTrainJourney() error = %v", err)
+	}
+	for _, got := range []*types.TrainJourney{&journey, &stored} {
+		if got.Stops[0].ActualDep != "1" || got.Stops[1].ActualPass != "2" {
+			t.Errorf("journey lost a write: %+v", got.Stops[:2])
+		}
+	}
+}
+
+func TestUpdateTrainJourneyConcurrentWriters(t *testing.T) {
+	ctx := context.Background()
+	_, rdb := cachedJourney(t)
+
+	// each writer records an actual at a different stop, and every one must
+	// survive the others
+	var wg sync.WaitGroup
+	errs := make(chan error, len(loopJourney().Stops))
+	for i := range loopJourney().Stops {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := UpdateTrainJourney(ctx, nil, rdb, "C12345", "20260101", func(journey *types.TrainJourney) bool {
+				journey.Stops[i].ActualArr = string(rune('1' + i))
+				return true
+			})
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		if err != nil {
+			t.Errorf("UpdateTrainJourney() error = %v", err)
+		}
+	}
+
+	stored, err := LoadTrainJourney(ctx, nil, rdb, "C12345", "20260101")
+	if err != nil {
+		t.Fatalf("LoadTrainJourney() error = %v", err)
+	}
+	for i, stop := range stored.Stops {
+		if want := string(rune('1' + i)); stop.ActualArr != want {
+			t.Errorf("stop %d arrival = %q, want %q", i, stop.ActualArr, want)
+		}
+	}
+}
+
+func TestUpdateTrainJourneyGivesUp(t *testing.T) {
+	ctx := context.Background()
+	server, rdb := cachedJourney(t)
+	key := BuildJourneyKey("C12345", "20260101")
+
+	// another writer changes the journey every time it is read
+	calls := 0
+	_, err := UpdateTrainJourney(ctx, nil, rdb, "C12345", "20260101", func(journey *types.TrainJourney) bool {
+		calls++
+		server.HIncrBy(key, journeyVersionField, 1)
+		journey.Stops[0].ActualDep = "1"
+		return true
+	})
+	if !errors.Is(err, ErrJourneyConflict) {
+		t.Fatalf("UpdateTrainJourney() error = %v, want ErrJourneyConflict", err)
+	}
+	if calls != journeyUpdateAttempts {
+		t.Errorf("update called %d times, want %d", calls, journeyUpdateAttempts)
+	}
+
+	stored, err := LoadTrainJourney(ctx, nil, rdb, "C12345", "20260101")
+	if err != nil {
+		t.Fatalf("LoadTrainJourney() error = %v", err)
+	}
+	if stored.Stops[0].ActualDep != "" {
+		t.Errorf("departure = %q, want the update not written", stored.Stops[0].ActualDep)
+	}
+}
+
+func TestReplaceTrainJourneyKeepsActuals(t *testing.T) {
+	ctx := context.Background()
+	server, rdb := cachedJourney(t)
+
+	_, err := UpdateTrainJourney(ctx, nil, rdb, "C12345", "20260101", func(journey *types.TrainJourney) bool {
+		journey.Stops[0].ActualDep, journey.Stops[0].DepSource, journey.Stops[0].DepSourceTime = "1", types.FeedTRUST, "100"
+		journey.Stops[1].ActualPass, journey.Stops[1].PassSource = "2", types.FeedTD
+		journey.Stops[2].ActualArr = "3"
+		journey.Stops[3].Cancelled = true
+		journey.Cancellation = &types.Cancellation{Type: "EN ROUTE", Stanox: "C"}
+		return true
+	})
+	if err != nil {
+		t.Fatalf("UpdateTrainJourney() error = %v", err)
+	}
+
+	// the revised schedule retimes the calls, no longer passes B and stops
+	// short of C
+	revised := types.TrainJourney{
+		UID:     "C12345",
+		RunDate: "20260101",
+		Stops: []types.Stop{
+			{Stanox: "A", PlannedDep: "10:05"},
+			{Stanox: "A", PlannedArr: "10:25", PlannedDep: "10:27"},
+		},
+	}
+	if err := ReplaceTrainJourney(ctx, rdb, &revised, journeyTTL); err != nil {
+		t.Fatalf("ReplaceTrainJourney() error = %v", err)
+	}
+
+	stored, err := LoadTrainJourney(ctx, nil, rdb, "C12345", "20260101")
+	if err != nil {
+		t.Fatalf("LoadTrainJourney() error = %v", err)
+	}
+	if len(stored.Stops) != 2 {
+		t.Fatalf("journey has %d stops, want 2", len(stored.Stops))
+	}
+	if stop := stored.Stops[0]; stop.PlannedDep != "10:05" || stop.ActualDep != "1" || stop.DepSource != types.FeedTRUST || stop.DepSourceTime != "100" {
+		t.Errorf("first call at A = %+v, want the revised time with its departure kept", stop)
+	}
+	if stop := stored.Stops[1]; stop.PlannedArr != "10:25" || stop.ActualArr != "3" {
+		t.Errorf("second call at A = %+v, want the revised time with its arrival kept", stop)
+	}
+	if stored.Cancellation == nil || stored.Cancellation.Type != "EN ROUTE" {
+		t.Errorf("cancellation = %+v, want it kept", stored.Cancellation)
+	}
+	if fields, _ := server.HKeys(BuildJourneyKey("C12345", "20260101")); len(fields) != 5 {
+		t.Errorf("journey fields = %v, want the stops beyond the revised journey removed", fields)
+	}
+}
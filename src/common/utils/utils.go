@@ -3,82 +3,204 @@ package utils
 import (
 	"context"
 	"database/sql"
-	"encoding/json"
+	"errors"
 	"fmt"
 	"strings"
 	"time"
+	_ "time/tzdata"
 
+	"github.com/jack-barr3tt/gbr-engine/src/common/metrics"
 	"github.com/jack-barr3tt/gbr-engine/src/common/types"
+	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgxpool"
-	"github.com/redis/go-redis/v9"
 )
 
-func LoadTrainJourney(ctx context.Context, db *pgxpool.Pool, rdb *redis.Client, trainUID, runDate string) (types.TrainJourney, error) {
-	schedKey := BuildScheduleKey(trainUID, runDate)
-	raw, err := rdb.Get(ctx, schedKey).Result()
-	var journey types.TrainJourney
-	if err != nil {
-		journey, err = LoadScheduleFromDatabase(ctx, db, trainUID, runDate)
-		if err != nil {
-			return types.TrainJourney{}, err
+type MergeOutcome string
+
+const (
+	MergeApplied    MergeOutcome = "applied"
+	MergeDuplicate  MergeOutcome = "duplicate"
+	MergeStale      MergeOutcome = "stale"
+	MergeSuperseded MergeOutcome = "superseded"
+	MergeNoMatch    MergeOutcome = "no_match"
+)
+
+// MergeTrustEvent writes the actual time of a movement onto the matching stop.
+// sourceTime is when the feed queued the event; anything older than the event
+// already recorded from the same feed is ignored unless TRUST has flagged it as
+// a correction. Events synthesised from TD berth steps only fill gaps between
+// TRUST reports and never overwrite an actual that TRUST has already provided,
+// while a TRUST report always replaces one taken from TD. The index of
+// the matched stop is returned alongside the outcome, or -1 if none matched.
+func MergeTrustEvent(journey *types.TrainJourney, trust *types.TrustBody, sourceTime string) (MergeOutcome, int) {
+	feed := types.FeedTRUST
+	if trust.EventSource == types.FeedTD {
+		feed = types.FeedTD
+	}
+	corrected := strings.TrimSpace(trust.CorrectionInd) == "true"
+
+	i := matchStopIndex(journey, trust, corrected)
+	if i == -1 {
+		return MergeNoMatch, -1
+	}
+
+	actual, source, recorded := stopActual(&journey.Stops[i], trust.EventType)
+	if actual == nil {
+		return MergeNoMatch, -1
+	}
+
+	if feed == types.FeedTD && *actual != "" && *source != types.FeedTD {
+		return MergeSuperseded, i
+	}
+	if *actual == trust.ActualTimestamp && *source == feed {
+		return MergeDuplicate, i
+	}
+	if !corrected && *actual != "" && *source == feed && ParseIntOrZero(*recorded) > ParseIntOrZero(sourceTime) {
+		return MergeStale, i
+	}
+
+	*actual = trust.ActualTimestamp
+	*source = feed
+	*recorded = sourceTime
+	return MergeApplied, i
+}
+
+// stopActual returns the actual, source and source time fields of a stop that
+// an event of the given type is recorded in
+func stopActual(stop *types.Stop, eventType string) (actual, source, sourceTime *string) {
+	switch {
+	case stop.IsPass():
+		return &stop.ActualPass, &stop.PassSource, &stop.PassSourceTime
+	case eventType == "ARRIVAL":
+		return &stop.ActualArr, &stop.ArrSource, &stop.ArrSourceTime
+	case eventType == "DEPARTURE":
+		return &stop.ActualDep, &stop.DepSource, &stop.DepSourceTime
+	default:
+		return nil, nil, nil
+	}
+}
+
+// matchStopIndex picks which occurrence of the movement's stanox it refers to,
+// so trains calling at the same location more than once have each event
+// recorded against the right call. A match on planned time wins; otherwise the
+// first occurrence at or beyond the train's progress that is still awaiting
+// this event is used. Corrections instead look for the call already holding
+// the event they replace.
+func matchStopIndex(journey *types.TrainJourney, trust *types.TrustBody, corrected bool) int {
+	candidates := stopsAt(journey, trust.LocStanox)
+	if len(candidates) <= 1 {
+		if len(candidates) == 0 {
+			return -1
 		}
+		return candidates[0]
+	}
 
-		if b, err := json.Marshal(journey); err == nil {
-			rdb.Set(ctx, schedKey, b, 48*time.Hour)
+	if planned := FormatTrustTime(trust.PlannedTimestamp); planned != "" {
+		for _, i := range candidates {
+			if plannedTimeFor(&journey.Stops[i], trust.PlannedEventType) == planned {
+				return i
+			}
 		}
-	} else {
-		if err := json.Unmarshal([]byte(raw), &journey); err != nil {
-			return types.TrainJourney{}, fmt.Errorf("failed to unmarshal schedule: %w", err)
+		for _, i := range candidates {
+			stop := &journey.Stops[i]
+			if stop.PlannedArr == planned || stop.PlannedDep == planned || stop.PlannedPass == planned {
+				return i
+			}
 		}
 	}
-	return journey, nil
-}
 
-func MergeTrustEvent(journey *types.TrainJourney, trust *types.TrustBody) bool {
-	merged := false
-	for i, stop := range journey.Stops {
-		if stop.Stanox == trust.LocStanox {
-			if trust.EventType == "ARRIVAL" {
-				journey.Stops[i].ActualArr = trust.ActualTimestamp
-			} else if trust.EventType == "DEPARTURE" {
-				journey.Stops[i].ActualDep = trust.ActualTimestamp
+	if corrected {
+		for j := len(candidates) - 1; j >= 0; j-- {
+			actual, _, _ := stopActual(&journey.Stops[candidates[j]], trust.EventType)
+			if actual != nil && *actual != "" {
+				return candidates[j]
 			}
-			merged = true
-			break
 		}
 	}
-	return merged
+
+	progress := journeyProgress(journey)
+	for _, i := range candidates {
+		if i < progress {
+			continue
+		}
+		actual, _, _ := stopActual(&journey.Stops[i], trust.EventType)
+		if actual != nil && *actual == "" {
+			return i
+		}
+	}
+
+	for _, i := range candidates {
+		if i >= progress {
+			return i
+		}
+	}
+	return candidates[len(candidates)-1]
 }
 
+func plannedTimeFor(stop *types.Stop, plannedEventType string) string {
+	if stop.IsPass() {
+		return stop.PlannedPass
+	}
+	switch plannedEventType {
+	case "ARRIVAL", "DESTINATION":
+		return stop.PlannedArr
+	default:
+		return stop.PlannedDep
+	}
+}
+
+// FormatTrustTime converts a TRUST epoch millisecond timestamp into the HH:MM
+// form used for planned times in journeys
+func FormatTrustTime(timestamp string) string {
+	var timestampMs int64
+	if _, err := fmt.Sscanf(strings.TrimSpace(timestamp), "%d", &timestampMs); err != nil || timestampMs <= 1000000000 {
+		return ""
+	}
+	return time.UnixMilli(timestampMs).UTC().Format("15:04")
+}
+
+// LoadScheduleFromDatabase builds a journey from the schedule a train runs to
+// on a date. It returns ErrJourneyNotFound if there is no such schedule or it
+// is an STP cancellation, and any other error if the schedule could not be
+// read.
 func LoadScheduleFromDatabase(ctx context.Context, db *pgxpool.Pool, trainUID string, runDateStr string) (types.TrainJourney, error) {
+	defer metrics.QueryTimer("load_schedule").ObserveDuration()
+
 	runDate, err := time.Parse("20060102", runDateStr)
 	if err != nil {
 		return types.TrainJourney{}, fmt.Errorf("invalid run date: %w", err)
 	}
 
 	var scheduleID int
-	var scheduleDaysRuns string
+	var scheduleDaysRuns, stpIndicator string
 	var startDate, endDate time.Time
 	err = db.QueryRow(ctx, `
-		SELECT id, schedule_days_runs, schedule_start_date, schedule_end_date
+		SELECT id, schedule_days_runs, schedule_start_date, schedule_end_date, stp_indicator
 		FROM schedule
 		WHERE train_uid = $1
 		  AND schedule_start_date <= $2
 		  AND schedule_end_date >= $2
 		ORDER BY schedule_start_date DESC
 		LIMIT 1
-	`, trainUID, runDate).Scan(&scheduleID, &scheduleDaysRuns, &startDate, &endDate)
+	`, trainUID, runDate).Scan(&scheduleID, &scheduleDaysRuns, &startDate, &endDate, &stpIndicator)
 
+	if errors.Is(err, pgx.ErrNoRows) {
+		return types.TrainJourney{}, fmt.Errorf("%w: no schedule found for train %s on %s", ErrJourneyNotFound, trainUID, runDateStr)
+	}
 	if err != nil {
-		return types.TrainJourney{}, fmt.Errorf("no schedule found for train %s on %s", trainUID, runDateStr)
+		return types.TrainJourney{}, fmt.Errorf("failed to load schedule: %w", err)
 	}
 
 	if !IsScheduleValidForDate(scheduleDaysRuns, startDate, endDate, runDate) {
-		return types.TrainJourney{}, fmt.Errorf("schedule does not run on this day")
+		return types.TrainJourney{}, fmt.Errorf("%w: schedule does not run on this day", ErrJourneyNotFound)
+	}
+
+	if stpIndicator == STPCancellation {
+		return types.TrainJourney{}, fmt.Errorf("%w: schedule is cancelled on this day", ErrJourneyNotFound)
 	}
 
 	rows, err := db.Query(ctx, `
-		SELECT sl.tiploc_code, sl.arrival::text, sl.departure::text, t.stanox
+		SELECT sl.tiploc_code, sl.arrival::text, sl.departure::text, sl.pass::text, t.stanox
 		FROM schedule_location sl
 		LEFT JOIN tiploc t ON sl.tiploc_code = t.tiploc_code
 		WHERE sl.schedule_id = $1
@@ -92,10 +214,10 @@ func LoadScheduleFromDatabase(ctx context.Context, db *pgxpool.Pool, trainUID st
 	var stops []types.Stop
 	for rows.Next() {
 		var tiplocCode string
-		var arrival, departure sql.NullString
+		var arrival, departure, pass sql.NullString
 		var stanox sql.NullString
 
-		if err := rows.Scan(&tiplocCode, &arrival, &departure, &stanox); err != nil {
+		if err := rows.Scan(&tiplocCode, &arrival, &departure, &pass, &stanox); err != nil {
 			return types.TrainJourney{}, fmt.Errorf("failed to scan location: %w", err)
 		}
 
@@ -120,6 +242,13 @@ func LoadScheduleFromDatabase(ctx context.Context, db *pgxpool.Pool, trainUID st
 				stop.PlannedDep = departure.String
 			}
 		}
+		if pass.Valid {
+			if len(pass.String) >= 5 {
+				stop.PlannedPass = pass.String[:5]
+			} else {
+				stop.PlannedPass = pass.String
+			}
+		}
 		stops = append(stops, stop)
 	}
 
@@ -168,6 +297,10 @@ func ParseIntOrZero(s string) int {
 	return result
 }
 
+// STPCancellation is the STP indicator of a schedule that cancels the one it
+// overlays on the days it runs
+const STPCancellation = "C"
+
 func IsScheduleValidForDate(runsOn string, startDate, endDate, checkDate time.Time) bool {
 	if checkDate.Before(startDate) || checkDate.After(endDate) {
 		return false
@@ -190,14 +323,51 @@ func BuildActivationKey(trainID string) string {
 	return fmt.Sprintf("activation:%s", trainID)
 }
 
-func BuildScheduleKey(trainUID, runDate string) string {
-	return fmt.Sprintf("schedule:%s:%s", trainUID, runDate)
+func BuildHeadcodeKey(headcode string) string {
+	return fmt.Sprintf("headcode:%s", headcode)
+}
+
+func BuildJourneyKey(trainUID, runDate string) string {
+	return fmt.Sprintf("journey:%s:%s", trainUID, runDate)
+}
+
+func BuildBerthKey(areaID string) string {
+	return fmt.Sprintf("berths:%s", areaID)
+}
+
+func BuildTrainBerthKey(areaID, headcode string) string {
+	return fmt.Sprintf("train_berth:%s:%s", areaID, headcode)
+}
+
+func BuildSignallingKey(areaID string) string {
+	return fmt.Sprintf("signalling:%s", areaID)
+}
+
+func BuildSignallingHistoryKey(areaID string) string {
+	return fmt.Sprintf("signalling_history:%s", areaID)
 }
 
 func FormatRunDate(t time.Time) string {
 	return t.Format("20060102")
 }
 
+// ukTime is the time zone the timetable runs to. Its rules are embedded by
+// time/tzdata, since the service images have no zoneinfo of their own.
+var ukTime = func() *time.Location {
+	location, err := time.LoadLocation("Europe/London")
+	if err != nil {
+		panic(err)
+	}
+	return location
+}()
+
+// UKDate returns the date it is in the UK at t, as midnight UTC like the
+// dates parsed from schedules
+func UKDate(t time.Time) time.Time {
+	t = t.In(ukTime)
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+}
+
 func ParseTimeForComparison(timeStr string) (time.Time, error) {
 	timeStr = strings.TrimSpace(timeStr)
 
@@ -0,0 +1,302 @@
+package utils
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/jack-barr3tt/gbr-engine/src/common/types"
+)
+
+// trustTimestamp builds a TRUST epoch millisecond timestamp for a time of day
+func trustTimestamp(hhmm string) string {
+	t, err := time.Parse("15:04", hhmm)
+	if err != nil {
+		panic(err)
+	}
+	at := time.Date(2026, 1, 1, t.Hour(), t.Minute(), 0, 0, time.UTC)
+	return strconv.FormatInt(at.UnixMilli(), 10)
+}
+
+// loopJourney calls at A, passes B and calls at A again, so A appears twice
+func loopJourney() types.TrainJourney {
+	return types.TrainJourney{
+		UID:     "C12345",
+		RunDate: "20260101",
+		Stops: []types.Stop{
+			{Stanox: "A", PlannedDep: "10:00"},
+			{Stanox: "B", PlannedPass: "10:10"},
+			{Stanox: "A", PlannedArr: "10:20", PlannedDep: "10:22"},
+			{Stanox: "C", PlannedArr: "10:30"},
+		},
+	}
+}
+
+func TestMergeTrustEvent(t *testing.T) {
+	tests := []struct {
+		name       string
+		setup      func(*types.TrainJourney)
+		trust      types.TrustBody
+		sourceTime string
+		wantResult MergeOutcome
+		wantIndex  int
+		check      func(*testing.T, *types.TrainJourney)
+	}{
+		{
+			name:       "unknown stanox",
+			trust:      types.TrustBody{LocStanox: "Z", EventType: "ARRIVAL", ActualTimestamp: "1"},
+			sourceTime: "100",
+			wantResult: MergeNoMatch,
+			wantIndex:  -1,
+		},
+		{
+			name:       "arrival at a single call",
+			trust:      types.TrustBody{LocStanox: "C", EventType: "ARRIVAL", ActualTimestamp: "5"},
+			sourceTime: "100",
+			wantResult: MergeApplied,
+			wantIndex:  3,
+			check: func(t *testing.T, j *types.TrainJourney) {
+				stop := j.Stops[3]
+				if stop.ActualArr != "5" || stop.ArrSource != types.FeedTRUST || stop.ArrSourceTime != "100" {
+					t.Errorf("arrival not recorded: %+v", stop)
+				}
+			},
+		},
+		{
+			name:       "pass recorded at a passing point",
+			trust:      types.TrustBody{LocStanox: "B", EventType: "DEPARTURE", ActualTimestamp: "7"},
+			sourceTime: "100",
+			wantResult: MergeApplied,
+			wantIndex:  1,
+			check: func(t *testing.T, j *types.TrainJourney) {
+				if j.Stops[1].ActualPass != "7" || j.Stops[1].ActualDep != "" {
+					t.Errorf("pass not recorded: %+v", j.Stops[1])
+				}
+			},
+		},
+		{
+			name: "same actual from the same feed",
+			setup: func(j *types.TrainJourney) {
+				j.Stops[3].ActualArr, j.Stops[3].ArrSource, j.Stops[3].ArrSourceTime = "5", types.FeedTRUST, "100"
+			},
+			trust:      types.TrustBody{LocStanox: "C", EventType: "ARRIVAL", ActualTimestamp: "5"},
+			sourceTime: "100",
+			wantResult: MergeDuplicate,
+			wantIndex:  3,
+		},
+		{
+			name: "older event than the one recorded",
+			setup: func(j *types.TrainJourney) {
+				j.Stops[3].ActualArr, j.Stops[3].ArrSource, j.Stops[3].ArrSourceTime = "5", types.FeedTRUST, "200"
+			},
+			trust:      types.TrustBody{LocStanox: "C", EventType: "ARRIVAL", ActualTimestamp: "4"},
+			sourceTime: "100",
+			wantResult: MergeStale,
+			wantIndex:  3,
+		},
+		{
+			name: "correction older than the event recorded",
+			setup: func(j *types.TrainJourney) {
+				j.Stops[3].ActualArr, j.Stops[3].ArrSource, j.Stops[3].ArrSourceTime = "5", types.FeedTRUST, "200"
+			},
+			trust:      types.TrustBody{LocStanox: "C", EventType: "ARRIVAL", ActualTimestamp: "4", CorrectionInd: "true"},
+			sourceTime: "100",
+			wantResult: MergeApplied,
+			wantIndex:  3,
+			check: func(t *testing.T, j *types.TrainJourney) {
+				if j.Stops[3].ActualArr != "4" {
+					t.Errorf("correction not applied: %+v", j.Stops[3])
+				}
+			},
+		},
+		{
+			name: "TD step after a TRUST report",
+			setup: func(j *types.TrainJourney) {
+				j.Stops[3].ActualArr, j.Stops[3].ArrSource, j.Stops[3].ArrSourceTime = "5", types.FeedTRUST, "100"
+			},
+			trust:      types.TrustBody{LocStanox: "C", EventType: "ARRIVAL", ActualTimestamp: "6", EventSource: types.FeedTD},
+			sourceTime: "200",
+			wantResult: MergeSuperseded,
+			wantIndex:  3,
+		},
+		{
+			name: "older TRUST report after a TD step",
+			setup: func(j *types.TrainJourney) {
+				j.Stops[3].ActualArr, j.Stops[3].ArrSource, j.Stops[3].ArrSourceTime = "6", types.FeedTD, "200"
+			},
+			trust:      types.TrustBody{LocStanox: "C", EventType: "ARRIVAL", ActualTimestamp: "5"},
+			sourceTime: "100",
+			wantResult: MergeApplied,
+			wantIndex:  3,
+			check: func(t *testing.T, j *types.TrainJourney) {
+				stop := j.Stops[3]
+				if stop.ActualArr != "5" || stop.ArrSource != types.FeedTRUST || stop.ArrSourceTime != "100" {
+					t.Errorf("TD actual not replaced by TRUST: %+v", stop)
+				}
+			},
+		},
+		{
+			name: "older TD step than the one recorded",
+			setup: func(j *types.TrainJourney) {
+				j.Stops[3].ActualArr, j.Stops[3].ArrSource, j.Stops[3].ArrSourceTime = "6", types.FeedTD, "200"
+			},
+			trust:      types.TrustBody{LocStanox: "C", EventType: "ARRIVAL", ActualTimestamp: "5", EventSource: types.FeedTD},
+			sourceTime: "100",
+			wantResult: MergeStale,
+			wantIndex:  3,
+		},
+		{
+			name:       "TD step filling a gap",
+			trust:      types.TrustBody{LocStanox: "C", EventType: "ARRIVAL", ActualTimestamp: "6", EventSource: types.FeedTD},
+			sourceTime: "200",
+			wantResult: MergeApplied,
+			wantIndex:  3,
+			check: func(t *testing.T, j *types.TrainJourney) {
+				if j.Stops[3].ArrSource != types.FeedTD {
+					t.Errorf("source not recorded as TD: %+v", j.Stops[3])
+				}
+			},
+		},
+		{
+			name:       "event with no actual field at the stop",
+			trust:      types.TrustBody{LocStanox: "C", EventType: "OTHER", ActualTimestamp: "6"},
+			sourceTime: "100",
+			wantResult: MergeNoMatch,
+			wantIndex:  -1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			journey := loopJourney()
+			if tt.setup != nil {
+				tt.setup(&journey)
+			}
+
+			result, index := MergeTrustEvent(&journey, &tt.trust, tt.sourceTime)
+			if result != tt.wantResult || index != tt.wantIndex {
+				t.Fatalf("MergeTrustEvent() = %s, %d, want %s, %d", result, index, tt.wantResult, tt.wantIndex)
+			}
+			if tt.check != nil {
+				tt.check(t, &journey)
+			}
+		})
+	}
+}
+
+func TestMatchStopIndex(t *testing.T) {
+	tests := []struct {
+		name      string
+		setup     func(*types.TrainJourney)
+		trust     types.TrustBody
+		corrected bool
+		want      int
+	}{
+		{
+			name:  "single occurrence",
+			trust: types.TrustBody{LocStanox: "C", EventType: "ARRIVAL"},
+			want:  3,
+		},
+		{
+			name:  "not in the journey",
+			trust: types.TrustBody{LocStanox: "Z", EventType: "ARRIVAL"},
+			want:  -1,
+		},
+		{
+			name: "planned time of the event type",
+			trust: types.TrustBody{
+				LocStanox: "A", EventType: "DEPARTURE",
+				PlannedEventType: "DEPARTURE", PlannedTimestamp: trustTimestamp("10:22"),
+			},
+			want: 2,
+		},
+		{
+			name: "planned time of another event type",
+			trust: types.TrustBody{
+				LocStanox: "A", EventType: "ARRIVAL",
+				PlannedEventType: "DEPARTURE", PlannedTimestamp: trustTimestamp("10:20"),
+			},
+			want: 2,
+		},
+		{
+			name:  "first occurrence before the train has started",
+			trust: types.TrustBody{LocStanox: "A", EventType: "DEPARTURE"},
+			want:  0,
+		},
+		{
+			name: "next occurrence awaiting the event",
+			setup: func(j *types.TrainJourney) {
+				j.Stops[0].ActualDep = "1"
+				j.Stops[1].ActualPass = "2"
+			},
+			trust: types.TrustBody{LocStanox: "A", EventType: "DEPARTURE"},
+			want:  2,
+		},
+		{
+			name: "occurrence at or beyond progress once every one has the event",
+			setup: func(j *types.TrainJourney) {
+				j.Stops[0].ActualDep = "1"
+				j.Stops[1].ActualPass = "2"
+				j.Stops[2].ActualDep = "3"
+			},
+			trust: types.TrustBody{LocStanox: "A", EventType: "DEPARTURE"},
+			want:  2,
+		},
+		{
+			name: "correction replaces the latest occurrence holding the event",
+			setup: func(j *types.TrainJourney) {
+				j.Stops[0].ActualDep = "1"
+				j.Stops[1].ActualPass = "2"
+				j.Stops[2].ActualDep = "3"
+				j.Stops[3].ActualArr = "4"
+			},
+			trust:     types.TrustBody{LocStanox: "A", EventType: "DEPARTURE"},
+			corrected: true,
+			want:      2,
+		},
+		{
+			name: "correction of the first occurrence",
+			setup: func(j *types.TrainJourney) {
+				j.Stops[0].ActualDep = "1"
+			},
+			trust:     types.TrustBody{LocStanox: "A", EventType: "DEPARTURE"},
+			corrected: true,
+			want:      0,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			journey := loopJourney()
+			if tt.setup != nil {
+				tt.setup(&journey)
+			}
+
+			if got := matchStopIndex(&journey, &tt.trust, tt.corrected); got != tt.want {
+				t.Errorf("matchStopIndex() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestUKDate(t *testing.T) {
+	tests := []struct {
+		name string
+		at   time.Time
+		want string
+	}{
+		{"winter evening", time.Date(2026, 1, 7, 23, 30, 0, 0, time.UTC), "20260107"},
+		{"summer before midnight UTC", time.Date(2026, 6, 30, 23, 30, 0, 0, time.UTC), "20260701"},
+		{"summer after midnight UTC", time.Date(2026, 7, 1, 0, 30, 0, 0, time.UTC), "20260701"},
+		{"other zone", time.Date(2026, 7, 1, 8, 0, 0, 0, time.FixedZone("PDT", -7*3600)), "20260701"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := UKDate(tt.at)
+			if FormatRunDate(got) != tt.want || got.Location() != time.UTC || got.Hour() != 0 {
+				t.Errorf("UKDate(%v) = %v, want %s at midnight UTC", tt.at, got, tt.want)
+			}
+		})
+	}
+}
@@ -2,79 +2,12 @@ package main
 
 import (
 	"context"
-	"encoding/json"
-	"io"
-	"net/http"
-	"os"
-	"time"
 
-	"github.com/jack-barr3tt/gbr-engine/src/common/types"
+	"github.com/jack-barr3tt/gbr-engine/src/common/metrics"
 	"github.com/jack-barr3tt/gbr-engine/src/common/utils"
-	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/jack-barr3tt/gbr-engine/src/data-fetcher/fetcher"
 )
 
-func ReferenceRequest(endpoint string) (*http.Response, error) {
-	baseUrl := os.Getenv("NR_REFERENCE_API")
-	apiKey := os.Getenv("NR_REFERENCE_API_KEY")
-
-	client := &http.Client{}
-
-	req, err := http.NewRequest("GET", baseUrl+endpoint, nil)
-	if err != nil {
-		return nil, err
-	}
-	req.Header.Set("x-apikey", apiKey)
-
-	resp, err := client.Do(req)
-	if err != nil {
-		return nil, err
-	}
-	return resp, nil
-}
-
-func UpdateTOCs(pg *pgxpool.Pool) error {
-	res, err := ReferenceRequest("/LDBSVWS/api/ref/20211101/GetTOCList/1")
-	if err != nil {
-		return err
-	}
-	defer res.Body.Close()
-
-	body, err := io.ReadAll(res.Body)
-	if err != nil {
-		return err
-	}
-
-	var tocData types.TOCReference
-	if err := json.Unmarshal(body, &tocData); err != nil {
-		return err
-	}
-
-	tx, err := pg.Begin(context.Background())
-	if err != nil {
-		return err
-	}
-	defer tx.Rollback(context.Background())
-
-	if _, err = tx.Exec(context.Background(), "TRUNCATE TABLE reference_toc"); err != nil {
-		return err
-	}
-
-	for _, toc := range tocData.TOCList {
-		_, err := tx.Exec(context.Background(), "INSERT INTO reference_toc (code, name) VALUES ($1, $2)", toc.TOC, toc.Value)
-		if err != nil {
-			return err
-		}
-	}
-
-	tx.Exec(context.Background(), "UPDATE reference_fetch SET last_fetched = NOW() WHERE key = 'toc'")
-
-	if err := tx.Commit(context.Background()); err != nil {
-		return err
-	}
-
-	return nil
-}
-
 func main() {
 	utils.InitLogger()
 	defer utils.SyncLogger()
@@ -85,35 +18,9 @@ func main() {
 		log.Fatalw("failed to connect to Postgres", "error", err)
 	}
 
-	for {
-		rows, err := pg.Query(context.Background(), "SELECT key FROM reference_fetch WHERE last_fetched + max_age < NOW()")
-		if err != nil {
-			log.Fatalw("failed to query reference_fetch", "error", err)
-		}
-
-		var key string
-		for rows.Next() {
-			if err := rows.Scan(&key); err != nil {
-				log.Fatalw("failed to scan key", "error", err)
-			}
-
-			switch key {
-			case "toc":
-				log.Info("Updating TOC reference data...")
-				err := UpdateTOCs(pg)
-				if err != nil {
-					log.Warnw("Error updating TOC reference data", "error", err)
-				} else {
-					log.Info("TOC reference data updated successfully.")
-				}
-			default:
-				log.Infow("unknown reference key", "key", key)
-			}
-		}
-
-		rows.Close()
+	go metrics.ServeFromEnv(context.Background(), log)
 
-		// Sleep for a while before checking again
-		time.Sleep(1 * time.Hour)
+	if err := fetcher.Run(context.Background(), pg); err != nil {
+		log.Fatalw("failed to fetch reference data", "error", err)
 	}
 }
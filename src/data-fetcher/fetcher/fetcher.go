@@ -0,0 +1,255 @@
+package fetcher
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/jack-barr3tt/gbr-engine/src/common/metrics"
+	"github.com/jack-barr3tt/gbr-engine/src/common/types"
+	"github.com/jack-barr3tt/gbr-engine/src/common/utils"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+func ReferenceRequest(endpoint string) (*http.Response, error) {
+	baseUrl := os.Getenv("NR_REFERENCE_API")
+	apiKey := os.Getenv("NR_REFERENCE_API_KEY")
+
+	client := &http.Client{}
+
+	req, err := http.NewRequest("GET", baseUrl+endpoint, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("x-apikey", apiKey)
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+func UpdateTOCs(pg *pgxpool.Pool) error {
+	res, err := ReferenceRequest("/LDBSVWS/api/ref/20211101/GetTOCList/1")
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		return err
+	}
+
+	var tocData types.TOCReference
+	if err := json.Unmarshal(body, &tocData); err != nil {
+		return err
+	}
+
+	defer metrics.QueryTimer("store_tocs").ObserveDuration()
+
+	tx, err := pg.Begin(context.Background())
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(context.Background())
+
+	if _, err = tx.Exec(context.Background(), "TRUNCATE TABLE reference_toc"); err != nil {
+		return err
+	}
+
+	for _, toc := range tocData.TOCList {
+		_, err := tx.Exec(context.Background(), "INSERT INTO reference_toc (code, name) VALUES ($1, $2)", toc.TOC, toc.Value)
+		if err != nil {
+			return err
+		}
+	}
+
+	if _, err := tx.Exec(context.Background(), "UPDATE reference_fetch SET last_fetched = NOW() WHERE key = 'toc'"); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(context.Background()); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// OpenSMARTData returns the SMART berth dataset, read from SMART_FILE when set
+// and otherwise downloaded from the NR feeds. Either source may be gzipped.
+func OpenSMARTData() (io.ReadCloser, error) {
+	var source io.ReadCloser
+	if path := os.Getenv("SMART_FILE"); path != "" {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		source = f
+	} else {
+		req, err := http.NewRequest("GET", "https://publicdatafeeds.networkrail.co.uk/ntrod/SupportingFileAuthenticate?type=SMART", nil)
+		if err != nil {
+			return nil, err
+		}
+		req.SetBasicAuth(os.Getenv("NR_FEEDS_USERNAME"), os.Getenv("NR_FEEDS_PASSWORD"))
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			return nil, fmt.Errorf("HTTP error: %s", resp.Status)
+		}
+		source = resp.Body
+	}
+
+	buffered := bufio.NewReader(source)
+	magic, err := buffered.Peek(2)
+	if err != nil {
+		source.Close()
+		return nil, err
+	}
+
+	if magic[0] != 0x1f || magic[1] != 0x8b {
+		return readCloser{Reader: buffered, Closer: source}, nil
+	}
+
+	gzReader, err := gzip.NewReader(buffered)
+	if err != nil {
+		source.Close()
+		return nil, err
+	}
+	return readCloser{Reader: gzReader, Closer: source}, nil
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+func UpdateSMART(pg *pgxpool.Pool) error {
+	source, err := OpenSMARTData()
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+
+	var smartData types.SMARTReference
+	if err := json.NewDecoder(source).Decode(&smartData); err != nil {
+		return err
+	}
+
+	defer metrics.QueryTimer("store_smart").ObserveDuration()
+
+	tx, err := pg.Begin(context.Background())
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(context.Background())
+
+	if _, err = tx.Exec(context.Background(), "TRUNCATE TABLE reference_smart"); err != nil {
+		return err
+	}
+
+	rows := make([][]any, 0, len(smartData.BerthData))
+	for _, entry := range smartData.BerthData {
+		rows = append(rows, []any{
+			strings.TrimSpace(entry.TD),
+			utils.NullString(entry.FromBerth),
+			utils.NullString(entry.ToBerth),
+			utils.NullString(entry.FromLine),
+			utils.NullString(entry.ToLine),
+			utils.ParseIntOrZero(strings.TrimPrefix(entry.BerthOffset, "+")),
+			utils.NullString(entry.Platform),
+			utils.NullString(entry.Event),
+			utils.NullString(entry.Route),
+			utils.NullString(entry.Stanox),
+			utils.NullString(entry.Stanme),
+			utils.NullString(entry.StepType),
+			utils.NullString(entry.Comment),
+		})
+	}
+
+	// there are tens of thousands of berth steps, so they are copied in
+	// rather than inserted one at a time
+	_, err = tx.CopyFrom(context.Background(), pgx.Identifier{"reference_smart"}, []string{
+		"td_area", "from_berth", "to_berth", "from_line", "to_line", "berth_offset",
+		"platform", "event", "route", "stanox", "stanme", "step_type", "comment",
+	}, pgx.CopyFromRows(rows))
+	if err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec(context.Background(), "UPDATE reference_fetch SET last_fetched = NOW() WHERE key = 'smart'"); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(context.Background()); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// Run refreshes reference data whenever it is older than its maximum age,
+// checking hourly until the context is cancelled
+func Run(ctx context.Context, pg *pgxpool.Pool) error {
+	log := utils.GetLogger()
+
+	for {
+		rows, err := pg.Query(ctx, "SELECT key FROM reference_fetch WHERE last_fetched + max_age < NOW()")
+		if err != nil {
+			return fmt.Errorf("failed to query reference_fetch: %w", err)
+		}
+
+		var key string
+		for rows.Next() {
+			if err := rows.Scan(&key); err != nil {
+				rows.Close()
+				return fmt.Errorf("failed to scan key: %w", err)
+			}
+
+			switch key {
+			case "toc":
+				log.Info("Updating TOC reference data...")
+				err := UpdateTOCs(pg)
+				metrics.ReferenceFetches.WithLabelValues(key, metrics.Outcome(err)).Inc()
+				if err != nil {
+					log.Warnw("Error updating TOC reference data", "error", err)
+				} else {
+					log.Info("TOC reference data updated successfully.")
+				}
+			case "smart":
+				log.Info("Updating SMART reference data...")
+				err := UpdateSMART(pg)
+				metrics.ReferenceFetches.WithLabelValues(key, metrics.Outcome(err)).Inc()
+				if err != nil {
+					log.Warnw("Error updating SMART reference data", "error", err)
+				} else {
+					log.Info("SMART reference data updated successfully.")
+				}
+			default:
+				log.Infow("unknown reference key", "key", key)
+			}
+		}
+
+		rows.Close()
+
+		// Sleep for a while before checking again
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(1 * time.Hour):
+		}
+	}
+}
@@ -4,14 +4,26 @@
 package api
 
 import (
+	"fmt"
+
 	"github.com/gofiber/fiber/v2"
+	"github.com/oapi-codegen/runtime"
 )
 
 // ServerInterface represents all server handlers.
 type ServerInterface interface {
+	// Get feed health
+	// (GET /feeds/health)
+	GetFeedHealth(c *fiber.Ctx) error
 	// Health check endpoint
 	// (GET /health)
 	GetHealth(c *fiber.Ctx) error
+	// Liveness check
+	// (GET /health/live)
+	GetLiveness(c *fiber.Ctx) error
+	// Readiness check
+	// (GET /health/ready)
+	GetReadiness(c *fiber.Ctx) error
 	// Get all locations
 	// (GET /locations)
 	GetLocations(c *fiber.Ctx) error
@@ -21,6 +33,18 @@ type ServerInterface interface {
 	// Query services with filters
 	// (POST /services)
 	QueryServices(c *fiber.Ctx) error
+	// Query historical service performance
+	// (POST /services/performance)
+	QueryServicePerformance(c *fiber.Ctx) error
+	// Get berth occupancy
+	// (GET /td/areas/{area_id}/berths)
+	GetBerthOccupancy(c *fiber.Ctx, areaId string) error
+	// Get signalling state
+	// (GET /td/areas/{area_id}/signalling/{address})
+	GetSignallingState(c *fiber.Ctx, areaId string, address string) error
+	// Get train berth
+	// (GET /td/areas/{area_id}/trains/{headcode})
+	GetTrainBerth(c *fiber.Ctx, areaId string, headcode string) error
 }
 
 // ServerInterfaceWrapper converts contexts to parameters.
@@ -30,12 +54,30 @@ type ServerInterfaceWrapper struct {
 
 type MiddlewareFunc fiber.Handler
 
+// GetFeedHealth operation middleware
+func (siw *ServerInterfaceWrapper) GetFeedHealth(c *fiber.Ctx) error {
+
+	return siw.Handler.GetFeedHealth(c)
+}
+
 // GetHealth operation middleware
 func (siw *ServerInterfaceWrapper) GetHealth(c *fiber.Ctx) error {
 
 	return siw.Handler.GetHealth(c)
 }
 
+// GetLiveness operation middleware
+func (siw *ServerInterfaceWrapper) GetLiveness(c *fiber.Ctx) error {
+
+	return siw.Handler.GetLiveness(c)
+}
+
+// GetReadiness operation middleware
+func (siw *ServerInterfaceWrapper) GetReadiness(c *fiber.Ctx) error {
+
+	return siw.Handler.GetReadiness(c)
+}
+
 // GetLocations operation middleware
 func (siw *ServerInterfaceWrapper) GetLocations(c *fiber.Ctx) error {
 
@@ -54,6 +96,76 @@ func (siw *ServerInterfaceWrapper) QueryServices(c *fiber.Ctx) error {
 	return siw.Handler.QueryServices(c)
 }
 
+// QueryServicePerformance operation middleware
+func (siw *ServerInterfaceWrapper) QueryServicePerformance(c *fiber.Ctx) error {
+
+	return siw.Handler.QueryServicePerformance(c)
+}
+
+// GetBerthOccupancy operation middleware
+func (siw *ServerInterfaceWrapper) GetBerthOccupancy(c *fiber.Ctx) error {
+
+	var err error
+
+	// ------------- Path parameter "area_id" -------------
+	var areaId string
+
+	err = runtime.BindStyledParameterWithOptions("simple", "area_id", c.Params("area_id"), &areaId, runtime.BindStyledParameterOptions{Explode: false, Required: true})
+	if err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, fmt.Errorf("Invalid format for parameter area_id: %w", err).Error())
+	}
+
+	return siw.Handler.GetBerthOccupancy(c, areaId)
+}
+
+// GetSignallingState operation middleware
+func (siw *ServerInterfaceWrapper) GetSignallingState(c *fiber.Ctx) error {
+
+	var err error
+
+	// ------------- Path parameter "area_id" -------------
+	var areaId string
+
+	err = runtime.BindStyledParameterWithOptions("simple", "area_id", c.Params("area_id"), &areaId, runtime.BindStyledParameterOptions{Explode: false, Required: true})
+	if err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, fmt.Errorf("Invalid format for parameter area_id: %w", err).Error())
+	}
+
+	// ------------- Path parameter "address" -------------
+	var address string
+
+	err = runtime.BindStyledParameterWithOptions("simple", "address", c.Params("address"), &address, runtime.BindStyledParameterOptions{Explode: false, Required: true})
+	if err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, fmt.Errorf("Invalid format for parameter address: %w", err).Error())
+	}
+
+	return siw.Handler.GetSignallingState(c, areaId, address)
+}
+
+// GetTrainBerth operation middleware
+func (siw *ServerInterfaceWrapper) GetTrainBerth(c *fiber.Ctx) error {
+
+	var err error
+
+	// ------------- Path parameter "area_id" -------------
+	var areaId string
+
+	err = runtime.BindStyledParameterWithOptions("simple", "area_id", c.Params("area_id"), &areaId, runtime.BindStyledParameterOptions{Explode: false, Required: true})
+	if err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, fmt.Errorf("Invalid format for parameter area_id: %w", err).Error())
+	}
+
+	// ------------- Path parameter "headcode" -------------
+	var headcode string
+
+	err = runtime.BindStyledParameterWithOptions("simple", "headcode", c.Params("headcode"), &headcode, runtime.BindStyledParameterOptions{Explode: false, Required: true})
+	if err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, fmt.Errorf("Invalid format for parameter headcode: %w", err).Error())
+	}
+
+	return siw.Handler.GetTrainBerth(c, areaId, headcode)
+}
+
 // FiberServerOptions provides options for the Fiber server.
 type FiberServerOptions struct {
 	BaseURL     string
@@ -75,12 +187,26 @@ func RegisterHandlersWithOptions(router fiber.Router, si ServerInterface, option
 		router.Use(fiber.Handler(m))
 	}
 
+	router.Get(options.BaseURL+"/feeds/health", wrapper.GetFeedHealth)
+
 	router.Get(options.BaseURL+"/health", wrapper.GetHealth)
 
+	router.Get(options.BaseURL+"/health/live", wrapper.GetLiveness)
+
+	router.Get(options.BaseURL+"/health/ready", wrapper.GetReadiness)
+
 	router.Get(options.BaseURL+"/locations", wrapper.GetLocations)
 
 	router.Get(options.BaseURL+"/operators", wrapper.GetOperators)
 
 	router.Post(options.BaseURL+"/services", wrapper.QueryServices)
 
+	router.Post(options.BaseURL+"/services/performance", wrapper.QueryServicePerformance)
+
+	router.Get(options.BaseURL+"/td/areas/:area_id/berths", wrapper.GetBerthOccupancy)
+
+	router.Get(options.BaseURL+"/td/areas/:area_id/signalling/:address", wrapper.GetSignallingState)
+
+	router.Get(options.BaseURL+"/td/areas/:area_id/trains/:headcode", wrapper.GetTrainBerth)
+
 }
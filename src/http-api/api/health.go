@@ -1,14 +1,105 @@
 package api
 
 import (
+	"net/http"
+
 	"github.com/gofiber/fiber/v2"
+	"github.com/jack-barr3tt/gbr-engine/src/common/health"
+	"github.com/jack-barr3tt/gbr-engine/src/common/utils"
 )
 
-// GetHealth implements the health check endpoint
+// GetHealth implements the health check endpoint. Stale feeds only mark the
+// API as degraded, since it can still serve everything it has already stored,
+// while a failed component check marks it unhealthy and responds with 503.
 func (s *APIServer) GetHealth(c *fiber.Ctx) error {
+	report := s.Checker.Check(c.Context())
+	components := componentStatuses(report)
 	response := HealthResponse{
-		Status:  "healthy",
-		Version: "1.0.0",
+		Status:     "healthy",
+		Version:    "1.0.0",
+		Components: &components,
+	}
+	status := http.StatusOK
+	if !report.Ready {
+		response.Status = "unhealthy"
+		status = http.StatusServiceUnavailable
+	}
+
+	feeds, err := s.Data.GetFeedHealth(utils.FeedStaleAfter())
+	if err != nil {
+		s.Logger.Warnw("failed to load feed health", "error", err)
+		return c.Status(status).JSON(response)
+	}
+
+	summary := FeedHealthSummary{
+		StaleTopics:  []string{},
+		StaleTdAreas: []string{},
+	}
+	for _, topic := range feeds.Topics {
+		if topic.Stale {
+			summary.StaleTopics = append(summary.StaleTopics, topic.Topic)
+		}
+	}
+	for _, area := range feeds.TdAreas {
+		if area.Stale {
+			summary.StaleTdAreas = append(summary.StaleTdAreas, area.AreaId)
+		}
+	}
+
+	response.Feeds = &summary
+	if report.Ready && (len(summary.StaleTopics) > 0 || len(summary.StaleTdAreas) > 0) {
+		response.Status = "degraded"
+	}
+
+	return c.Status(status).JSON(response)
+}
+
+// GetFeedHealth reports the health of each feed topic and TD area
+func (s *APIServer) GetFeedHealth(c *fiber.Ctx) error {
+	feeds, err := s.Data.GetFeedHealth(utils.FeedStaleAfter())
+	if err != nil {
+		errStr := err.Error()
+		return c.Status(http.StatusInternalServerError).JSON(ErrorResponse{
+			Error:   "Cache error",
+			Message: "Failed to retrieve feed health",
+			Stack:   &errStr,
+		})
+	}
+
+	return c.JSON(feeds)
+}
+
+// GetLiveness reports the API process is running. It does not check any
+// dependencies, so an outage elsewhere does not get the API restarted.
+func (s *APIServer) GetLiveness(c *fiber.Ctx) error {
+	return c.JSON(LivenessResponse{Status: "alive"})
+}
+
+// GetReadiness checks each dependency the API needs to serve requests,
+// responding with 503 if any of them cannot be used
+func (s *APIServer) GetReadiness(c *fiber.Ctx) error {
+	report := s.Checker.Check(c.Context())
+
+	status := http.StatusOK
+	if !report.Ready {
+		status = http.StatusServiceUnavailable
+	}
+
+	return c.Status(status).JSON(ReadinessResponse{
+		Status:     report.Status,
+		Components: componentStatuses(report),
+	})
+}
+
+func componentStatuses(report health.Report) []ComponentStatus {
+	components := make([]ComponentStatus, len(report.Components))
+	for i, component := range report.Components {
+		components[i] = ComponentStatus{
+			Name:      component.Name,
+			Status:    component.Status,
+			Error:     component.Error,
+			LatencyMs: component.LatencyMs,
+		}
 	}
-	return c.JSON(response)
+	return components
 }
@@ -0,0 +1,72 @@
+package api
+
+import (
+	"net/http"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/jack-barr3tt/gbr-engine/src/common/data"
+)
+
+func (s *APIServer) QueryServicePerformance(c *fiber.Ctx) error {
+	var req ServicePerformanceRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(http.StatusBadRequest).JSON(ErrorResponse{
+			Error:   "Bad Request",
+			Message: "Invalid request body",
+		})
+	}
+
+	if req.TrainUid == nil && req.Headcode == nil {
+		return c.Status(http.StatusBadRequest).JSON(ErrorResponse{
+			Error:   "Bad Request",
+			Message: "Must specify one of: train_uid or headcode",
+		})
+	}
+
+	if req.DateFrom.Time.IsZero() || req.DateTo.Time.IsZero() || req.DateTo.Time.Before(req.DateFrom.Time) {
+		return c.Status(http.StatusBadRequest).JSON(ErrorResponse{
+			Error:   "Bad Request",
+			Message: "Must specify a valid date_from and date_to",
+		})
+	}
+
+	filters := data.PerformanceFilters{
+		TrainUID:        req.TrainUid,
+		Headcode:        req.Headcode,
+		DateFrom:        req.DateFrom.Time,
+		DateTo:          req.DateTo.Time,
+		OnTimeThreshold: 5,
+	}
+
+	if req.OnTimeThreshold != nil {
+		filters.OnTimeThreshold = *req.OnTimeThreshold
+	}
+
+	if req.Origin != nil {
+		stanox, err := s.StanoxFromLocationFilter(*req.Origin)
+		if err != nil {
+			return HandleError(c, err)
+		}
+		filters.Origin = stanox
+	}
+
+	if req.Destination != nil {
+		stanox, err := s.StanoxFromLocationFilter(*req.Destination)
+		if err != nil {
+			return HandleError(c, err)
+		}
+		filters.Destination = stanox
+	}
+
+	performance, err := s.Data.GetServicePerformance(filters)
+	if err != nil {
+		errStr := err.Error()
+		return c.Status(http.StatusInternalServerError).JSON(ErrorResponse{
+			Error:   "Database error",
+			Message: "Failed to retrieve service performance",
+			Stack:   &errStr,
+		})
+	}
+
+	return c.JSON(performance)
+}
@@ -1,7 +1,16 @@
 package api
 
 import (
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/middleware/cors"
 	"github.com/jack-barr3tt/gbr-engine/src/common/data"
+	"github.com/jack-barr3tt/gbr-engine/src/common/health"
+	"github.com/jack-barr3tt/gbr-engine/src/common/metrics"
 	"github.com/jack-barr3tt/gbr-engine/src/common/utils"
 	"github.com/jackc/pgx/v5/pgxpool"
 	"github.com/redis/go-redis/v9"
@@ -13,6 +22,8 @@ type APIServer struct {
 	Redis  *redis.Client
 	Logger *zap.SugaredLogger
 	Data   *data.DataClient
+
+	Checker *health.Checker
 }
 
 func NewServer() (*APIServer, error) {
@@ -25,12 +36,69 @@ func NewServer() (*APIServer, error) {
 
 	redis := utils.NewRedisClient()
 
-	data := data.NewDataClient(db, redis, logger)
+	return NewServerWith(db, redis), nil
+}
+
+// NewServerWith creates a server using existing connections
+func NewServerWith(db *pgxpool.Pool, redis *redis.Client) *APIServer {
+	logger := utils.GetLogger()
 
 	return &APIServer{
 		DB:     db,
 		Redis:  redis,
 		Logger: logger,
-		Data:   data,
-	}, nil
+		Data:   data.NewDataClient(db, redis, logger),
+		Checker: health.NewChecker(
+			health.Postgres(db),
+			health.Redis(redis),
+			health.SchemaVersion(db),
+			health.TimetableLoaded(db),
+		),
+	}
+}
+
+// NewApp creates the fiber app serving the API, logging every request other
+// than health checks and timing every request
+func NewApp(server *APIServer) *fiber.App {
+	log := server.Logger
+	app := fiber.New()
+
+	app.Use(func(c *fiber.Ctx) error {
+		path := c.Path()
+		method := c.Method()
+
+		if !strings.HasPrefix(path, "/health") {
+			log.Infow("request", "method", method, "path", path, "status", c.Response().StatusCode())
+		}
+
+		return c.Next()
+	})
+
+	app.Use(requestMetrics)
+	app.Use(cors.New())
+
+	RegisterHandlers(app, server)
+	return app
+}
+
+// requestMetrics times each request by the route pattern that served it, so
+// requests for different services share a label
+func requestMetrics(c *fiber.Ctx) error {
+	start := time.Now()
+	err := c.Next()
+
+	// errors are only turned into responses after the middleware returns
+	status := c.Response().StatusCode()
+	if err != nil {
+		status = fiber.StatusInternalServerError
+		var fiberErr *fiber.Error
+		if errors.As(err, &fiberErr) {
+			status = fiberErr.Code
+		}
+	}
+
+	metrics.HTTPRequestDuration.
+		WithLabelValues(c.Method(), c.Route().Path, strconv.Itoa(status)).
+		Observe(time.Since(start).Seconds())
+	return err
 }
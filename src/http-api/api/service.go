@@ -70,10 +70,12 @@ func (s *APIServer) QueryServices(c *fiber.Ctx) error {
 
 	// Add realtime data based on the date range from filters
 	realtimeDate := time.Now()
+	realtimeStanox := ""
 	if len(filters.PassesThrough) > 0 && filters.PassesThrough[0].TimeFrom != nil {
 		realtimeDate = *filters.PassesThrough[0].TimeFrom
+		realtimeStanox = filters.PassesThrough[0].Stanox
 	}
-	s.Data.AddRealtimeData(services, realtimeDate)
+	s.Data.AddRealtimeData(services, realtimeDate, realtimeStanox)
 
 	return c.JSON(services)
 }
@@ -0,0 +1,81 @@
+package api
+
+import (
+	"database/sql"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// GetSignallingState reports the signalling state bits held at an address of a
+// TD area, along with its recent changes
+func (s *APIServer) GetSignallingState(c *fiber.Ctx, areaId string, address string) error {
+	parsedAddress, err := strconv.ParseUint(strings.TrimSpace(address), 16, 8)
+	if err != nil {
+		return c.Status(http.StatusBadRequest).JSON(ErrorResponse{
+			Error:   "Bad Request",
+			Message: "Address must be a hex value between 00 and FF",
+		})
+	}
+
+	state, err := s.Data.GetSignallingState(strings.ToUpper(areaId), int(parsedAddress), 50)
+	if err == sql.ErrNoRows {
+		return c.Status(http.StatusNotFound).JSON(NotFoundResponse{
+			Error: "No signalling state for this area",
+		})
+	}
+	if err != nil {
+		errStr := err.Error()
+		return c.Status(http.StatusInternalServerError).JSON(ErrorResponse{
+			Error:   "Cache error",
+			Message: "Failed to retrieve signalling state",
+			Stack:   &errStr,
+		})
+	}
+
+	return c.JSON(state)
+}
+
+// GetBerthOccupancy reports the description held in each occupied berth of a
+// TD area
+func (s *APIServer) GetBerthOccupancy(c *fiber.Ctx, areaId string) error {
+	occupancy, err := s.Data.GetBerthOccupancy(strings.ToUpper(areaId))
+	if err == sql.ErrNoRows {
+		return c.Status(http.StatusNotFound).JSON(NotFoundResponse{
+			Error: "No berth occupancy for this area",
+		})
+	}
+	if err != nil {
+		errStr := err.Error()
+		return c.Status(http.StatusInternalServerError).JSON(ErrorResponse{
+			Error:   "Cache error",
+			Message: "Failed to retrieve berth occupancy",
+			Stack:   &errStr,
+		})
+	}
+
+	return c.JSON(occupancy)
+}
+
+// GetTrainBerth reports the berth a headcode was last seen in within a TD
+// area
+func (s *APIServer) GetTrainBerth(c *fiber.Ctx, areaId string, headcode string) error {
+	position, err := s.Data.GetTrainBerth(strings.ToUpper(areaId), strings.ToUpper(strings.TrimSpace(headcode)))
+	if err == sql.ErrNoRows {
+		return c.Status(http.StatusNotFound).JSON(NotFoundResponse{
+			Error: "Headcode not in any berth of this area",
+		})
+	}
+	if err != nil {
+		errStr := err.Error()
+		return c.Status(http.StatusInternalServerError).JSON(ErrorResponse{
+			Error:   "Cache error",
+			Message: "Failed to retrieve train berth",
+			Stack:   &errStr,
+		})
+	}
+
+	return c.JSON(position)
+}
@@ -4,13 +4,25 @@ package api
 import api_types "github.com/jack-barr3tt/gbr-engine/src/common/api-types"
 
 type (
-	ErrorResponse       = api_types.ErrorResponse
-	HealthResponse      = api_types.HealthResponse
-	Location            = api_types.Location
-	NotFoundResponse    = api_types.NotFoundResponse
-	Operator            = api_types.Operator
-	ScheduleLocation    = api_types.ScheduleLocation
-	ServiceResponse     = api_types.ServiceResponse
-	ServiceQueryRequest = api_types.ServiceQueryRequest
-	LocationFilter      = api_types.LocationFilter
+	ComponentStatus            = api_types.ComponentStatus
+	ErrorResponse              = api_types.ErrorResponse
+	FeedHealthResponse         = api_types.FeedHealthResponse
+	FeedHealthSummary          = api_types.FeedHealthSummary
+	HealthResponse             = api_types.HealthResponse
+	LivenessResponse           = api_types.LivenessResponse
+	Location                   = api_types.Location
+	NotFoundResponse           = api_types.NotFoundResponse
+	Operator                   = api_types.Operator
+	ScheduleLocation           = api_types.ScheduleLocation
+	ReadinessResponse          = api_types.ReadinessResponse
+	ServiceResponse            = api_types.ServiceResponse
+	ServiceQueryRequest        = api_types.ServiceQueryRequest
+	ServicePerformanceRequest  = api_types.ServicePerformanceRequest
+	ServicePerformanceResponse = api_types.ServicePerformanceResponse
+	LocationFilter             = api_types.LocationFilter
+	SignallingChange           = api_types.SignallingChange
+	SignallingStateResponse    = api_types.SignallingStateResponse
+	BerthOccupancy             = api_types.BerthOccupancy
+	BerthOccupancyResponse     = api_types.BerthOccupancyResponse
+	TrainBerthResponse         = api_types.TrainBerthResponse
 )
@@ -1,10 +1,11 @@
-//go:generate oapi-codegen -config server.cfg.yaml ../../spec/openapi.yaml
+//go:generate go run github.com/oapi-codegen/oapi-codegen/v2/cmd/oapi-codegen@v2.5.0 -config server.cfg.yaml ../../spec/openapi.yaml
 
 package main
 
 import (
-	"github.com/gofiber/fiber/v2"
-	"github.com/gofiber/fiber/v2/middleware/cors"
+	"context"
+
+	"github.com/jack-barr3tt/gbr-engine/src/common/metrics"
 	"github.com/jack-barr3tt/gbr-engine/src/common/utils"
 	"github.com/jack-barr3tt/gbr-engine/src/http-api/api"
 )
@@ -14,28 +15,15 @@ func main() {
 	defer utils.SyncLogger()
 	log := utils.GetLogger()
 
-	app := fiber.New()
-
-	app.Use(func(c *fiber.Ctx) error {
-		path := c.Path()
-		method := c.Method()
-
-		if path != "/health" {
-			log.Infow("request", "method", method, "path", path, "status", c.Response().StatusCode())
-		}
-
-		return c.Next()
-	})
-
-	app.Use(cors.New())
-
 	server, err := api.NewServer()
 	if err != nil {
 		log.Fatalw("failed to start http api server", "error", err)
 		return
 	}
 
-	api.RegisterHandlers(app, server)
+	app := api.NewApp(server)
+
+	go metrics.ServeFromEnv(context.Background(), log)
 
 	if err := app.Listen(":3000"); err != nil {
 		log.Fatalw("fiber listen failed", "error", err)
@@ -0,0 +1,107 @@
+package feed
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+
+	"github.com/go-stomp/stomp/v3"
+	"github.com/go-stomp/stomp/v3/server"
+)
+
+// EmbeddedSource runs a STOMP broker inside the process and subscribes to it
+// like the live feed. Anything able to speak STOMP can publish frames into it,
+// and recordings can be played into it with Publish, so the full client path
+// is exercised without a connection to Network Rail.
+type EmbeddedSource struct {
+	*StompSource
+	listener net.Listener
+
+	mu         sync.Mutex
+	subscribed map[string]chan struct{}
+}
+
+// NewEmbeddedSource starts a broker listening on addr
+func NewEmbeddedSource(addr string) (*EmbeddedSource, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen for embedded STOMP: %w", err)
+	}
+
+	go (&server.Server{}).Serve(ln)
+
+	e := &EmbeddedSource{
+		listener:   ln,
+		subscribed: make(map[string]chan struct{}),
+	}
+	e.StompSource = NewStompSource(func(string) (*stomp.Conn, error) {
+		// the embedded broker does not set the ack header STOMP 1.2 clients
+		// need to acknowledge messages, so stay on 1.1
+		return stomp.Dial("tcp", ln.Addr().String(), stomp.ConnOpt.AcceptVersion(stomp.V11))
+	})
+
+	return e, nil
+}
+
+func (e *EmbeddedSource) Addr() string {
+	return e.listener.Addr().String()
+}
+
+func (e *EmbeddedSource) Close() error {
+	return e.listener.Close()
+}
+
+func (e *EmbeddedSource) Subscribe(ctx context.Context, topic, subscriptionName string) (Subscription, error) {
+	sub, err := e.StompSource.Subscribe(ctx, topic, subscriptionName)
+	if err != nil {
+		return nil, err
+	}
+
+	e.mu.Lock()
+	ready := e.readyLocked(topic)
+	select {
+	case <-ready:
+	default:
+		close(ready)
+	}
+	e.mu.Unlock()
+
+	return sub, nil
+}
+
+func (e *EmbeddedSource) readyLocked(topic string) chan struct{} {
+	ready, ok := e.subscribed[topic]
+	if !ok {
+		ready = make(chan struct{})
+		e.subscribed[topic] = ready
+	}
+	return ready
+}
+
+// Publish plays a recording into the broker. Topics on the broker do not hold
+// messages for absent subscribers, so playback waits until each of the given
+// topics has been subscribed to.
+func (e *EmbeddedSource) Publish(ctx context.Context, replay *ReplaySource, topics ...string) error {
+	for _, topic := range topics {
+		e.mu.Lock()
+		ready := e.readyLocked(topic)
+		e.mu.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ready:
+		}
+	}
+
+	conn, err := stomp.Dial("tcp", e.Addr())
+	if err != nil {
+		return fmt.Errorf("failed to connect to embedded STOMP: %w", err)
+	}
+	defer conn.Disconnect()
+
+	return replay.Play(ctx, func(frame Frame) error {
+		return conn.Send(frame.Topic, "application/json", []byte(frame.Body))
+	})
+}
@@ -0,0 +1,65 @@
+package feed
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestEmbeddedSourcePlaysRecording(t *testing.T) {
+	const topic = "/topic/TRAIN_MVT_ALL_TOC"
+	dir := t.TempDir()
+	origin := time.Date(2026, 1, 1, 10, 0, 0, 0, time.UTC)
+	writeRecording(t, filepath.Join(dir, "feed.ndjson"), []Frame{
+		{Topic: topic, Received: origin, Body: "1"},
+		{Topic: "/topic/TD_ALL_SIG_AREA", Received: origin, Body: "td"},
+		{Topic: topic, Received: origin.Add(time.Second), Body: "2"},
+	}, "")
+	replay, err := NewReplaySource(dir, 0)
+	if err != nil {
+		t.Fatalf("NewReplaySource() error = %v", err)
+	}
+
+	source, err := NewEmbeddedSource("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("NewEmbeddedSource() error = %v", err)
+	}
+	defer source.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// playback waits for the subscription, so nothing is published before it
+	published := make(chan error, 1)
+	go func() {
+		published <- source.Publish(ctx, replay, topic)
+	}()
+
+	sub, err := source.Subscribe(ctx, topic, "test")
+	if err != nil {
+		t.Fatalf("Subscribe() error = %v", err)
+	}
+	defer sub.Close()
+
+	for _, want := range []string{"1", "2"} {
+		select {
+		case msg, ok := <-sub.Messages():
+			if !ok {
+				t.Fatalf("subscription ended before %q: %v", want, sub.Err())
+			}
+			if msg.Topic != topic || string(msg.Body) != want {
+				t.Errorf("delivered %q on %s, want %q on %s", msg.Body, msg.Topic, want, topic)
+			}
+			if err := msg.Ack(); err != nil {
+				t.Errorf("Ack() error = %v", err)
+			}
+		case <-ctx.Done():
+			t.Fatalf("%q was not delivered", want)
+		}
+	}
+
+	if err := <-published; err != nil {
+		t.Errorf("Publish() error = %v", err)
+	}
+}
@@ -0,0 +1,109 @@
+package feed
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Frame is a raw feed message as recorded to disk, one per line of NDJSON
+type Frame struct {
+	Topic    string    `json:"topic"`
+	Received time.Time `json:"received"`
+	Body     string    `json:"body"`
+}
+
+// Message is a single message delivered by a subscription. It must be
+// acknowledged once it has been handled, or the source may deliver it again.
+type Message struct {
+	Topic    string
+	Body     []byte
+	Received time.Time
+	ack      func() error
+}
+
+// NewMessage creates a message for a source outside this package, where ack
+// acknowledges it to the source
+func NewMessage(topic string, body []byte, received time.Time, ack func() error) Message {
+	return Message{Topic: topic, Body: body, Received: received, ack: ack}
+}
+
+func (m Message) Ack() error {
+	if m.ack == nil {
+		return nil
+	}
+	return m.ack()
+}
+
+// Source is somewhere feed messages can be subscribed to from, such as the
+// live Network Rail broker or a set of recorded files
+type Source interface {
+	// Subscribe starts delivering messages published to topic. The
+	// subscription name identifies a durable subscription on sources that
+	// support them, so messages are held for it while it is disconnected.
+	Subscribe(ctx context.Context, topic, subscriptionName string) (Subscription, error)
+}
+
+type Subscription interface {
+	// Messages is closed once the subscription ends, after which Err reports
+	// why. Err returns io.EOF once a finite source has been exhausted.
+	Messages() <-chan Message
+	Err() error
+	Close() error
+}
+
+// subscription is a Subscription fed by a goroutine that closes the channel
+// when it is done. The goroutine should stop sending once done is closed.
+type subscription struct {
+	ch        chan Message
+	done      chan struct{}
+	err       error
+	closeOnce sync.Once
+	close     func() error
+}
+
+func newSubscription(close func() error) *subscription {
+	return &subscription{
+		ch:    make(chan Message),
+		done:  make(chan struct{}),
+		close: close,
+	}
+}
+
+func (s *subscription) Messages() <-chan Message {
+	return s.ch
+}
+
+func (s *subscription) Err() error {
+	return s.err
+}
+
+func (s *subscription) Close() error {
+	var err error
+	s.closeOnce.Do(func() {
+		close(s.done)
+		if s.close != nil {
+			err = s.close()
+		}
+	})
+	return err
+}
+
+// send delivers a message unless the subscription is closed or the context
+// is cancelled first
+func (s *subscription) send(ctx context.Context, message Message) bool {
+	select {
+	case s.ch <- message:
+		return true
+	case <-s.done:
+		return false
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// finish records why the subscription ended and closes its channel
+func (s *subscription) finish(err error) {
+	s.err = err
+	close(s.ch)
+}
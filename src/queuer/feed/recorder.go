@@ -0,0 +1,236 @@
+package feed
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jack-barr3tt/gbr-engine/src/common/utils"
+)
+
+const recordingFormat = "feed-2006010215"
+
+// recordingFlushInterval is the longest a recorded frame is held in the gzip
+// writer's buffer before it is written to the file, so little is lost if the
+// process is killed and a recording can be replayed while it is written
+const recordingFlushInterval = time.Second
+
+// Recorder writes raw frames to gzipped NDJSON files in a directory, starting
+// a new file every hour and deleting the oldest files once the directory grows
+// beyond its size limit. The files can be played back with ReplaySource.
+type Recorder struct {
+	dir           string
+	maxBytes      int64
+	flushInterval time.Duration
+
+	mu         sync.Mutex
+	hour       time.Time
+	file       *os.File
+	gz         *gzip.Writer
+	flushTimer *time.Timer
+	closed     bool
+}
+
+func NewRecorder(dir string, maxBytes int64) (*Recorder, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create recording directory: %w", err)
+	}
+
+	r := &Recorder{dir: dir, maxBytes: maxBytes, flushInterval: recordingFlushInterval}
+	if err := r.prune(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Record appends a frame to the recording for the hour it was received in
+func (r *Recorder) Record(frame Frame) error {
+	line, err := json.Marshal(frame)
+	if err != nil {
+		return fmt.Errorf("failed to marshal frame: %w", err)
+	}
+	line = append(line, '\n')
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.closed {
+		return fmt.Errorf("recorder is closed")
+	}
+
+	// frames from different topics can arrive slightly out of order around the
+	// hour, so only ever rotate forwards
+	hour := frame.Received.UTC().Truncate(time.Hour)
+	if r.gz == nil || hour.After(r.hour) {
+		if err := r.rotate(hour); err != nil {
+			return err
+		}
+	}
+
+	if _, err := r.gz.Write(line); err != nil {
+		return fmt.Errorf("failed to write frame: %w", err)
+	}
+	if r.flushTimer == nil {
+		r.flushTimer = time.AfterFunc(r.flushInterval, r.flush)
+	}
+	return nil
+}
+
+// flush writes the frames buffered since the last flush to the recording
+func (r *Recorder) flush() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.flushTimer = nil
+	if r.gz == nil {
+		return
+	}
+	if err := r.gz.Flush(); err != nil {
+		utils.GetLogger().Warnw("failed to flush recording", "error", err)
+	}
+}
+
+// rotate closes the current recording and opens the one for the given hour.
+// Reopening an hour that was already recorded, such as after a restart,
+// appends a new gzip member which readers treat as a continuation.
+func (r *Recorder) rotate(hour time.Time) error {
+	if err := r.closeFile(); err != nil {
+		return err
+	}
+	if err := r.prune(); err != nil {
+		return err
+	}
+
+	name := filepath.Join(r.dir, hour.Format(recordingFormat)+".ndjson.gz")
+	f, err := os.OpenFile(name, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return fmt.Errorf("failed to open recording: %w", err)
+	}
+
+	r.file = f
+	r.gz = gzip.NewWriter(f)
+	r.hour = hour
+	return nil
+}
+
+func (r *Recorder) closeFile() error {
+	if r.gz == nil {
+		return nil
+	}
+
+	gzErr := r.gz.Close()
+	fileErr := r.file.Close()
+	r.gz, r.file = nil, nil
+
+	if gzErr != nil {
+		return fmt.Errorf("failed to finish recording: %w", gzErr)
+	}
+	if fileErr != nil {
+		return fmt.Errorf("failed to close recording: %w", fileErr)
+	}
+	return nil
+}
+
+// prune deletes the oldest recordings until the total size of those left is
+// within the limit
+func (r *Recorder) prune() error {
+	if r.maxBytes <= 0 {
+		return nil
+	}
+
+	entries, err := os.ReadDir(r.dir)
+	if err != nil {
+		return fmt.Errorf("failed to list recordings: %w", err)
+	}
+
+	type recording struct {
+		path string
+		size int64
+	}
+	var recordings []recording
+	var total int64
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".ndjson.gz") {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		recordings = append(recordings, recording{path: filepath.Join(r.dir, entry.Name()), size: info.Size()})
+		total += info.Size()
+	}
+	sort.Slice(recordings, func(i, j int) bool { return recordings[i].path < recordings[j].path })
+
+	for _, rec := range recordings {
+		if total <= r.maxBytes {
+			break
+		}
+		if err := os.Remove(rec.path); err != nil {
+			return fmt.Errorf("failed to delete recording: %w", err)
+		}
+		total -= rec.size
+		utils.GetLogger().Infow("deleted old recording", "path", rec.path, "size", rec.size)
+	}
+
+	return nil
+}
+
+func (r *Recorder) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.closed = true
+	if r.flushTimer != nil {
+		r.flushTimer.Stop()
+		r.flushTimer = nil
+	}
+	return r.closeFile()
+}
+
+// recordingSource records every message delivered by the source it wraps
+type recordingSource struct {
+	Source
+	recorder *Recorder
+}
+
+// Record wraps a source so every message it delivers is also recorded
+func Record(source Source, recorder *Recorder) Source {
+	return &recordingSource{Source: source, recorder: recorder}
+}
+
+func (s *recordingSource) Subscribe(ctx context.Context, topic, subscriptionName string) (Subscription, error) {
+	inner, err := s.Source.Subscribe(ctx, topic, subscriptionName)
+	if err != nil {
+		return nil, err
+	}
+
+	sub := newSubscription(inner.Close)
+
+	go func() {
+		for msg := range inner.Messages() {
+			err := s.recorder.Record(Frame{
+				Topic:    msg.Topic,
+				Received: msg.Received,
+				Body:     string(msg.Body),
+			})
+			if err != nil {
+				utils.GetLogger().Warnw("failed to record frame", "topic", msg.Topic, "error", err)
+			}
+
+			if !sub.send(ctx, msg) {
+				sub.finish(ctx.Err())
+				return
+			}
+		}
+		sub.finish(inner.Err())
+	}()
+
+	return sub, nil
+}
@@ -0,0 +1,121 @@
+package feed
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// recordFrames records a frame per body on the given topic, received a minute
+// apart from start
+func recordFrames(t *testing.T, r *Recorder, topic string, start time.Time, bodies ...string) []Frame {
+	t.Helper()
+
+	var frames []Frame
+	for i, body := range bodies {
+		frame := Frame{Topic: topic, Received: start.Add(time.Duration(i) * time.Minute), Body: body}
+		if err := r.Record(frame); err != nil {
+			t.Fatalf("Record() error = %v", err)
+		}
+		frames = append(frames, frame)
+	}
+	return frames
+}
+
+func recordingPath(dir string, hour time.Time) string {
+	return filepath.Join(dir, hour.Format(recordingFormat)+".ndjson.gz")
+}
+
+func TestRecorderRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	first := time.Date(2026, 1, 1, 10, 0, 0, 0, time.UTC)
+	second, third := first.Add(time.Hour), first.Add(2*time.Hour)
+
+	r, err := NewRecorder(dir, 0)
+	if err != nil {
+		t.Fatalf("NewRecorder() error = %v", err)
+	}
+	recordFrames(t, r, "TRAIN_MVT_ALL_TOC", first, "a", "b")
+	want := recordFrames(t, r, "TRAIN_MVT_ALL_TOC", second, "c", "d")
+	// a frame from before the hour that arrives late stays in the current file
+	want = append(want, recordFrames(t, r, "TD_ALL_SIG_AREA", first.Add(59*time.Minute), "late")...)
+	if err := r.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+
+	// limited to the size of the second hour, so the first is deleted
+	info, err := os.Stat(recordingPath(dir, second))
+	if err != nil {
+		t.Fatalf("second hour not recorded: %v", err)
+	}
+	r, err = NewRecorder(dir, info.Size())
+	if err != nil {
+		t.Fatalf("NewRecorder() error = %v", err)
+	}
+	if _, err := os.Stat(recordingPath(dir, first)); !os.IsNotExist(err) {
+		t.Errorf("oldest recording not pruned: %v", err)
+	}
+	want = append(want, recordFrames(t, r, "TRAIN_MVT_ALL_TOC", third, "e")...)
+	if err := r.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+
+	source, err := NewReplaySource(dir, 0)
+	if err != nil {
+		t.Fatalf("NewReplaySource() error = %v", err)
+	}
+	var got []Frame
+	err = source.Play(context.Background(), func(frame Frame) error {
+		got = append(got, frame)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Play() error = %v", err)
+	}
+
+	if len(got) != len(want) {
+		t.Fatalf("replayed %d frames, want %d: %+v", len(got), len(want), got)
+	}
+	for i := range want {
+		if got[i].Topic != want[i].Topic || got[i].Body != want[i].Body || !got[i].Received.Equal(want[i].Received) {
+			t.Errorf("frame %d = %+v, want %+v", i, got[i], want[i])
+		}
+	}
+}
+
+func TestRecorderFlushesWhileOpen(t *testing.T) {
+	dir := t.TempDir()
+	hour := time.Date(2026, 1, 1, 10, 0, 0, 0, time.UTC)
+
+	r, err := NewRecorder(dir, 0)
+	if err != nil {
+		t.Fatalf("NewRecorder() error = %v", err)
+	}
+	r.flushInterval = 10 * time.Millisecond
+	defer r.Close()
+
+	recordFrames(t, r, "TRAIN_MVT_ALL_TOC", hour, "a")
+
+	// the recording is still open, so is read up to the last flushed frame
+	source := &ReplaySource{}
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		var frames int
+		err := source.readFile(recordingPath(dir, hour), func(Frame) error {
+			frames++
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("readFile() error = %v", err)
+		}
+		if frames == 1 {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("recorded frame never flushed to the file")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,187 @@
+package feed
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// replayBufferSize is the longest line that can be read from a recorded file.
+// TD and VSTP bodies can be large, so this is well above bufio's default.
+const replayBufferSize = 16 * 1024 * 1024
+
+// ReplaySource plays back frames recorded as NDJSON, optionally gzipped. All
+// subscriptions share a clock, so frames from different topics are delivered
+// in the same relative order and spacing they were received in.
+type ReplaySource struct {
+	files  []string
+	speed  float64
+	origin time.Time
+
+	startOnce sync.Once
+	start     time.Time
+}
+
+// NewReplaySource reads frames from a single recording or every recording
+// under a directory, in file name order. Speed scales the gaps between
+// frames, so 1 replays in real time, 60 replays an hour a minute, and 0
+// replays as fast as the frames can be handled.
+func NewReplaySource(path string, speed float64) (*ReplaySource, error) {
+	var files []string
+	err := filepath.WalkDir(path, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.IsDir() && (strings.HasSuffix(p, ".ndjson") || strings.HasSuffix(p, ".ndjson.gz")) {
+			files = append(files, p)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to find recordings: %w", err)
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("no recordings found in %s", path)
+	}
+	sort.Strings(files)
+
+	source := &ReplaySource{files: files, speed: speed}
+
+	// the first frame of the first file anchors the replay clock
+	err = source.readFile(files[0], func(frame Frame) error {
+		source.origin = frame.Received
+		return io.EOF
+	})
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	return source, nil
+}
+
+func (r *ReplaySource) Subscribe(ctx context.Context, topic, subscriptionName string) (Subscription, error) {
+	sub := newSubscription(nil)
+
+	go func() {
+		err := r.Play(ctx, func(frame Frame) error {
+			if frame.Topic != topic {
+				return nil
+			}
+
+			message := Message{
+				Topic:    frame.Topic,
+				Body:     []byte(frame.Body),
+				Received: frame.Received,
+			}
+			if !sub.send(ctx, message) {
+				return context.Canceled
+			}
+			return nil
+		})
+		if err == nil {
+			err = io.EOF
+		}
+		sub.finish(err)
+	}()
+
+	return sub, nil
+}
+
+// Play calls emit with every recorded frame at the time it is due, returning
+// once all frames have been played or emit returns an error
+func (r *ReplaySource) Play(ctx context.Context, emit func(Frame) error) error {
+	r.startOnce.Do(func() {
+		r.start = time.Now()
+	})
+
+	for _, file := range r.files {
+		err := r.readFile(file, func(frame Frame) error {
+			if err := r.wait(ctx, frame.Received); err != nil {
+				return err
+			}
+			return emit(frame)
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// wait sleeps until a frame received at the given time is due to be replayed
+func (r *ReplaySource) wait(ctx context.Context, received time.Time) error {
+	if r.speed <= 0 {
+		return ctx.Err()
+	}
+
+	due := r.start.Add(time.Duration(float64(received.Sub(r.origin)) / r.speed))
+	delay := time.Until(due)
+	if delay <= 0 {
+		return ctx.Err()
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+func (r *ReplaySource) readFile(path string, fn func(Frame) error) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("failed to open recording: %w", err)
+	}
+	defer f.Close()
+
+	var reader io.Reader = f
+	if strings.HasSuffix(path, ".gz") {
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			return fmt.Errorf("failed to decompress recording %s: %w", path, err)
+		}
+		defer gz.Close()
+		reader = gz
+	}
+
+	scanner := bufio.NewScanner(reader)
+	scanner.Buffer(make([]byte, 64*1024), replayBufferSize)
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		if len(line) == 0 {
+			continue
+		}
+
+		// a partly written frame at the end of a recording is skipped
+		var frame Frame
+		if err := json.Unmarshal(line, &frame); err != nil {
+			continue
+		}
+		if err := fn(frame); err != nil {
+			return err
+		}
+	}
+
+	// likewise a compressed recording cut off mid-write still replays up to
+	// the last full frame
+	if err := scanner.Err(); err != nil && err != io.ErrUnexpectedEOF {
+		return fmt.Errorf("failed to read recording %s: %w", path, err)
+	}
+
+	return nil
+}
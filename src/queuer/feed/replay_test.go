@@ -0,0 +1,148 @@
+package feed
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeRecording writes frames to an NDJSON file, gzipped if the name ends in
+// .gz, followed by any extra raw text
+func writeRecording(t *testing.T, path string, frames []Frame, extra string) {
+	t.Helper()
+
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	var w io.Writer = f
+	if filepath.Ext(path) == ".gz" {
+		gz := gzip.NewWriter(f)
+		defer gz.Close()
+		w = gz
+	}
+
+	enc := json.NewEncoder(w)
+	for _, frame := range frames {
+		if err := enc.Encode(frame); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := io.WriteString(w, extra); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReplayPacing(t *testing.T) {
+	dir := t.TempDir()
+	origin := time.Date(2026, 1, 1, 10, 0, 0, 0, time.UTC)
+	offsets := []time.Duration{0, 2 * time.Second, 3 * time.Second, 6 * time.Second}
+
+	var frames []Frame
+	for _, offset := range offsets {
+		frames = append(frames, Frame{Topic: "TRAIN_MVT_ALL_TOC", Received: origin.Add(offset), Body: "{}"})
+	}
+	writeRecording(t, filepath.Join(dir, "feed.ndjson"), frames, "")
+
+	// at 40 times real time the frames are due 50ms, 75ms and 150ms in
+	const speed = 40
+	source, err := NewReplaySource(dir, speed)
+	if err != nil {
+		t.Fatalf("NewReplaySource() error = %v", err)
+	}
+
+	start := time.Now()
+	var emitted []time.Duration
+	err = source.Play(context.Background(), func(Frame) error {
+		emitted = append(emitted, time.Since(start))
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Play() error = %v", err)
+	}
+
+	if len(emitted) != len(offsets) {
+		t.Fatalf("played %d frames, want %d", len(emitted), len(offsets))
+	}
+	for i, offset := range offsets {
+		if due := offset / speed; emitted[i] < due {
+			t.Errorf("frame %d played after %v, want at least %v", i, emitted[i], due)
+		}
+	}
+}
+
+func TestReplayStopsWhenCancelled(t *testing.T) {
+	dir := t.TempDir()
+	origin := time.Date(2026, 1, 1, 10, 0, 0, 0, time.UTC)
+	writeRecording(t, filepath.Join(dir, "feed.ndjson"), []Frame{
+		{Topic: "TRAIN_MVT_ALL_TOC", Received: origin, Body: "{}"},
+		{Topic: "TRAIN_MVT_ALL_TOC", Received: origin.Add(time.Hour), Body: "{}"},
+	}, "")
+
+	source, err := NewReplaySource(dir, 1)
+	if err != nil {
+		t.Fatalf("NewReplaySource() error = %v", err)
+	}
+
+	// the second frame is an hour away, so only the first is played in time
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	played := 0
+	err = source.Play(ctx, func(Frame) error {
+		played++
+		return nil
+	})
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Play() error = %v, want the context's error", err)
+	}
+	if played != 1 {
+		t.Errorf("played %d frames before being cancelled, want 1", played)
+	}
+}
+
+func TestReplaySubscriptionEndsWithEOF(t *testing.T) {
+	dir := t.TempDir()
+	origin := time.Date(2026, 1, 1, 10, 0, 0, 0, time.UTC)
+	writeRecording(t, filepath.Join(dir, "feed-2026010110.ndjson.gz"), []Frame{
+		{Topic: "TRAIN_MVT_ALL_TOC", Received: origin, Body: "1"},
+		{Topic: "TD_ALL_SIG_AREA", Received: origin, Body: "td"},
+		{Topic: "TRAIN_MVT_ALL_TOC", Received: origin, Body: "2"},
+	}, "")
+	// a recording cut off part way through a frame
+	writeRecording(t, filepath.Join(dir, "feed-2026010111.ndjson"), []Frame{
+		{Topic: "TRAIN_MVT_ALL_TOC", Received: origin, Body: "3"},
+	}, `{"topic":"TRAIN_MVT_ALL_TOC","rec`)
+
+	source, err := NewReplaySource(dir, 0)
+	if err != nil {
+		t.Fatalf("NewReplaySource() error = %v", err)
+	}
+	sub, err := source.Subscribe(context.Background(), "TRAIN_MVT_ALL_TOC", "test")
+	if err != nil {
+		t.Fatalf("Subscribe() error = %v", err)
+	}
+	defer sub.Close()
+
+	var got []string
+	for msg := range sub.Messages() {
+		if msg.Topic != "TRAIN_MVT_ALL_TOC" {
+			t.Errorf("delivered a message from %s", msg.Topic)
+		}
+		got = append(got, string(msg.Body))
+	}
+
+	if len(got) != 3 || got[0] != "1" || got[1] != "2" || got[2] != "3" {
+		t.Errorf("delivered %v, want [1 2 3]", got)
+	}
+	if !errors.Is(sub.Err(), io.EOF) {
+		t.Errorf("Err() = %v, want io.EOF once the recordings are exhausted", sub.Err())
+	}
+}
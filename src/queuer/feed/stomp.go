@@ -0,0 +1,77 @@
+package feed
+
+import (
+	"context"
+	"time"
+
+	"github.com/go-stomp/stomp/v3"
+)
+
+// StompSource subscribes to topics on a STOMP broker, dialling a separate
+// connection for each subscription
+type StompSource struct {
+	dial func(subscriptionName string) (*stomp.Conn, error)
+}
+
+// NewStompSource creates a source that dials a connection for each
+// subscription, passing the subscription name so the dialler can derive a
+// client ID that stays stable across reconnects
+func NewStompSource(dial func(subscriptionName string) (*stomp.Conn, error)) *StompSource {
+	return &StompSource{dial: dial}
+}
+
+// Subscribe makes a durable subscription to the topic. Messages use client
+// individual acknowledgement, so any not acknowledged before the connection
+// is lost are redelivered by the broker.
+func (s *StompSource) Subscribe(ctx context.Context, topic, subscriptionName string) (Subscription, error) {
+	conn, err := s.dial(subscriptionName)
+	if err != nil {
+		return nil, err
+	}
+
+	stompSub, err := conn.Subscribe(topic, stomp.AckClientIndividual,
+		stomp.SubscribeOpt.Header("activemq.subscriptionName", subscriptionName),
+	)
+	if err != nil {
+		conn.Disconnect()
+		return nil, err
+	}
+
+	sub := newSubscription(conn.Disconnect)
+
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				sub.finish(ctx.Err())
+				return
+			case <-sub.done:
+				sub.finish(nil)
+				return
+			case msg, ok := <-stompSub.C:
+				if !ok {
+					sub.finish(nil)
+					return
+				}
+				if msg.Err != nil {
+					sub.finish(msg.Err)
+					return
+				}
+
+				message := Message{
+					Topic:    topic,
+					Body:     msg.Body,
+					Received: time.Now(),
+					ack:      func() error { return conn.Ack(msg) },
+				}
+
+				if !sub.send(ctx, message) {
+					sub.finish(ctx.Err())
+					return
+				}
+			}
+		}
+	}()
+
+	return sub, nil
+}
@@ -2,66 +2,117 @@ package listener
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"io"
 	"sync"
+	"time"
 
-	"github.com/go-stomp/stomp/v3"
-	amqp "github.com/rabbitmq/amqp091-go"
+	"github.com/jack-barr3tt/gbr-engine/src/common/bus"
+	"github.com/jack-barr3tt/gbr-engine/src/common/utils"
+	"github.com/jack-barr3tt/gbr-engine/src/queuer/feed"
+)
+
+const (
+	minBackoff = 1 * time.Second
+	maxBackoff = 2 * time.Minute
 )
 
 type Listener struct {
-	ctx       context.Context
-	wg        *sync.WaitGroup
-	channel   *amqp.Channel
-	stompConn *stomp.Conn
-	topic     string
-	handler   func(*amqp.Channel, string)
+	ctx              context.Context
+	wg               *sync.WaitGroup
+	bus              bus.Bus
+	source           feed.Source
+	topic            string
+	subscriptionName string
+	handler          func(bus.Bus, string) error
+
+	// minBackoff and maxBackoff bound the wait before each reconnect
+	minBackoff time.Duration
+	maxBackoff time.Duration
 }
 
-func NewListener(ctx context.Context, wg *sync.WaitGroup, channel *amqp.Channel, stompConn *stomp.Conn, topic string, handler func(*amqp.Channel, string)) *Listener {
+// NewListener creates a listener for a topic on a feed source. Each listener
+// holds its own subscription so it can reconnect independently of the others,
+// and subscribes durably under subscriptionName so messages published while
+// it is reconnecting are held by the broker.
+func NewListener(ctx context.Context, wg *sync.WaitGroup, b bus.Bus, source feed.Source, topic, subscriptionName string, handler func(bus.Bus, string) error) *Listener {
 	return &Listener{
-		ctx:       ctx,
-		wg:        wg,
-		channel:   channel,
-		stompConn: stompConn,
-		topic:     topic,
-		handler:   handler,
+		ctx:              ctx,
+		wg:               wg,
+		bus:              b,
+		source:           source,
+		topic:            topic,
+		subscriptionName: subscriptionName,
+		handler:          handler,
+		minBackoff:       minBackoff,
+		maxBackoff:       maxBackoff,
 	}
 }
 
-func (l *Listener) DeclareQueue(name string) error {
-	_, err := l.channel.QueueDeclare(
-		name,
-		false,
-		false,
-		false,
-		false,
-		nil,
-	)
-	return err
+// DeclareQueue declares a durable queue for messages from the feed, bound
+// with the binding key, along with the feed's dead letter queue
+func (l *Listener) DeclareQueue(feed, name, bindingKey string, opts ...bus.QueueOption) error {
+	return l.bus.DeclareQueue(l.ctx, feed, name, bindingKey, opts...)
 }
 
+// Start consumes the topic until the context is cancelled or the source runs
+// out of messages, reconnecting with exponential backoff whenever the
+// subscription is lost
 func (l *Listener) Start() error {
 	defer l.wg.Done()
+	logger := utils.GetLogger()
 
-	sub, err := l.stompConn.Subscribe(l.topic, stomp.AckAuto)
-	if err != nil {
-		return err
-	}
-	defer sub.Unsubscribe()
-
+	backoff := l.minBackoff
 	for {
+		received, err := l.consume()
+		if l.ctx.Err() != nil {
+			return nil
+		}
+		if errors.Is(err, io.EOF) {
+			logger.Infow("feed exhausted", "topic", l.topic)
+			return nil
+		}
+
+		if received {
+			backoff = l.minBackoff
+		}
+		logger.Warnw("STOMP subscription lost, reconnecting", "topic", l.topic, "backoff", backoff, "error", err)
+
 		select {
 		case <-l.ctx.Done():
 			return nil
-		case msg, ok := <-sub.C:
-			if !ok {
-				return nil
-			}
-			if msg.Err != nil {
-				continue
-			}
-
-			l.handler(l.channel, string(msg.Body))
+		case <-time.After(backoff):
+		}
+
+		backoff = min(backoff*2, l.maxBackoff)
+	}
+}
+
+// consume runs a single subscription until it is lost, reporting whether any
+// messages were received on it. Messages are only acknowledged once the
+// handler has published them; if it fails the subscription is dropped so the
+// source redelivers the message on reconnect.
+func (l *Listener) consume() (bool, error) {
+	sub, err := l.source.Subscribe(l.ctx, l.topic, l.subscriptionName)
+	if err != nil {
+		return false, err
+	}
+	defer sub.Close()
+	utils.GetLogger().Infow("subscribed to feed topic", "topic", l.topic, "subscription", l.subscriptionName)
+
+	received := false
+	for msg := range sub.Messages() {
+		received = true
+
+		if err := l.handler(l.bus, string(msg.Body)); err != nil {
+			return received, fmt.Errorf("failed to handle message: %w", err)
+		}
+
+		if err := msg.Ack(); err != nil {
+			return received, err
 		}
 	}
+
+	return received, sub.Err()
 }
@@ -0,0 +1,183 @@
+package listener
+
+import (
+	"context"
+	"errors"
+	"io"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jack-barr3tt/gbr-engine/src/common/bus"
+	"github.com/jack-barr3tt/gbr-engine/src/queuer/feed"
+)
+
+// scriptedSource delivers the same bodies to every subscription, starting
+// from the first one not yet acknowledged, like a broker redelivering to a
+// durable subscription
+type scriptedSource struct {
+	bodies []string
+
+	mu sync.Mutex
+	// failures are returned by the next calls to Subscribe
+	failures []error
+	// breaks are the bodies a subscription is lost just before delivering,
+	// each only once
+	breaks     []int
+	subscribed []time.Time
+	acked      []string
+}
+
+func (s *scriptedSource) Subscribe(ctx context.Context, topic, subscriptionName string) (feed.Subscription, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.subscribed = append(s.subscribed, time.Now())
+	if len(s.failures) > 0 {
+		err := s.failures[0]
+		s.failures = s.failures[1:]
+		return nil, err
+	}
+
+	sub := &scriptedSubscription{ch: make(chan feed.Message), done: make(chan struct{})}
+	go s.deliver(ctx, sub, topic, len(s.acked))
+	return sub, nil
+}
+
+func (s *scriptedSource) deliver(ctx context.Context, sub *scriptedSubscription, topic string, from int) {
+	for i := from; i < len(s.bodies); i++ {
+		s.mu.Lock()
+		broken := slices.Contains(s.breaks, i)
+		s.breaks = slices.DeleteFunc(s.breaks, func(b int) bool { return b == i })
+		s.mu.Unlock()
+		if broken {
+			sub.finish(errors.New("connection lost"))
+			return
+		}
+
+		body := s.bodies[i]
+		msg := feed.NewMessage(topic, []byte(body), time.Now(), func() error {
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			s.acked = append(s.acked, body)
+			return nil
+		})
+		select {
+		case sub.ch <- msg:
+		case <-sub.done:
+			sub.finish(nil)
+			return
+		case <-ctx.Done():
+			sub.finish(ctx.Err())
+			return
+		}
+	}
+	sub.finish(io.EOF)
+}
+
+type scriptedSubscription struct {
+	ch        chan feed.Message
+	done      chan struct{}
+	err       error
+	closeOnce sync.Once
+}
+
+func (s *scriptedSubscription) Messages() <-chan feed.Message { return s.ch }
+func (s *scriptedSubscription) Err() error                    { return s.err }
+
+func (s *scriptedSubscription) Close() error {
+	s.closeOnce.Do(func() { close(s.done) })
+	return nil
+}
+
+func (s *scriptedSubscription) finish(err error) {
+	s.err = err
+	close(s.ch)
+}
+
+// startListener runs a listener on the source until it returns, failing the
+// test if it takes too long
+func startListener(t *testing.T, b bus.Bus, source feed.Source, handler func(bus.Bus, string) error) {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	l := NewListener(ctx, &wg, b, source, "TOPIC", "test", handler)
+	l.minBackoff, l.maxBackoff = 10*time.Millisecond, 25*time.Millisecond
+
+	if err := l.Start(); err != nil {
+		t.Fatalf("Start() error = %v", err)
+	}
+	if ctx.Err() != nil {
+		t.Fatal("listener did not finish")
+	}
+}
+
+func TestListenerReconnectsWithBackoff(t *testing.T) {
+	source := &scriptedSource{
+		failures: []error{errors.New("refused"), errors.New("refused"), errors.New("refused"), errors.New("refused")},
+	}
+	b := bus.NewMemoryBus(0)
+	defer b.Close()
+
+	startListener(t, b, source, func(bus.Bus, string) error { return nil })
+
+	// each wait doubles up to the limit, and it stops once the feed is exhausted
+	want := []time.Duration{10 * time.Millisecond, 20 * time.Millisecond, 25 * time.Millisecond, 25 * time.Millisecond}
+	if len(source.subscribed) != len(want)+1 {
+		t.Fatalf("subscribed %d times, want %d", len(source.subscribed), len(want)+1)
+	}
+	for i, wait := range want {
+		if got := source.subscribed[i+1].Sub(source.subscribed[i]); got < wait {
+			t.Errorf("reconnect %d after %v, want at least %v", i+1, got, wait)
+		}
+	}
+}
+
+func TestListenerAcksOnlyPublishedMessages(t *testing.T) {
+	ctx := context.Background()
+	source := &scriptedSource{bodies: []string{"a", "b", "c", "d"}, breaks: []int{3}}
+	b := bus.NewMemoryBus(0)
+	defer b.Close()
+	if err := b.DeclareQueue(ctx, bus.VSTPFeed, "q", "vstp.#"); err != nil {
+		t.Fatal(err)
+	}
+
+	// publishing b fails the first time, and the connection is lost before d
+	var handled []string
+	failed := false
+	startListener(t, b, source, func(b bus.Bus, body string) error {
+		handled = append(handled, body)
+		if body == "b" && !failed {
+			failed = true
+			return errors.New("publish failed")
+		}
+		return b.Publish(ctx, "vstp.test", []byte(body), nil)
+	})
+
+	if want := []string{"a", "b", "b", "c", "d"}; !slices.Equal(handled, want) {
+		t.Errorf("handled %v, want %v", handled, want)
+	}
+	if want := []string{"a", "b", "c", "d"}; !slices.Equal(source.acked, want) {
+		t.Errorf("acknowledged %v, want %v", source.acked, want)
+	}
+
+	msgs, err := b.Consume(ctx, "q")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"a", "b", "c", "d"} {
+		select {
+		case msg := <-msgs:
+			if string(msg.Body) != want {
+				t.Errorf("published %q, want %q", msg.Body, want)
+			}
+			msg.Ack()
+		case <-time.After(time.Second):
+			t.Fatalf("%q was not published", want)
+		}
+	}
+}
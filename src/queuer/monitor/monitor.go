@@ -0,0 +1,140 @@
+package monitor
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/jack-barr3tt/gbr-engine/src/common/types"
+	"github.com/jack-barr3tt/gbr-engine/src/common/utils"
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	// rateWindow is how many minutes message rates are averaged over
+	rateWindow = 5
+
+	flushInterval = 10 * time.Second
+)
+
+// Monitor tracks how often messages arrive on each feed topic and when each
+// TD area last sent a CT heartbeat, periodically storing what it has seen so
+// silent feeds can be spotted by the API
+type Monitor struct {
+	mu         sync.Mutex
+	topics     map[string]*topicStats
+	heartbeats map[string]time.Time
+}
+
+type topicStats struct {
+	last  time.Time
+	total int64
+
+	// messages received in each of the last few minutes, with the minute each
+	// count belongs to so old counts can be told apart from current ones
+	counts  [rateWindow]int64
+	minutes [rateWindow]int64
+}
+
+func New() *Monitor {
+	return &Monitor{
+		topics:     make(map[string]*topicStats),
+		heartbeats: make(map[string]time.Time),
+	}
+}
+
+// Watch starts tracking a topic, so it is reported even before any messages
+// arrive on it
+func (m *Monitor) Watch(topic string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.statsLocked(topic)
+}
+
+func (m *Monitor) statsLocked(topic string) *topicStats {
+	stats, ok := m.topics[topic]
+	if !ok {
+		stats = &topicStats{}
+		m.topics[topic] = stats
+	}
+	return stats
+}
+
+// Message records a message arriving on a topic
+func (m *Monitor) Message(topic string, at time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	stats := m.statsLocked(topic)
+	stats.last = at
+	stats.total++
+
+	minute := at.Unix() / 60
+	slot := minute % rateWindow
+	if stats.minutes[slot] != minute {
+		stats.minutes[slot] = minute
+		stats.counts[slot] = 0
+	}
+	stats.counts[slot]++
+}
+
+// Heartbeat records a CT heartbeat from a TD area
+func (m *Monitor) Heartbeat(areaID string, at time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.heartbeats[areaID] = at
+}
+
+// Snapshot reports the state of every topic and the last heartbeat from every
+// TD area as of now
+func (m *Monitor) Snapshot(now time.Time) ([]types.FeedTopicStatus, map[string]time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	current := now.Unix() / 60
+	topics := make([]types.FeedTopicStatus, 0, len(m.topics))
+	for topic, stats := range m.topics {
+		var recent int64
+		for i := range stats.counts {
+			if current-stats.minutes[i] < rateWindow {
+				recent += stats.counts[i]
+			}
+		}
+
+		topics = append(topics, types.FeedTopicStatus{
+			Topic:             topic,
+			LastMessage:       stats.last,
+			MessagesPerMinute: float64(recent) / rateWindow,
+			Total:             stats.total,
+		})
+	}
+	sort.Slice(topics, func(i, j int) bool { return topics[i].Topic < topics[j].Topic })
+
+	heartbeats := make(map[string]time.Time, len(m.heartbeats))
+	for areaID, at := range m.heartbeats {
+		heartbeats[areaID] = at
+	}
+
+	return topics, heartbeats
+}
+
+// Run stores a snapshot in Redis every few seconds until the context is
+// cancelled
+func (m *Monitor) Run(ctx context.Context, rdb *redis.Client) {
+	ticker := time.NewTicker(flushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		topics, heartbeats := m.Snapshot(time.Now())
+		if err := utils.StoreFeedHealth(ctx, rdb, topics, heartbeats); err != nil {
+			utils.GetLogger().Warnw("failed to store feed health", "error", err)
+		}
+	}
+}
@@ -0,0 +1,92 @@
+package monitor
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSnapshotRateWindow(t *testing.T) {
+	now := time.Date(2026, 1, 1, 10, 30, 30, 0, time.UTC)
+
+	tests := []struct {
+		name     string
+		messages []time.Duration
+		wantRate float64
+	}{
+		{
+			name:     "no messages",
+			wantRate: 0,
+		},
+		{
+			name:     "current minute",
+			messages: []time.Duration{0, -10 * time.Second, -20 * time.Second},
+			wantRate: 3.0 / rateWindow,
+		},
+		{
+			name:     "spread across the window",
+			messages: []time.Duration{0, -time.Minute, -2 * time.Minute, -3 * time.Minute, -4 * time.Minute},
+			wantRate: 5.0 / rateWindow,
+		},
+		{
+			name:     "older than the window",
+			messages: []time.Duration{-5 * time.Minute, -6 * time.Minute, -time.Hour},
+			wantRate: 0,
+		},
+		{
+			// five minutes ago shares a bucket with now, so its count is
+			// replaced rather than added to
+			name:     "bucket reused after the window",
+			messages: []time.Duration{-5 * time.Minute, -5 * time.Minute, 0},
+			wantRate: 1.0 / rateWindow,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := New()
+			m.Watch("TRAIN_MVT_ALL_TOC")
+			var last time.Time
+			for _, offset := range tt.messages {
+				last = now.Add(offset)
+				m.Message("TRAIN_MVT_ALL_TOC", last)
+			}
+
+			topics, _ := m.Snapshot(now)
+			if len(topics) != 1 {
+				t.Fatalf("Snapshot() reported %d topics, want 1", len(topics))
+			}
+			got := topics[0]
+			if got.MessagesPerMinute != tt.wantRate {
+				t.Errorf("MessagesPerMinute = %v, want %v", got.MessagesPerMinute, tt.wantRate)
+			}
+			if got.Total != int64(len(tt.messages)) {
+				t.Errorf("Total = %d, want %d", got.Total, len(tt.messages))
+			}
+			if !got.LastMessage.Equal(last) {
+				t.Errorf("LastMessage = %v, want %v", got.LastMessage, last)
+			}
+		})
+	}
+}
+
+func TestSnapshotHeartbeats(t *testing.T) {
+	now := time.Date(2026, 1, 1, 10, 30, 0, 0, time.UTC)
+	m := New()
+	m.Heartbeat("SK", now.Add(-time.Minute))
+	m.Heartbeat("SK", now)
+	m.Heartbeat("WY", now.Add(-time.Hour))
+
+	topics, heartbeats := m.Snapshot(now)
+	if len(topics) != 0 {
+		t.Errorf("Snapshot() reported topics %+v, want none", topics)
+	}
+	if len(heartbeats) != 2 || !heartbeats["SK"].Equal(now) || !heartbeats["WY"].Equal(now.Add(-time.Hour)) {
+		t.Errorf("heartbeats = %v, want the latest from SK and WY", heartbeats)
+	}
+
+	// the snapshot is a copy, so later heartbeats don't change it
+	m.Heartbeat("WY", now)
+	if !heartbeats["WY"].Equal(now.Add(-time.Hour)) {
+		t.Error("snapshot changed by a later heartbeat")
+	}
+}
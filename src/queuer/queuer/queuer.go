@@ -0,0 +1,285 @@
+package queuer
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/jack-barr3tt/gbr-engine/src/common/bus"
+	"github.com/jack-barr3tt/gbr-engine/src/common/metrics"
+	"github.com/jack-barr3tt/gbr-engine/src/common/types"
+	"github.com/jack-barr3tt/gbr-engine/src/common/utils"
+	"github.com/jack-barr3tt/gbr-engine/src/queuer/feed"
+	"github.com/jack-barr3tt/gbr-engine/src/queuer/listener"
+	"github.com/jack-barr3tt/gbr-engine/src/queuer/monitor"
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	trustTopic = "TRAIN_MVT_ALL_TOC"
+	tdTopic    = "TD_ALL_SIG_AREA"
+	vstpTopic  = "VSTP_ALL"
+)
+
+// NewFeedSource picks where feed messages come from: "stomp" (the default)
+// for the live Network Rail feed, "replay" to play back recordings from
+// FEED_REPLAY_PATH, or "embedded" to run an in-process STOMP broker on
+// FEED_EMBEDDED_ADDR, optionally playing recordings into it.
+// FEED_REPLAY_SPEED scales replay timing, with 0 replaying as fast as possible.
+func NewFeedSource(ctx context.Context, kind string) (feed.Source, error) {
+	logger := utils.GetLogger()
+
+	var replay *feed.ReplaySource
+	if path := os.Getenv("FEED_REPLAY_PATH"); path != "" {
+		speed := 1.0
+		if s := os.Getenv("FEED_REPLAY_SPEED"); s != "" {
+			parsed, err := strconv.ParseFloat(s, 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid FEED_REPLAY_SPEED %q: %w", s, err)
+			}
+			speed = parsed
+		}
+
+		var err error
+		replay, err = feed.NewReplaySource(path, speed)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	source, err := selectFeedSource(ctx, kind, replay)
+	if err != nil {
+		return nil, err
+	}
+
+	// RECORD_DIR turns on recording of every raw frame, keeping at most
+	// RECORD_MAX_MB of recordings (10GB by default)
+	if dir := os.Getenv("RECORD_DIR"); dir != "" {
+		maxMB := 10240
+		if s := os.Getenv("RECORD_MAX_MB"); s != "" {
+			parsed, err := strconv.Atoi(s)
+			if err != nil {
+				return nil, fmt.Errorf("invalid RECORD_MAX_MB %q: %w", s, err)
+			}
+			maxMB = parsed
+		}
+
+		recorder, err := feed.NewRecorder(dir, int64(maxMB)*1024*1024)
+		if err != nil {
+			return nil, err
+		}
+		go func() {
+			<-ctx.Done()
+			if err := recorder.Close(); err != nil {
+				logger.Warnw("failed to close recorder", "error", err)
+			}
+		}()
+
+		logger.Infow("recording raw feed frames", "dir", dir, "max_mb", maxMB)
+		source = feed.Record(source, recorder)
+	}
+
+	return source, nil
+}
+
+func selectFeedSource(ctx context.Context, kind string, replay *feed.ReplaySource) (feed.Source, error) {
+	logger := utils.GetLogger()
+
+	switch kind {
+	case "", "stomp":
+		return feed.NewStompSource(utils.NewNRStompConnection), nil
+	case "replay":
+		if replay == nil {
+			return nil, fmt.Errorf("FEED_REPLAY_PATH must be set to replay recordings")
+		}
+		logger.Infow("replaying recorded feed", "path", os.Getenv("FEED_REPLAY_PATH"))
+		return replay, nil
+	case "embedded":
+		addr := os.Getenv("FEED_EMBEDDED_ADDR")
+		if addr == "" {
+			addr = "127.0.0.1:61613"
+		}
+
+		embedded, err := feed.NewEmbeddedSource(addr)
+		if err != nil {
+			return nil, err
+		}
+		logger.Infow("running embedded STOMP broker", "addr", embedded.Addr())
+
+		if replay != nil {
+			go func() {
+				if err := embedded.Publish(ctx, replay, trustTopic, tdTopic, vstpTopic); err != nil && ctx.Err() == nil {
+					logger.Warnw("failed to play recordings into embedded broker", "error", err)
+					return
+				}
+				logger.Infow("finished playing recordings into embedded broker")
+			}()
+		}
+		return embedded, nil
+	default:
+		return nil, fmt.Errorf("unknown feed source %q", kind)
+	}
+}
+
+func HandleTrust(b bus.Bus, data string) error {
+	ctx := context.Background()
+
+	messages, err := utils.UnmarshalTrustMessages(data)
+	if err != nil {
+		utils.GetLogger().Warnw("error unmarshalling TRUST message", "error", err)
+		return deadLetterFrame(ctx, b, bus.TrustFeed, trustTopic, data, err)
+	}
+
+	for _, message := range messages {
+		body, _ := json.Marshal(message)
+		err = publish(ctx, b, bus.TrustFeed, bus.TrustRoutingKey(&message), body, bus.TrustHeaders(&message))
+		if err != nil {
+			utils.GetLogger().Warnw("error publishing message to bus", "queue", "trust", "error", err)
+			return err
+		}
+		utils.GetLogger().Debug("Published message to bus for TRUST")
+	}
+
+	return nil
+}
+
+// HandleTD publishes TD messages, recording CT heartbeats with the monitor
+func HandleTD(b bus.Bus, mon *monitor.Monitor, data string) error {
+	ctx := context.Background()
+
+	tdcMessages, tdsMessages, err := utils.UnmarshalTDMessages(data)
+	if err != nil {
+		utils.GetLogger().Warnw("error unmarshalling TD message", "error", err)
+		return deadLetterFrame(ctx, b, bus.TDFeed, tdTopic, data, err)
+	}
+
+	for _, message := range tdcMessages {
+		if message.MsgType == types.MsgTypeCT {
+			mon.Heartbeat(message.AreaID, time.Now())
+		}
+
+		body, _ := json.Marshal(message)
+		err = publish(ctx, b, bus.TDFeed, bus.TDCRoutingKey(&message), body, nil)
+		if err != nil {
+			utils.GetLogger().Warnw("error publishing message to bus", "queue", "tdc", "error", err)
+			return err
+		}
+		utils.GetLogger().Debug("Published message to bus for TD-C")
+	}
+
+	for _, message := range tdsMessages {
+		body, _ := json.Marshal(message)
+		err = publish(ctx, b, bus.TDFeed, bus.TDSRoutingKey(&message), body, nil)
+		if err != nil {
+			utils.GetLogger().Warnw("error publishing message to bus", "queue", "tds", "error", err)
+			return err
+		}
+		utils.GetLogger().Debug("Published message to bus for TD-S")
+	}
+
+	return nil
+}
+
+func HandleVSTP(b bus.Bus, data string) error {
+	ctx := context.Background()
+
+	message, err := utils.UnmarshalVSTP(data)
+	if err != nil {
+		utils.GetLogger().Warnw("error unmarshalling VSTP message", "error", err)
+		return deadLetterFrame(ctx, b, bus.VSTPFeed, vstpTopic, data, err)
+	}
+
+	body, _ := json.Marshal(message)
+	err = publish(ctx, b, bus.VSTPFeed, bus.VSTPRoutingKey(message), body, nil)
+	if err != nil {
+		utils.GetLogger().Warnw("error publishing message to bus", "queue", "vstp", "error", err)
+		return err
+	}
+	utils.GetLogger().Debug("Published message to bus for VSTP")
+
+	return nil
+}
+
+// publish sends a message from a feed to the bus, counting whether it was
+// accepted
+func publish(ctx context.Context, b bus.Bus, feed, key string, body []byte, headers bus.Headers) error {
+	err := b.Publish(ctx, key, body, headers)
+	metrics.PublishedMessages.WithLabelValues(feed, metrics.Outcome(err)).Inc()
+	return err
+}
+
+// deadLetterFrame sends a raw frame that could not be parsed to the feed's
+// dead letter queue, so it is kept for inspection rather than dropped
+func deadLetterFrame(ctx context.Context, b bus.Bus, feed, topic, data string, cause error) error {
+	return b.DeadLetter(ctx, feed, []byte(data), bus.Headers{"x-topic": topic}, cause)
+}
+
+// Run publishes every message from the source's TRUST, TD and VSTP topics to
+// the bus until the context is cancelled, storing the health of each topic in
+// Redis. Subscriptions are made durably under names derived from the client
+// ID.
+func Run(ctx context.Context, b bus.Bus, rdb *redis.Client, source feed.Source, clientID string) error {
+	var wg sync.WaitGroup
+
+	mon := monitor.New()
+	go mon.Run(ctx, rdb)
+
+	// count every frame as it arrives, before it is parsed, so a feed sending
+	// messages we cannot handle still shows as alive
+	track := func(topic string, handle func(bus.Bus, string) error) func(bus.Bus, string) error {
+		mon.Watch(topic)
+		return func(b bus.Bus, data string) error {
+			mon.Message(topic, time.Now())
+			metrics.FeedFrames.WithLabelValues(topic).Inc()
+			return handle(b, data)
+		}
+	}
+	handleTD := func(b bus.Bus, data string) error {
+		return HandleTD(b, mon, data)
+	}
+
+	trustListener := listener.NewListener(ctx, &wg, b, source, trustTopic, clientID+"-trust", track(trustTopic, HandleTrust))
+	for partition := 0; partition < bus.TrustPartitions; partition++ {
+		if err := bus.DeclareTrustPartition(ctx, b, partition); err != nil {
+			return fmt.Errorf("failed to declare TRUST queue %s: %w", bus.TrustPartitionQueue(partition), err)
+		}
+	}
+	// nothing consumes the single TRUST queue since it was partitioned, so it
+	// fills up for as long as it stays bound. Retiring it is left to the
+	// operator, once the old TRUST consumers are gone.
+	if os.Getenv("RETIRE_LEGACY_TRUST_QUEUE") == "true" {
+		if err := b.RetireQueue(ctx, bus.LegacyTrustQueue, bus.TrustFeed+".#"); err != nil {
+			return fmt.Errorf("failed to retire TRUST queue: %w", err)
+		}
+	}
+
+	tdListener := listener.NewListener(ctx, &wg, b, source, tdTopic, clientID+"-td", track(tdTopic, handleTD))
+	if err := tdListener.DeclareQueue(bus.TDFeed, "tdc", "td.c.#"); err != nil {
+		return fmt.Errorf("failed to declare TD-C queue: %w", err)
+	}
+	if err := tdListener.DeclareQueue(bus.TDFeed, "tds", "td.s.#"); err != nil {
+		return fmt.Errorf("failed to declare TD-S queue: %w", err)
+	}
+
+	vstpListener := listener.NewListener(ctx, &wg, b, source, vstpTopic, clientID+"-vstp", track(vstpTopic, HandleVSTP))
+	if err := vstpListener.DeclareQueue(bus.VSTPFeed, "vstp", "vstp.#"); err != nil {
+		return fmt.Errorf("failed to declare VSTP queue: %w", err)
+	}
+
+	wg.Add(1)
+	go trustListener.Start()
+
+	wg.Add(1)
+	go tdListener.Start()
+
+	wg.Add(1)
+	go vstpListener.Start()
+
+	<-ctx.Done()
+	wg.Wait()
+	return nil
+}
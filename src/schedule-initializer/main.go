@@ -10,6 +10,7 @@ import (
 	"os"
 	"time"
 
+	"github.com/jack-barr3tt/gbr-engine/src/common/metrics"
 	"github.com/jack-barr3tt/gbr-engine/src/common/types"
 	"github.com/jack-barr3tt/gbr-engine/src/common/utils"
 )
@@ -67,6 +68,10 @@ func main() {
 	}
 	defer pg.Close()
 
+	// loading the full timetable takes a while, so progress can be scraped
+	// while it runs as well as pushed once it is done
+	go metrics.ServeFromEnv(context.Background(), l)
+
 	url := "https://publicdatafeeds.networkrail.co.uk/ntrod/CifFileAuthenticate?type=CIF_ALL_FULL_DAILY&day=toc-full"
 
 	username := os.Getenv("NR_FEEDS_USERNAME")
@@ -147,6 +152,7 @@ func main() {
 			} else {
 				tiplocCount++
 			}
+			metrics.TimetableRecords.WithLabelValues("tiploc", metrics.Outcome(err)).Inc()
 
 		case entry.JsonAssociationV1 != nil:
 			assoc := entry.JsonAssociationV1
@@ -200,6 +206,7 @@ func main() {
 			} else {
 				associationCount++
 			}
+			metrics.TimetableRecords.WithLabelValues("association", metrics.Outcome(err)).Inc()
 
 		case entry.JsonScheduleV1 != nil:
 			tx, err := pg.Begin(context.Background())
@@ -278,6 +285,7 @@ func main() {
 
 			if err != nil {
 				l.Warnw("Error inserting schedule", "train_uid", schedule.TrainUID, "error", err)
+				metrics.TimetableRecords.WithLabelValues("schedule", metrics.OutcomeFailed).Inc()
 				tx.Rollback(context.Background())
 				continue
 			}
@@ -371,11 +379,13 @@ func main() {
 				}
 			}
 
-			if err := tx.Commit(context.Background()); err != nil {
+			err = tx.Commit(context.Background())
+			if err != nil {
 				l.Warnw("Error committing schedule transaction", "train_uid", schedule.TrainUID, "error", err)
 			} else {
 				scheduleCount++
 			}
+			metrics.TimetableRecords.WithLabelValues("schedule", metrics.Outcome(err)).Inc()
 
 		case entry.EOF != nil && entry.EOF.EOF:
 			l.Info("End of schedule data reached.")
@@ -394,4 +404,8 @@ endProcessing:
 	l.Info("Schedule initialization completed successfully!")
 	l.Infof("Final counts - TIPLOCs: %d, Associations: %d, Schedules: %d",
 		tiplocCount, associationCount, scheduleCount)
+
+	if err := metrics.PushFromEnv("schedule-initializer"); err != nil {
+		l.Warnw("Failed to push metrics", "error", err)
+	}
 }
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"context"
+
+	"github.com/jack-barr3tt/gbr-engine/src/common/bus"
+	"github.com/jack-barr3tt/gbr-engine/src/common/health"
+	"github.com/jack-barr3tt/gbr-engine/src/common/metrics"
+	"github.com/jack-barr3tt/gbr-engine/src/common/utils"
+	"github.com/jack-barr3tt/gbr-engine/src/td-consumer/td"
+)
+
+func main() {
+	utils.InitLogger()
+	defer utils.SyncLogger()
+	logger := utils.GetLogger()
+	ctx := context.Background()
+
+	db, err := utils.NewPostgresConnection()
+	if err != nil {
+		logger.Fatalw("failed to connect to Postgres", "error", err)
+	}
+	defer db.Close()
+
+	rdb := utils.NewRedisClient()
+	defer rdb.Close()
+
+	b, err := bus.New()
+	if err != nil {
+		logger.Fatalw("failed to connect to message bus", "error", err)
+	}
+	defer b.Close()
+
+	go health.ServeFromEnv(ctx, health.NewChecker(health.Postgres(db), health.Redis(rdb), health.Bus(b)))
+	go metrics.ServeFromEnv(ctx, logger)
+
+	if err := td.Run(ctx, db, rdb, b); err != nil {
+		logger.Fatalw("failed to run TD consumer", "error", err)
+	}
+}
@@ -0,0 +1,113 @@
+package td
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/jack-barr3tt/gbr-engine/src/common/bus"
+	"github.com/jack-barr3tt/gbr-engine/src/common/types"
+	"github.com/jack-barr3tt/gbr-engine/src/common/utils"
+	"github.com/redis/go-redis/v9"
+	"go.uber.org/zap"
+)
+
+// signallingHistoryLimit caps how many changes are kept per TD area
+const signallingHistoryLimit = 5000
+
+func consumeSignalling(ctx context.Context, conns *Connections, msgs <-chan bus.Delivery) {
+	rdb, logger := conns.Redis, conns.Logger
+
+	for msg := range msgs {
+		var td types.TDSMsgBody
+		if err := json.Unmarshal(msg.Body, &td); err != nil {
+			logger.Warnw("bad json in TD-S message", "error", err)
+			msg.Reject(ctx, err)
+			continue
+		}
+
+		switch td.MsgType {
+		case types.MsgTypeSF, types.MsgTypeSG, types.MsgTypeSH:
+			if err := processSignalling(ctx, rdb, logger, &td); err != nil {
+				logger.Warnw("error processing signalling update", "area_id", td.AreaID, "msg_type", td.MsgType, "error", err)
+				msg.Reject(ctx, err)
+				continue
+			}
+		}
+
+		msg.Ack()
+	}
+}
+
+// processSignalling writes the bytes carried by an SF, SG or SH message into
+// the area's signalling state, starting at the message address. SF updates a
+// single byte while SG and SH refresh four consecutive bytes.
+func processSignalling(ctx context.Context, rdb *redis.Client, logger *zap.SugaredLogger, td *types.TDSMsgBody) error {
+	address, err := strconv.ParseUint(strings.TrimSpace(td.Address), 16, 8)
+	if err != nil {
+		return fmt.Errorf("invalid address %q: %w", td.Address, err)
+	}
+
+	data, err := hex.DecodeString(strings.TrimSpace(td.Data))
+	if err != nil {
+		return fmt.Errorf("invalid data %q: %w", td.Data, err)
+	}
+	if len(data) == 0 {
+		return nil
+	}
+
+	stateKey := utils.BuildSignallingKey(td.AreaID)
+	current, err := rdb.GetRange(ctx, stateKey, int64(address), int64(address)+int64(len(data))-1).Result()
+	if err != nil && err != redis.Nil {
+		return fmt.Errorf("failed to read signalling state: %w", err)
+	}
+
+	var changes [][]byte
+	for i, b := range data {
+		var old byte
+		if i < len(current) {
+			old = current[i]
+		}
+		if old == b {
+			continue
+		}
+
+		change, err := json.Marshal(types.SignallingChange{
+			Time:    td.Time,
+			MsgType: td.MsgType,
+			Address: fmt.Sprintf("%02X", int(address)+i),
+			Old:     fmt.Sprintf("%02X", old),
+			New:     fmt.Sprintf("%02X", b),
+		})
+		if err != nil {
+			return err
+		}
+		changes = append(changes, change)
+	}
+
+	historyKey := utils.BuildSignallingHistoryKey(td.AreaID)
+	_, err = rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.SetRange(ctx, stateKey, int64(address), string(data))
+		for _, change := range changes {
+			pipe.LPush(ctx, historyKey, change)
+		}
+		if len(changes) > 0 {
+			pipe.LTrim(ctx, historyKey, 0, signallingHistoryLimit-1)
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to write signalling state: %w", err)
+	}
+
+	logger.Debugw("updated signalling state",
+		"area_id", td.AreaID,
+		"msg_type", td.MsgType,
+		"address", td.Address,
+		"changes", len(changes),
+	)
+	return nil
+}
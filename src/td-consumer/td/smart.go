@@ -0,0 +1,215 @@
+package td
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jack-barr3tt/gbr-engine/src/common/data"
+	"github.com/jack-barr3tt/gbr-engine/src/common/types"
+	"github.com/jack-barr3tt/gbr-engine/src/common/utils"
+)
+
+// smartIndex holds the SMART berth steps in memory, keyed by the TD message
+// that triggers them and its area and berths, so every berth message can be
+// correlated without a database round trip
+type smartIndex struct {
+	mu    sync.RWMutex
+	steps map[string][]types.SMARTStep
+}
+
+func smartKey(msgType types.TDCMsgType, areaID, from, to string) string {
+	return fmt.Sprintf("%s:%s:%s:%s", msgType, areaID, from, to)
+}
+
+func (si *smartIndex) Refresh(dc *data.DataClient) error {
+	steps, err := dc.GetSMARTSteps()
+	if err != nil {
+		return err
+	}
+
+	index := indexSMARTSteps(steps)
+
+	si.mu.Lock()
+	si.steps = index
+	si.mu.Unlock()
+
+	return nil
+}
+
+// indexSMARTSteps keys each step by the TD message and berths that must match
+// for it to apply. Interposes are triggered by CC messages and clearouts by CB
+// messages, while every other step type is triggered by a CA step. Steps
+// missing a berth they need are skipped, as they would otherwise be keyed as
+// if they matched any berth.
+func indexSMARTSteps(steps []types.SMARTStep) map[string][]types.SMARTStep {
+	index := make(map[string][]types.SMARTStep)
+	for _, step := range steps {
+		from := strings.TrimSpace(step.FromBerth)
+		to := strings.TrimSpace(step.ToBerth)
+
+		var key string
+		switch step.StepType {
+		case "F":
+			// from the berth to anywhere
+			if from == "" {
+				continue
+			}
+			key = smartKey(types.MsgTypeCA, step.TDArea, from, "")
+		case "T":
+			// into the berth from anywhere
+			if to == "" {
+				continue
+			}
+			key = smartKey(types.MsgTypeCA, step.TDArea, "", to)
+		case "C":
+			// the description is cleared out of the berth
+			if from == "" {
+				continue
+			}
+			key = smartKey(types.MsgTypeCB, step.TDArea, from, "")
+		case "I":
+			// a description is interposed into the berth
+			if to == "" {
+				continue
+			}
+			key = smartKey(types.MsgTypeCC, step.TDArea, "", to)
+		default:
+			if from == "" || to == "" {
+				continue
+			}
+			key = smartKey(types.MsgTypeCA, step.TDArea, from, to)
+		}
+		index[key] = append(index[key], step)
+	}
+	return index
+}
+
+// Lookup finds the steps matching a TD message between two berths, either of
+// which may be blank, such as when a description is interposed or cancelled
+func (si *smartIndex) Lookup(msgType types.TDCMsgType, areaID, from, to string) []types.SMARTStep {
+	si.mu.RLock()
+	defer si.mu.RUnlock()
+
+	var matches []types.SMARTStep
+	if from != "" && to != "" {
+		matches = append(matches, si.steps[smartKey(msgType, areaID, from, to)]...)
+	}
+	if from != "" {
+		matches = append(matches, si.steps[smartKey(msgType, areaID, from, "")]...)
+	}
+	if to != "" {
+		matches = append(matches, si.steps[smartKey(msgType, areaID, "", to)]...)
+	}
+	return matches
+}
+
+func smartEventType(event string) string {
+	switch event {
+	case "A", "C":
+		return "ARRIVAL"
+	case "B", "D":
+		return "DEPARTURE"
+	default:
+		return ""
+	}
+}
+
+// correlateStep turns a berth step, interpose or cancel into synthetic
+// movements at the STANOX the SMART data associates with it, and merges them
+// into the journey of whichever activated train is carrying the headcode
+func correlateStep(ctx context.Context, conns *Connections, smart *smartIndex, td *types.TDCMsgBody) error {
+	headcode := strings.TrimSpace(td.Descr)
+	if headcode == "" {
+		return nil
+	}
+
+	steps := smart.Lookup(td.MsgType, td.AreaID, strings.TrimSpace(td.From), strings.TrimSpace(td.To))
+	if len(steps) == 0 {
+		return nil
+	}
+
+	stepMs, err := strconv.ParseInt(strings.TrimSpace(td.Time), 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid step time %q: %w", td.Time, err)
+	}
+	stepTime := time.UnixMilli(stepMs)
+
+	trainIDs, err := conns.Redis.SMembers(ctx, utils.BuildHeadcodeKey(headcode)).Result()
+	if err != nil {
+		return fmt.Errorf("failed to look up headcode: %w", err)
+	}
+	if len(trainIDs) == 0 {
+		return nil
+	}
+
+	for _, step := range steps {
+		eventType := smartEventType(step.Event)
+		if eventType == "" {
+			continue
+		}
+
+		eventTime := stepTime.Add(time.Duration(step.BerthOffset) * time.Second)
+		event := types.TrustBody{
+			ActualTimestamp: strconv.FormatInt(eventTime.UnixMilli(), 10),
+			LocStanox:       step.Stanox,
+			EventType:       eventType,
+			EventSource:     types.FeedTD,
+			Platform:        step.Platform,
+		}
+
+		if err := mergeSyntheticEvent(ctx, conns, trainIDs, &event, td.Time); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func mergeSyntheticEvent(ctx context.Context, conns *Connections, trainIDs []string, event *types.TrustBody, sourceTime string) error {
+	for _, trainID := range trainIDs {
+		activation, err := utils.LoadActivation(ctx, conns.Redis, trainID)
+		if err != nil {
+			continue
+		}
+
+		var outcome utils.MergeOutcome
+		var i int
+		journey, err := utils.UpdateTrainJourney(ctx, conns.DB, conns.Redis, activation.TrainUID, activation.RunDate, func(journey *types.TrainJourney) bool {
+			outcome, i = utils.MergeTrustEvent(journey, event, sourceTime)
+			return outcome == utils.MergeApplied
+		})
+		if errors.Is(err, utils.ErrJourneyNotFound) {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("failed to save merged schedule: %w", err)
+		}
+
+		// archive a duplicate again in case it is a retry of a step that was
+		// merged but failed to archive
+		if outcome == utils.MergeDuplicate {
+			if err := utils.ArchiveMovement(ctx, conns.DB, utils.StopMovement(&journey, i, event.EventType, trainID)); err != nil {
+				return err
+			}
+		}
+		// the step may belong to another train with the same headcode
+		if outcome != utils.MergeApplied {
+			continue
+		}
+
+		conns.Logger.Debugw("merged TD step into schedule",
+			"train_uid", activation.TrainUID,
+			"train_id", trainID,
+			"event_type", event.EventType,
+			"stanox", event.LocStanox,
+		)
+		return utils.ArchiveMovement(ctx, conns.DB, utils.StopMovement(&journey, i, event.EventType, trainID))
+	}
+
+	return nil
+}
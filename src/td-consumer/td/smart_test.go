@@ -0,0 +1,104 @@
+package td
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/jack-barr3tt/gbr-engine/src/common/testdb"
+	"github.com/jack-barr3tt/gbr-engine/src/common/types"
+	"github.com/jack-barr3tt/gbr-engine/src/common/utils"
+	"github.com/redis/go-redis/v9"
+	"go.uber.org/zap"
+)
+
+func TestSMARTIndexLookup(t *testing.T) {
+	steps := []types.SMARTStep{
+		{TDArea: "SK", FromBerth: "0101", ToBerth: "0103", StepType: "B", Stanox: "between"},
+		{TDArea: "SK", FromBerth: "0103", StepType: "F", Stanox: "from"},
+		{TDArea: "SK", ToBerth: "0105", StepType: "T", Stanox: "to"},
+		{TDArea: "SK", ToBerth: "0107", StepType: "I", Stanox: "interpose"},
+		{TDArea: "SK", FromBerth: "0109", StepType: "C", Stanox: "clear"},
+		// missing the berths they need, so they must not match any step
+		{TDArea: "SK", StepType: "B", Stanox: "blank between"},
+		{TDArea: "SK", ToBerth: "0103", StepType: "F", Stanox: "blank from"},
+		{TDArea: "SK", FromBerth: "0101", StepType: "T", Stanox: "blank to"},
+		{TDArea: "SK", FromBerth: " ", ToBerth: "0105", StepType: "B", Stanox: "space between"},
+	}
+	index := &smartIndex{steps: indexSMARTSteps(steps)}
+
+	tests := []struct {
+		name     string
+		msgType  types.TDCMsgType
+		from, to string
+		want     []string
+	}{
+		{name: "between berths", msgType: types.MsgTypeCA, from: "0101", to: "0103", want: []string{"between"}},
+		{name: "from a berth", msgType: types.MsgTypeCA, from: "0103", to: "0105", want: []string{"from", "to"}},
+		{name: "stepped into an interpose berth", msgType: types.MsgTypeCA, from: "0105", to: "0107", want: nil},
+		{name: "stepped out of a clearout berth", msgType: types.MsgTypeCA, from: "0109", to: "0111", want: nil},
+		{name: "interposed", msgType: types.MsgTypeCC, to: "0107", want: []string{"interpose"}},
+		{name: "interposed into a to berth", msgType: types.MsgTypeCC, to: "0105", want: nil},
+		{name: "cancelled", msgType: types.MsgTypeCB, from: "0109", want: []string{"clear"}},
+		{name: "cancelled from a from berth", msgType: types.MsgTypeCB, from: "0103", want: nil},
+		{name: "no berths", msgType: types.MsgTypeCA, want: nil},
+		{name: "unknown berths", msgType: types.MsgTypeCA, from: "0201", to: "0203", want: nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []string
+			for _, step := range index.Lookup(tt.msgType, "SK", tt.from, tt.to) {
+				got = append(got, step.Stanox)
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("Lookup(%s, %q, %q) = %v, want %v", tt.msgType, tt.from, tt.to, got, tt.want)
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Fatalf("Lookup(%s, %q, %q) = %v, want %v", tt.msgType, tt.from, tt.to, got, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestMergeSyntheticEventTriesEveryTrain(t *testing.T) {
+	ctx := context.Background()
+	db := testdb.New(t)
+	server := miniredis.RunT(t)
+	rdb := redis.NewClient(&redis.Options{Addr: server.Addr()})
+	defer rdb.Close()
+	conns := &Connections{DB: db, Redis: rdb, Logger: zap.NewNop().Sugar()}
+
+	// two trains share the headcode, and TRUST has already reported the
+	// first arriving where the step is
+	journeys := []types.TrainJourney{
+		{UID: "C11111", RunDate: "20260101", Stops: []types.Stop{
+			{Stanox: "12345", PlannedArr: "10:00", ActualArr: "1767261600000", ArrSource: types.FeedTRUST},
+		}},
+		{UID: "C22222", RunDate: "20260101", Stops: []types.Stop{
+			{Stanox: "12345", PlannedArr: "10:05"},
+		}},
+	}
+	for i, trainID := range []string{"451A23MB01", "451A23MC01"} {
+		if err := utils.ReplaceTrainJourney(ctx, rdb, &journeys[i], time.Hour); err != nil {
+			t.Fatalf("ReplaceTrainJourney() error = %v", err)
+		}
+		server.Set(utils.BuildActivationKey(trainID), `{"train_uid":"`+journeys[i].UID+`","run_date":"20260101"}`)
+	}
+
+	event := &types.TrustBody{ActualTimestamp: "1767261960000", LocStanox: "12345", EventType: "ARRIVAL", EventSource: types.FeedTD}
+	if err := mergeSyntheticEvent(ctx, conns, []string{"451A23MB01", "451A23MC01"}, event, "100"); err != nil {
+		t.Fatalf("mergeSyntheticEvent() error = %v", err)
+	}
+
+	journey, err := utils.LoadTrainJourney(ctx, db, rdb, "C22222", "20260101")
+	if err != nil {
+		t.Fatalf("LoadTrainJourney() error = %v", err)
+	}
+	if stop := journey.Stops[0]; stop.ActualArr != event.ActualTimestamp || stop.ArrSource != types.FeedTD {
+		t.Errorf("second train's arrival = %+v, want the TD step", stop)
+	}
+}
@@ -0,0 +1,287 @@
+package td
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jack-barr3tt/gbr-engine/src/common/bus"
+	"github.com/jack-barr3tt/gbr-engine/src/common/data"
+	"github.com/jack-barr3tt/gbr-engine/src/common/types"
+	"github.com/jack-barr3tt/gbr-engine/src/common/utils"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/redis/go-redis/v9"
+	"go.uber.org/zap"
+)
+
+type Connections struct {
+	DB     *pgxpool.Pool
+	Redis  *redis.Client
+	Logger *zap.SugaredLogger
+	Data   *data.DataClient
+}
+
+// Run tracks berth occupancy and signalling state from TD messages on the bus,
+// correlating berth steps with activated trains, until the context is
+// cancelled or the bus stops delivering
+func Run(ctx context.Context, db *pgxpool.Pool, rdb *redis.Client, b bus.Bus) error {
+	logger := utils.GetLogger()
+
+	conns := &Connections{
+		DB:     db,
+		Redis:  rdb,
+		Logger: logger,
+		Data:   data.NewDataClient(db, rdb, logger),
+	}
+
+	smart := &smartIndex{}
+	if err := smart.Refresh(conns.Data); err != nil {
+		logger.Warnw("failed to load SMART data, berth steps will not be correlated", "error", err)
+	}
+	go func() {
+		ticker := time.NewTicker(1 * time.Hour)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if err := smart.Refresh(conns.Data); err != nil {
+					logger.Warnw("failed to refresh SMART data", "error", err)
+				}
+			}
+		}
+	}()
+
+	if err := b.DeclareQueue(ctx, bus.TDFeed, "tdc", "td.c.#"); err != nil {
+		return fmt.Errorf("failed to declare TD-C queue: %w", err)
+	}
+
+	if err := b.DeclareQueue(ctx, bus.TDFeed, "tds", "td.s.#"); err != nil {
+		return fmt.Errorf("failed to declare TD-S queue: %w", err)
+	}
+
+	berthMsgs, err := b.Consume(ctx, "tdc")
+	if err != nil {
+		return fmt.Errorf("failed to consume TD-C queue: %w", err)
+	}
+
+	signallingMsgs, err := b.Consume(ctx, "tds")
+	if err != nil {
+		return fmt.Errorf("failed to consume TD-S queue: %w", err)
+	}
+	logger.Infow("tracking berth occupancy and signalling state via TD feed")
+
+	var wg sync.WaitGroup
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		consumeBerths(ctx, conns, smart, berthMsgs)
+	}()
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		consumeSignalling(ctx, conns, signallingMsgs)
+	}()
+
+	wg.Wait()
+	return nil
+}
+
+func consumeBerths(ctx context.Context, conns *Connections, smart *smartIndex, msgs <-chan bus.Delivery) {
+	logger := conns.Logger
+
+	for msg := range msgs {
+		var td types.TDCMsgBody
+		if err := json.Unmarshal(msg.Body, &td); err != nil {
+			logger.Warnw("bad json in TD-C message", "error", err)
+			msg.Reject(ctx, err)
+			continue
+		}
+
+		if err := processBerthMessage(ctx, conns, smart, &td); err != nil {
+			logger.Warnw("error processing TD-C message", "area_id", td.AreaID, "msg_type", td.MsgType, "error", err)
+			msg.Reject(ctx, err)
+			continue
+		}
+
+		msg.Ack()
+	}
+}
+
+func processBerthMessage(ctx context.Context, conns *Connections, smart *smartIndex, td *types.TDCMsgBody) error {
+	rdb, logger := conns.Redis, conns.Logger
+
+	var err error
+	switch td.MsgType {
+	case types.MsgTypeCA:
+		err = processStep(ctx, rdb, logger, td)
+	case types.MsgTypeCB:
+		err = processCancel(ctx, rdb, logger, td)
+	case types.MsgTypeCC:
+		err = processInterpose(ctx, rdb, logger, td)
+	default:
+		// CT heartbeats are recorded by the queuer for feed health
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := correlateStep(ctx, conns, smart, td); err != nil {
+		// the berth itself was updated, but dead letter the message so the
+		// merge into the journey can be retried once it has been requeued
+		return fmt.Errorf("failed to correlate berth %s: %w", td.MsgType, err)
+	}
+	return nil
+}
+
+// processStep moves a headcode from one berth to another. Either side of the
+// step may be blank when a train enters or leaves the area.
+func processStep(ctx context.Context, rdb *redis.Client, logger *zap.SugaredLogger, td *types.TDCMsgBody) error {
+	headcode := strings.TrimSpace(td.Descr)
+	from := strings.TrimSpace(td.From)
+	to := strings.TrimSpace(td.To)
+
+	var displaced string
+	if to != "" {
+		var err error
+		if displaced, err = displacedTrainBerth(ctx, rdb, td.AreaID, to, headcode); err != nil {
+			return err
+		}
+	}
+
+	_, err := rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		if from != "" {
+			pipe.HDel(ctx, utils.BuildBerthKey(td.AreaID), from)
+		}
+		if displaced != "" {
+			pipe.Del(ctx, displaced)
+		}
+		if to != "" {
+			return setBerth(ctx, pipe, td.AreaID, to, headcode, td.Time)
+		}
+		if headcode != "" {
+			// the train has stepped out of the area
+			pipe.Del(ctx, utils.BuildTrainBerthKey(td.AreaID, headcode))
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to step berth: %w", err)
+	}
+
+	logger.Debugw("stepped berth", "area_id", td.AreaID, "from", from, "to", to, "headcode", headcode)
+	return nil
+}
+
+// processCancel clears a berth without moving its description anywhere, so
+// the headcode is no longer in the area.
+func processCancel(ctx context.Context, rdb *redis.Client, logger *zap.SugaredLogger, td *types.TDCMsgBody) error {
+	headcode := strings.TrimSpace(td.Descr)
+	from := strings.TrimSpace(td.From)
+	if from == "" {
+		return nil
+	}
+
+	_, err := rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.HDel(ctx, utils.BuildBerthKey(td.AreaID), from)
+		if headcode != "" {
+			pipe.Del(ctx, utils.BuildTrainBerthKey(td.AreaID, headcode))
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to cancel berth: %w", err)
+	}
+
+	logger.Debugw("cancelled berth", "area_id", td.AreaID, "berth", from, "headcode", td.Descr)
+	return nil
+}
+
+// processInterpose places a description into a berth, replacing whatever was
+// there before, so the headcode it replaces is no longer in the area.
+func processInterpose(ctx context.Context, rdb *redis.Client, logger *zap.SugaredLogger, td *types.TDCMsgBody) error {
+	headcode := strings.TrimSpace(td.Descr)
+	to := strings.TrimSpace(td.To)
+	if to == "" {
+		return nil
+	}
+
+	displaced, err := displacedTrainBerth(ctx, rdb, td.AreaID, to, headcode)
+	if err != nil {
+		return err
+	}
+
+	_, err = rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		if displaced != "" {
+			pipe.Del(ctx, displaced)
+		}
+		return setBerth(ctx, pipe, td.AreaID, to, headcode, td.Time)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to interpose berth: %w", err)
+	}
+
+	logger.Debugw("interposed berth", "area_id", td.AreaID, "berth", to, "headcode", headcode)
+	return nil
+}
+
+// displacedTrainBerth returns the train berth key of the headcode a berth
+// holds, if it is not the headcode about to replace it and its train berth
+// still points at the berth, so it can be cleared along with the berth.
+// Otherwise it returns "".
+func displacedTrainBerth(ctx context.Context, rdb *redis.Client, areaID, berth, headcode string) (string, error) {
+	raw, err := rdb.HGet(ctx, utils.BuildBerthKey(areaID), berth).Result()
+	if err == redis.Nil {
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to read berth: %w", err)
+	}
+
+	var occupancy types.BerthOccupancy
+	if err := json.Unmarshal([]byte(raw), &occupancy); err != nil || occupancy.Headcode == "" || occupancy.Headcode == headcode {
+		return "", nil
+	}
+
+	key := utils.BuildTrainBerthKey(areaID, occupancy.Headcode)
+	raw, err = rdb.Get(ctx, key).Result()
+	if err == redis.Nil {
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to read train berth: %w", err)
+	}
+
+	var position types.TrainBerth
+	if err := json.Unmarshal([]byte(raw), &position); err != nil || position.Berth != berth {
+		return "", nil
+	}
+	return key, nil
+}
+
+func setBerth(ctx context.Context, pipe redis.Pipeliner, areaID, berth, headcode, updated string) error {
+	occupancy, err := json.Marshal(types.BerthOccupancy{Headcode: headcode, Updated: updated})
+	if err != nil {
+		return err
+	}
+	pipe.HSet(ctx, utils.BuildBerthKey(areaID), berth, occupancy)
+
+	if headcode == "" {
+		return nil
+	}
+
+	position, err := json.Marshal(types.TrainBerth{AreaID: areaID, Berth: berth, Updated: updated})
+	if err != nil {
+		return err
+	}
+	pipe.Set(ctx, utils.BuildTrainBerthKey(areaID, headcode), position, 24*time.Hour)
+
+	return nil
+}
@@ -0,0 +1,65 @@
+package td
+
+import (
+	"context"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/jack-barr3tt/gbr-engine/src/common/types"
+	"github.com/jack-barr3tt/gbr-engine/src/common/utils"
+	"github.com/redis/go-redis/v9"
+	"go.uber.org/zap"
+)
+
+func TestReplacingBerthClearsDisplacedTrain(t *testing.T) {
+	tests := []struct {
+		name    string
+		replace types.TDCMsgBody
+	}{
+		{
+			name:    "interposed",
+			replace: types.TDCMsgBody{MsgType: types.MsgTypeCC, AreaID: "SK", To: "0127", Descr: "2C45", Time: "2"},
+		},
+		{
+			name:    "stepped in",
+			replace: types.TDCMsgBody{MsgType: types.MsgTypeCA, AreaID: "SK", From: "0125", To: "0127", Descr: "2C45", Time: "2"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			server := miniredis.RunT(t)
+			rdb := redis.NewClient(&redis.Options{Addr: server.Addr()})
+			defer rdb.Close()
+			conns := &Connections{Redis: rdb, Logger: zap.NewNop().Sugar()}
+			smart := &smartIndex{}
+
+			// 1B73 holds 0127, and 1A23 was last seen there before stepping on
+			for _, td := range []types.TDCMsgBody{
+				{MsgType: types.MsgTypeCC, AreaID: "SK", To: "0127", Descr: "1A23", Time: "0"},
+				{MsgType: types.MsgTypeCA, AreaID: "SK", From: "0127", To: "0129", Descr: "1A23", Time: "0"},
+				{MsgType: types.MsgTypeCC, AreaID: "SK", To: "0127", Descr: "1B73", Time: "1"},
+				{MsgType: types.MsgTypeCC, AreaID: "SK", To: "0125", Descr: "2C45", Time: "1"},
+			} {
+				if err := processBerthMessage(ctx, conns, smart, &td); err != nil {
+					t.Fatalf("failed to set up berths: %v", err)
+				}
+			}
+
+			if err := processBerthMessage(ctx, conns, smart, &tt.replace); err != nil {
+				t.Fatalf("error = %v", err)
+			}
+
+			if server.Exists(utils.BuildTrainBerthKey("SK", "1B73")) {
+				t.Error("displaced headcode still points at the berth it was replaced in")
+			}
+			if !server.Exists(utils.BuildTrainBerthKey("SK", "2C45")) {
+				t.Error("replacing headcode has no train berth")
+			}
+			if !server.Exists(utils.BuildTrainBerthKey("SK", "1A23")) {
+				t.Error("headcode that had already left the berth lost its train berth")
+			}
+		})
+	}
+}
@@ -0,0 +1,179 @@
+package trust
+
+import (
+	"context"
+	"fmt"
+	"hash/maphash"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/jack-barr3tt/gbr-engine/src/common/bus"
+	"github.com/jack-barr3tt/gbr-engine/src/common/metrics"
+	"github.com/jack-barr3tt/gbr-engine/src/common/types"
+	"go.uber.org/zap"
+)
+
+const (
+	defaultWorkers     = 8
+	defaultPrefetch    = 64
+	defaultMaxAttempts = 5
+
+	retryBackoff    = 250 * time.Millisecond
+	maxRetryBackoff = 5 * time.Second
+)
+
+// poolConfig sizes the worker pool, taken from TRUST_WORKERS, TRUST_PREFETCH
+// (per partition) and TRUST_MAX_ATTEMPTS
+type poolConfig struct {
+	workers     int
+	prefetch    int
+	maxAttempts int
+}
+
+func loadPoolConfig() (poolConfig, error) {
+	var config poolConfig
+	var err error
+	if config.workers, err = positiveEnv("TRUST_WORKERS", defaultWorkers); err != nil {
+		return poolConfig{}, err
+	}
+	if config.prefetch, err = positiveEnv("TRUST_PREFETCH", defaultPrefetch); err != nil {
+		return poolConfig{}, err
+	}
+	if config.maxAttempts, err = positiveEnv("TRUST_MAX_ATTEMPTS", defaultMaxAttempts); err != nil {
+		return poolConfig{}, err
+	}
+	return config, nil
+}
+
+func positiveEnv(name string, fallback int) (int, error) {
+	value := os.Getenv(name)
+	if value == "" {
+		return fallback, nil
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 1 {
+		return 0, fmt.Errorf("invalid %s %q", name, value)
+	}
+	return n, nil
+}
+
+// job is a TRUST message waiting for a worker, along with the delivery to
+// settle once it has been handled
+type job struct {
+	queue    string
+	delivery bus.Delivery
+	msg      types.TrustMessage
+}
+
+// workerPool handles TRUST messages on a fixed number of workers. Every
+// message about a train goes to the same worker, so a train's messages are
+// handled in the order they were delivered while other trains are handled
+// alongside them. A worker retrying a message holds up the trains behind it
+// rather than letting them overtake it.
+type workerPool struct {
+	process     func(ctx context.Context, msg *types.TrustMessage) error
+	logger      *zap.SugaredLogger
+	maxAttempts int
+
+	seed    maphash.Seed
+	workers []chan job
+	wg      sync.WaitGroup
+}
+
+// newWorkerPool starts the workers, which handle each message submitted to
+// them with process
+func newWorkerPool(ctx context.Context, logger *zap.SugaredLogger, config poolConfig, process func(ctx context.Context, msg *types.TrustMessage) error) *workerPool {
+	p := &workerPool{
+		process:     process,
+		logger:      logger,
+		maxAttempts: config.maxAttempts,
+		seed:        maphash.MakeSeed(),
+		workers:     make([]chan job, config.workers),
+	}
+
+	for i := range p.workers {
+		jobs := make(chan job)
+		p.workers[i] = jobs
+
+		p.wg.Add(1)
+		go func() {
+			defer p.wg.Done()
+			for j := range jobs {
+				p.handle(ctx, j)
+			}
+		}()
+	}
+	return p
+}
+
+// submit queues a message on the worker for its train, waiting until that
+// worker is free
+func (p *workerPool) submit(ctx context.Context, j job) {
+	key := bus.TrustOrderingKey(&j.msg)
+	worker := p.workers[maphash.String(p.seed, key)%uint64(len(p.workers))]
+
+	select {
+	case <-ctx.Done():
+	case worker <- j:
+	}
+}
+
+// close waits for every worker to finish the messages already submitted. No
+// more may be submitted once it is called.
+func (p *workerPool) close() {
+	for _, worker := range p.workers {
+		close(worker)
+	}
+	p.wg.Wait()
+}
+
+// handle processes a message, retrying with backoff if it fails, then
+// acknowledges it, or dead letters it once it has failed maxAttempts times.
+// If the consumer is stopping the message is left unsettled, so the bus can
+// deliver it again.
+func (p *workerPool) handle(ctx context.Context, j job) {
+	backoff := retryBackoff
+
+	for attempt := 1; ; attempt++ {
+		if ctx.Err() != nil {
+			return
+		}
+
+		err := p.process(ctx, &j.msg)
+		if err == nil {
+			j.delivery.Ack()
+			return
+		}
+		if ctx.Err() != nil {
+			return
+		}
+
+		if attempt >= p.maxAttempts {
+			p.logger.Warnw("error processing TRUST message",
+				"msg_type", j.msg.Header.MsgType,
+				"train_id", j.msg.Body.TrainID,
+				"attempts", attempt,
+				"error", err,
+			)
+			j.delivery.Reject(ctx, err)
+			return
+		}
+
+		metrics.ConsumeRetries.WithLabelValues(j.queue).Inc()
+		p.logger.Debugw("retrying TRUST message",
+			"msg_type", j.msg.Header.MsgType,
+			"train_id", j.msg.Body.TrainID,
+			"attempt", attempt,
+			"error", err,
+		)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, maxRetryBackoff)
+	}
+}
@@ -0,0 +1,269 @@
+package trust
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jack-barr3tt/gbr-engine/src/common/bus"
+	"github.com/jack-barr3tt/gbr-engine/src/common/types"
+	"go.uber.org/zap"
+)
+
+// startPool consumes a TRUST queue on a memory bus into a worker pool handling
+// messages with process, returning the bus and a function publishing a
+// message to the queue
+func startPool(t *testing.T, config poolConfig, process func(ctx context.Context, msg *types.TrustMessage) error) (*bus.MemoryBus, func(trainID, stanox string)) {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+
+	b := bus.NewMemoryBus(1000)
+	if err := b.DeclareQueue(ctx, bus.TrustFeed, "q", "trust.#"); err != nil {
+		t.Fatal(err)
+	}
+	msgs, err := b.Consume(ctx, "q", bus.Prefetch(config.prefetch))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	logger := zap.NewNop().Sugar()
+	pool := newWorkerPool(ctx, logger, config, process)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		consume(ctx, logger, pool, "q", msgs)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+		pool.close()
+		b.Close()
+	})
+
+	publish := func(trainID, stanox string) {
+		t.Helper()
+		body, err := json.Marshal(types.TrustMessage{
+			Header: types.TrustHeader{MsgType: types.TrainMovement},
+			Body:   types.TrustBody{TrainID: trainID, LocStanox: stanox},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := b.Publish(ctx, "trust."+trainID, body, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return b, publish
+}
+
+func TestWorkerPoolKeepsTrainOrder(t *testing.T) {
+	const trains, perTrain = 6, 25
+
+	var mu sync.Mutex
+	handled := make(map[string][]string)
+	var wg sync.WaitGroup
+	wg.Add(trains * perTrain)
+
+	_, publish := startPool(t, poolConfig{workers: 4, prefetch: 16, maxAttempts: 1}, func(ctx context.Context, msg *types.TrustMessage) error {
+		defer wg.Done()
+		// uneven handling times would let a train's messages overtake each
+		// other if they were spread across workers
+		time.Sleep(time.Duration(rand.IntN(500)) * time.Microsecond)
+
+		mu.Lock()
+		defer mu.Unlock()
+		handled[msg.Body.TrainID] = append(handled[msg.Body.TrainID], msg.Body.LocStanox)
+		return nil
+	})
+
+	for i := range perTrain {
+		for train := range trains {
+			publish(fmt.Sprintf("1A%02d", train), fmt.Sprint(i))
+		}
+	}
+
+	finished := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(finished)
+	}()
+	select {
+	case <-finished:
+	case <-time.After(5 * time.Second):
+		t.Fatal("messages not all handled")
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	for train, stanox := range handled {
+		for i, got := range stanox {
+			if got != fmt.Sprint(i) {
+				t.Fatalf("train %s handled in order %v", train, stanox)
+			}
+		}
+	}
+}
+
+func TestWorkerPoolGivesUpAfterMaxAttempts(t *testing.T) {
+	const maxAttempts = 3
+
+	var mu sync.Mutex
+	attempts := make(map[string]int)
+	succeeded := make(chan string, 1)
+
+	b, publish := startPool(t, poolConfig{workers: 2, prefetch: 4, maxAttempts: maxAttempts}, func(ctx context.Context, msg *types.TrustMessage) error {
+		mu.Lock()
+		defer mu.Unlock()
+		train := msg.Body.TrainID
+		attempts[train]++
+
+		// 2B02 recovers on its second attempt while 1A01 never does
+		if train == "2B02" && attempts[train] > 1 {
+			succeeded <- train
+			return nil
+		}
+		return errors.New("journey store unavailable")
+	})
+
+	dead, err := b.Consume(context.Background(), bus.DeadLetterQueue(bus.TrustFeed))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	publish("1A01", "1")
+	publish("2B02", "2")
+
+	select {
+	case d := <-dead:
+		var msg types.TrustMessage
+		if err := json.Unmarshal(d.Body, &msg); err != nil {
+			t.Fatal(err)
+		}
+		if msg.Body.TrainID != "1A01" {
+			t.Errorf("dead lettered %s, want 1A01", msg.Body.TrainID)
+		}
+		d.Ack()
+	case <-time.After(5 * time.Second):
+		t.Fatal("failing message not dead lettered")
+	}
+
+	select {
+	case <-succeeded:
+	case <-time.After(5 * time.Second):
+		t.Fatal("recovering message not handled")
+	}
+
+	select {
+	case d := <-dead:
+		t.Errorf("unexpected dead letter %s", d.Body)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if attempts["1A01"] != maxAttempts {
+		t.Errorf("failing message attempted %d times, want %d", attempts["1A01"], maxAttempts)
+	}
+	if attempts["2B02"] != 2 {
+		t.Errorf("recovering message attempted %d times, want 2", attempts["2B02"])
+	}
+}
+
+func TestWorkerPoolOrdersChangeOfIdentityAfterOldID(t *testing.T) {
+	const trains, perTrain = 6, 10
+
+	// each train is reported, renamed, reported under its second ID, renamed
+	// again and reported under its third ID, and every message carries the ID
+	// it was activated under as its train ID
+	stage := func(msg *types.TrustMessage) int {
+		renamed := msg.Header.MsgType == types.ChangeOfIdentity
+		switch current := msg.Body.CurrentTrainID; {
+		case current == "":
+			return 0
+		case renamed && current == msg.Body.TrainID:
+			return 1
+		case renamed:
+			return 3
+		case strings.HasPrefix(current, "5M"):
+			return 2
+		default:
+			return 4
+		}
+	}
+
+	var mu sync.Mutex
+	handled := make(map[string][]int)
+	var wg sync.WaitGroup
+	wg.Add(trains * (3*perTrain + 2))
+
+	b, _ := startPool(t, poolConfig{workers: 4, prefetch: 16, maxAttempts: 1}, func(ctx context.Context, msg *types.TrustMessage) error {
+		defer wg.Done()
+		time.Sleep(time.Duration(rand.IntN(500)) * time.Microsecond)
+
+		mu.Lock()
+		defer mu.Unlock()
+		handled[msg.Body.TrainID] = append(handled[msg.Body.TrainID], stage(msg))
+		return nil
+	})
+
+	publish := func(msg types.TrustMessage) {
+		t.Helper()
+		body, err := json.Marshal(msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := b.Publish(context.Background(), "trust."+msg.Body.TrainID, body, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	movements := func(trainID, currentID string) {
+		for i := range perTrain {
+			publish(types.TrustMessage{
+				Header: types.TrustHeader{MsgType: types.TrainMovement},
+				Body:   types.TrustBody{TrainID: trainID, CurrentTrainID: currentID, LocStanox: fmt.Sprint(i)},
+			})
+		}
+	}
+	rename := func(trainID, currentID, revisedID string) {
+		publish(types.TrustMessage{
+			Header: types.TrustHeader{MsgType: types.ChangeOfIdentity},
+			Body:   types.TrustBody{TrainID: trainID, CurrentTrainID: currentID, RevisedTrainID: revisedID},
+		})
+	}
+
+	for train := range trains {
+		oldID, midID, newID := fmt.Sprintf("1A%02d", train), fmt.Sprintf("5M%02d", train), fmt.Sprintf("9Z%02d", train)
+		movements(oldID, "")
+		rename(oldID, oldID, midID)
+		movements(oldID, midID)
+		rename(oldID, midID, newID)
+		movements(oldID, newID)
+	}
+
+	finished := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(finished)
+	}()
+	select {
+	case <-finished:
+	case <-time.After(5 * time.Second):
+		t.Fatal("messages not all handled")
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	for trainID, stages := range handled {
+		if !slices.IsSorted(stages) {
+			t.Errorf("%s handled out of order across its renames: %v", trainID, stages)
+		}
+	}
+}
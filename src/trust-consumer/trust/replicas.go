@@ -0,0 +1,175 @@
+package trust
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jack-barr3tt/gbr-engine/src/common/bus"
+)
+
+const (
+	serviceAccountDir    = "/var/run/secrets/kubernetes.io/serviceaccount"
+	replicaRecheckPeriod = time.Minute
+	replicaLookupTimeout = 10 * time.Second
+)
+
+// replicaSet is which of the running TRUST consumers this one is, out of how
+// many. The count can be looked up again with lookup when it comes from the
+// StatefulSet, since the StatefulSet can be scaled without restarting its pods.
+type replicaSet struct {
+	replica  int
+	replicas int
+	lookup   func(ctx context.Context) (int, error)
+}
+
+// findReplicas works out this consumer's replica number from
+// TRUST_CONSUMER_REPLICA, which is either the number itself or a StatefulSet
+// pod name ending in it. The number of replicas comes from
+// TRUST_CONSUMER_REPLICAS if it is set, or else from the StatefulSet the pod
+// belongs to. Without TRUST_CONSUMER_REPLICA this is the only replica.
+func findReplicas(ctx context.Context) (replicaSet, error) {
+	replicaEnv := os.Getenv("TRUST_CONSUMER_REPLICA")
+	if replicaEnv == "" {
+		return replicaSet{replica: 0, replicas: 1}, nil
+	}
+
+	dash := strings.LastIndex(replicaEnv, "-")
+	replica, err := strconv.Atoi(replicaEnv[dash+1:])
+	if err != nil || replica < 0 {
+		return replicaSet{}, fmt.Errorf("invalid TRUST_CONSUMER_REPLICA %q", replicaEnv)
+	}
+
+	set := replicaSet{replica: replica}
+	if replicasEnv := os.Getenv("TRUST_CONSUMER_REPLICAS"); replicasEnv != "" {
+		set.replicas, err = strconv.Atoi(replicasEnv)
+		if err != nil || set.replicas < 1 {
+			return replicaSet{}, fmt.Errorf("invalid TRUST_CONSUMER_REPLICAS %q", replicasEnv)
+		}
+	} else {
+		if dash < 1 {
+			return replicaSet{}, fmt.Errorf("TRUST_CONSUMER_REPLICAS must be set unless TRUST_CONSUMER_REPLICA is a StatefulSet pod name")
+		}
+		statefulSet := replicaEnv[:dash]
+		set.lookup = func(ctx context.Context) (int, error) {
+			return statefulSetReplicas(ctx, statefulSet)
+		}
+		if set.replicas, err = set.lookup(ctx); err != nil {
+			return replicaSet{}, fmt.Errorf("failed to look up replicas of %s: %w", statefulSet, err)
+		}
+	}
+
+	if replica >= set.replicas {
+		return replicaSet{}, fmt.Errorf("replica %d is out of range for %d replicas", replica, set.replicas)
+	}
+	return set, nil
+}
+
+// partitions lists the TRUST partitions this replica consumes, which are
+// those with its number as the remainder
+func (s replicaSet) partitions() []int {
+	var partitions []int
+	for partition := s.replica; partition < bus.TrustPartitions; partition += s.replicas {
+		partitions = append(partitions, partition)
+	}
+	return partitions
+}
+
+// watch looks up the number of replicas periodically until the context is
+// cancelled, returning an error once it has changed so the consumer can be
+// restarted to take its new share of the partitions
+func (s replicaSet) watch(ctx context.Context) error {
+	if s.lookup == nil {
+		<-ctx.Done()
+		return nil
+	}
+
+	ticker := time.NewTicker(replicaRecheckPeriod)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+
+		replicas, err := s.lookup(ctx)
+		if err != nil {
+			// keep the partitions already owned until it can be looked up
+			continue
+		}
+		if replicas != s.replicas {
+			return fmt.Errorf("replicas changed from %d to %d", s.replicas, replicas)
+		}
+	}
+}
+
+// statefulSetReplicas asks the Kubernetes API how many replicas a StatefulSet
+// in this pod's namespace should have, authenticating as the pod's service
+// account
+func statefulSetReplicas(ctx context.Context, name string) (int, error) {
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return 0, fmt.Errorf("not running in Kubernetes")
+	}
+
+	namespace, err := os.ReadFile(serviceAccountDir + "/namespace")
+	if err != nil {
+		return 0, err
+	}
+	token, err := os.ReadFile(serviceAccountDir + "/token")
+	if err != nil {
+		return 0, err
+	}
+	ca, err := os.ReadFile(serviceAccountDir + "/ca.crt")
+	if err != nil {
+		return 0, err
+	}
+	roots := x509.NewCertPool()
+	roots.AppendCertsFromPEM(ca)
+
+	ctx, cancel := context.WithTimeout(ctx, replicaLookupTimeout)
+	defer cancel()
+
+	url := fmt.Sprintf("https://%s/apis/apps/v1/namespaces/%s/statefulsets/%s",
+		net.JoinHostPort(host, port), strings.TrimSpace(string(namespace)), name)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots}}}
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	var statefulSet struct {
+		Spec struct {
+			Replicas *int `json:"replicas"`
+		} `json:"spec"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&statefulSet); err != nil {
+		return 0, err
+	}
+	// Kubernetes defaults an unset replica count to 1
+	if statefulSet.Spec.Replicas == nil {
+		return 1, nil
+	}
+	return *statefulSet.Spec.Replicas, nil
+}
@@ -0,0 +1,492 @@
+package trust
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jack-barr3tt/gbr-engine/src/common/bus"
+	"github.com/jack-barr3tt/gbr-engine/src/common/metrics"
+	"github.com/jack-barr3tt/gbr-engine/src/common/types"
+	"github.com/jack-barr3tt/gbr-engine/src/common/utils"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/redis/go-redis/v9"
+	"go.uber.org/zap"
+)
+
+// Run tracks train positions from TRUST messages on the bus until the context
+// is cancelled, the bus stops delivering or the number of replicas changes.
+// Each partition this replica owns is consumed alongside the others, and only
+// one replica consumes a partition at a time, so no two consumers ever update
+// the same train. Messages are handled by a pool of workers that keeps each
+// train's messages in order, and are only acknowledged once they have been
+// merged.
+func Run(ctx context.Context, db *pgxpool.Pool, rdb *redis.Client, b bus.Bus) error {
+	logger := utils.GetLogger()
+
+	replicas, err := findReplicas(ctx)
+	if err != nil {
+		return err
+	}
+	partitions := replicas.partitions()
+
+	config, err := loadPoolConfig()
+	if err != nil {
+		return err
+	}
+
+	go pruneMovementArchive(ctx, db, logger)
+
+	ctx, cancel := context.WithCancel(ctx)
+	pool := newWorkerPool(ctx, logger, config, func(ctx context.Context, msg *types.TrustMessage) error {
+		return processMessage(ctx, db, rdb, logger, msg)
+	})
+
+	// the partitions are stopped before the pool, so nothing is submitted to
+	// it once it has closed
+	var wg sync.WaitGroup
+	defer func() {
+		cancel()
+		wg.Wait()
+		pool.close()
+	}()
+
+	for _, partition := range partitions {
+		queue := bus.TrustPartitionQueue(partition)
+		if err := bus.DeclareTrustPartition(ctx, b, partition); err != nil {
+			return fmt.Errorf("failed to declare TRUST queue %s: %w", queue, err)
+		}
+
+		msgs, err := b.Consume(ctx, queue, bus.Prefetch(config.prefetch))
+		if err != nil {
+			return fmt.Errorf("failed to consume TRUST queue %s: %w", queue, err)
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			consume(ctx, logger, pool, queue, msgs)
+		}()
+	}
+	logger.Infow("tracking train positions via TRUST feed",
+		"partitions", partitions,
+		"workers", config.workers,
+		"prefetch", config.prefetch,
+	)
+
+	// a replica's partitions are picked by how many replicas there are, so it
+	// stops once that changes and is restarted to pick them again
+	watchErr := make(chan error, 1)
+	go func() {
+		watchErr <- replicas.watch(ctx)
+		cancel()
+	}()
+
+	wg.Wait()
+	cancel()
+	return <-watchErr
+}
+
+// consume passes the messages from one partition to the worker pool in the
+// order they arrive
+func consume(ctx context.Context, logger *zap.SugaredLogger, pool *workerPool, queue string, msgs <-chan bus.Delivery) {
+	for msg := range msgs {
+		var trust types.TrustMessage
+		if err := json.Unmarshal(msg.Body, &trust); err != nil {
+			logger.Warnw("bad json in TRUST message", "error", err)
+			msg.Reject(ctx, err)
+			continue
+		}
+
+		pool.submit(ctx, job{queue: queue, delivery: msg, msg: trust})
+	}
+}
+
+func processMessage(ctx context.Context, db *pgxpool.Pool, rdb *redis.Client, logger *zap.SugaredLogger, trust *types.TrustMessage) error {
+	switch trust.Header.MsgType {
+	case types.TrainActivation:
+		return processActivation(ctx, rdb, logger, &trust.Body)
+	case types.TrainMovement:
+		return processMovement(ctx, db, rdb, logger, trust)
+	case types.TrainCancellation:
+		return processCancellation(ctx, db, rdb, logger, &trust.Body)
+	case types.TrainReinstatement:
+		return processReinstatement(ctx, db, rdb, logger, &trust.Body)
+	case types.ChangeOfOrigin:
+		return processChangeOfOrigin(ctx, db, rdb, logger, &trust.Body)
+	case types.ChangeOfIdentity:
+		return processChangeOfIdentity(ctx, rdb, logger, &trust.Body)
+	case types.ChangeOfLocation:
+		return processChangeOfLocation(ctx, db, rdb, logger, &trust.Body)
+	default:
+		return nil
+	}
+}
+
+func processActivation(ctx context.Context, rdb *redis.Client, logger *zap.SugaredLogger, trust *types.TrustBody) error {
+	trainID := strings.TrimSpace(trust.TrainID)
+	trainUID := strings.TrimSpace(trust.TrainUID)
+
+	activation := types.Activation{
+		TrainUID:          trainUID,
+		RunDate:           utils.ActivationRunDate(trust),
+		ScheduleStartDate: strings.TrimSpace(trust.ScheduleStartDate),
+	}
+	b, err := json.Marshal(activation)
+	if err != nil {
+		return fmt.Errorf("failed to marshal activation: %w", err)
+	}
+
+	key := utils.BuildActivationKey(trainID)
+	err = rdb.Set(ctx, key, b, 48*time.Hour).Err()
+	if err != nil {
+		return fmt.Errorf("failed to store activation: %w", err)
+	}
+
+	if err := storeHeadcode(ctx, rdb, trainID); err != nil {
+		return err
+	}
+	logger.Infow("stored activation", "train_id", trainID, "train_uid", trainUID, "run_date", activation.RunDate)
+	return nil
+}
+
+// updateActivatedJourney applies update to the journey for the activated train
+// a message is about on the day it was activated for, returning false if the
+// train was never activated or has no schedule for that day
+func updateActivatedJourney(ctx context.Context, db *pgxpool.Pool, rdb *redis.Client, logger *zap.SugaredLogger, trust *types.TrustBody, update func(*types.TrainJourney) bool) (types.TrainJourney, bool, error) {
+	activation, err := loadActivation(ctx, rdb, trust)
+	if err != nil {
+		logger.Debugw("no activation found for train", "train_id", strings.TrimSpace(trust.TrainID))
+		return types.TrainJourney{}, false, nil
+	}
+
+	journey, err := utils.UpdateTrainJourney(ctx, db, rdb, activation.TrainUID, activation.RunDate, update)
+	if errors.Is(err, utils.ErrJourneyNotFound) {
+		return types.TrainJourney{}, false, nil
+	}
+	if err != nil {
+		return types.TrainJourney{}, false, err
+	}
+
+	return journey, true, nil
+}
+
+// loadActivation finds the activation for the train a message is about. A
+// renumbered train's messages carry the ID it currently runs under alongside
+// its train ID, and the activation is held under one or the other depending
+// on whether its change of identity has been handled yet, so both are tried.
+func loadActivation(ctx context.Context, rdb *redis.Client, trust *types.TrustBody) (types.Activation, error) {
+	trainID := strings.TrimSpace(trust.TrainID)
+	activation, err := utils.LoadActivation(ctx, rdb, trainID)
+	if err == nil {
+		return activation, nil
+	}
+
+	if currentID := strings.TrimSpace(trust.CurrentTrainID); currentID != "" && currentID != trainID {
+		if activation, currentErr := utils.LoadActivation(ctx, rdb, currentID); currentErr == nil {
+			return activation, nil
+		}
+	}
+	return types.Activation{}, err
+}
+
+// storeHeadcode indexes a train ID by its headcode, since TD only knows trains
+// by the headcode embedded in the train ID
+func storeHeadcode(ctx context.Context, rdb *redis.Client, trainID string) error {
+	headcode := utils.HeadcodeFromTrainID(trainID)
+	if headcode == "" {
+		return nil
+	}
+
+	headcodeKey := utils.BuildHeadcodeKey(headcode)
+	if err := rdb.SAdd(ctx, headcodeKey, trainID).Err(); err != nil {
+		return fmt.Errorf("failed to store headcode: %w", err)
+	}
+	rdb.Expire(ctx, headcodeKey, 48*time.Hour)
+	return nil
+}
+
+func processMovement(ctx context.Context, db *pgxpool.Pool, rdb *redis.Client, logger *zap.SugaredLogger, msg *types.TrustMessage) error {
+	trust := &msg.Body
+	trainID := strings.TrimSpace(trust.TrainID)
+
+	var outcome utils.MergeOutcome
+	var i int
+	journey, ok, err := updateActivatedJourney(ctx, db, rdb, logger, trust, func(journey *types.TrainJourney) bool {
+		outcome, i = utils.MergeTrustEvent(journey, trust, msg.Header.MsgQueueTimestamp)
+		return outcome == utils.MergeApplied
+	})
+	if err != nil {
+		return fmt.Errorf("failed to save merged schedule: %w", err)
+	}
+	if !ok {
+		return nil
+	}
+	metrics.MergeOutcomes.WithLabelValues(string(outcome)).Inc()
+
+	trainUID := journey.UID
+	if outcome == utils.MergeNoMatch {
+		foundStanoxes := []string{}
+		for _, stop := range journey.Stops {
+			foundStanoxes = append(foundStanoxes, stop.Stanox)
+		}
+		logger.Debugw("no stanox match in schedule",
+			"train_uid", trainUID,
+			"loc_stanox", trust.LocStanox,
+			"schedule_stanoxes", foundStanoxes,
+		)
+		return nil
+	}
+	// a duplicate may be a retry of a movement that was merged but failed to
+	// archive, and archiving it again keeps its place in the replay order
+	if outcome == utils.MergeDuplicate {
+		return utils.ArchiveMovement(ctx, db, utils.StopMovement(&journey, i, trust.EventType, trainID))
+	}
+	if outcome != utils.MergeApplied {
+		logger.Debugw("ignored TRUST event",
+			"train_uid", trainUID,
+			"outcome", outcome,
+			"event_type", trust.EventType,
+			"stanox", trust.LocStanox,
+			"msg_queue_timestamp", msg.Header.MsgQueueTimestamp,
+		)
+		return nil
+	}
+
+	logger.Infow("merged TRUST into schedule",
+		"train_uid", trainUID,
+		"train_id", trainID,
+		"event_type", trust.EventType,
+		"stanox", trust.LocStanox,
+		"correction", trust.CorrectionInd == "true",
+	)
+
+	return utils.ArchiveMovement(ctx, db, utils.StopMovement(&journey, i, trust.EventType, trainID))
+}
+
+func processCancellation(ctx context.Context, db *pgxpool.Pool, rdb *redis.Client, logger *zap.SugaredLogger, trust *types.TrustBody) error {
+	trainID := strings.TrimSpace(trust.TrainID)
+
+	journey, ok, err := updateActivatedJourney(ctx, db, rdb, logger, trust, func(journey *types.TrainJourney) bool {
+		utils.ApplyCancellation(journey, trust)
+		return true
+	})
+	if err != nil {
+		return fmt.Errorf("failed to save cancelled schedule: %w", err)
+	}
+	if !ok {
+		return nil
+	}
+
+	logger.Infow("recorded cancellation",
+		"train_uid", journey.UID,
+		"train_id", trainID,
+		"canx_type", trust.CanxType,
+		"reason_code", trust.CanxReasonCode,
+		"stanox", trust.LocStanox,
+	)
+
+	return utils.ArchiveMovement(ctx, db, &types.Movement{
+		TrainUID:        journey.UID,
+		RunDate:         journey.RunDate,
+		TrainID:         trainID,
+		Stanox:          trust.LocStanox,
+		EventType:       types.MovementCancellation,
+		ActualTimestamp: trust.CanxTimestamp,
+		Source:          types.FeedTRUST,
+		CanxType:        strings.TrimSpace(trust.CanxType),
+		ReasonCode:      strings.TrimSpace(trust.CanxReasonCode),
+	})
+}
+
+func processReinstatement(ctx context.Context, db *pgxpool.Pool, rdb *redis.Client, logger *zap.SugaredLogger, trust *types.TrustBody) error {
+	trainID := strings.TrimSpace(trust.TrainID)
+
+	journey, ok, err := updateActivatedJourney(ctx, db, rdb, logger, trust, func(journey *types.TrainJourney) bool {
+		utils.ApplyReinstatement(journey, trust)
+		return true
+	})
+	if err != nil {
+		return fmt.Errorf("failed to save reinstated schedule: %w", err)
+	}
+	if !ok {
+		return nil
+	}
+
+	logger.Infow("recorded reinstatement",
+		"train_uid", journey.UID,
+		"train_id", trainID,
+		"stanox", trust.LocStanox,
+	)
+
+	return utils.ArchiveMovement(ctx, db, &types.Movement{
+		TrainUID:        journey.UID,
+		RunDate:         journey.RunDate,
+		TrainID:         trainID,
+		Stanox:          trust.LocStanox,
+		EventType:       types.MovementReinstatement,
+		ActualTimestamp: trust.ReinstatementTimestamp,
+		Source:          types.FeedTRUST,
+	})
+}
+
+func processChangeOfOrigin(ctx context.Context, db *pgxpool.Pool, rdb *redis.Client, logger *zap.SugaredLogger, trust *types.TrustBody) error {
+	trainID := strings.TrimSpace(trust.TrainID)
+
+	var applied bool
+	journey, ok, err := updateActivatedJourney(ctx, db, rdb, logger, trust, func(journey *types.TrainJourney) bool {
+		applied = utils.ApplyChangeOfOrigin(journey, trust)
+		return applied
+	})
+	if err != nil {
+		return fmt.Errorf("failed to save truncated schedule: %w", err)
+	}
+	if !ok {
+		return nil
+	}
+	if !applied {
+		logger.Debugw("new origin not in schedule", "train_uid", journey.UID, "loc_stanox", trust.LocStanox)
+		return nil
+	}
+
+	logger.Infow("recorded change of origin",
+		"train_uid", journey.UID,
+		"train_id", trainID,
+		"reason_code", trust.ReasonCode,
+		"stanox", trust.LocStanox,
+	)
+
+	return utils.ArchiveMovement(ctx, db, &types.Movement{
+		TrainUID:        journey.UID,
+		RunDate:         journey.RunDate,
+		TrainID:         trainID,
+		Stanox:          trust.LocStanox,
+		EventType:       types.MovementChangeOfOrigin,
+		ActualTimestamp: trust.CooTimestamp,
+		Source:          types.FeedTRUST,
+		ReasonCode:      strings.TrimSpace(trust.ReasonCode),
+	})
+}
+
+// processChangeOfIdentity moves a train's activation to its revised train ID
+// so that movements reported under the new ID still find the schedule
+func processChangeOfIdentity(ctx context.Context, rdb *redis.Client, logger *zap.SugaredLogger, trust *types.TrustBody) error {
+	oldID := strings.TrimSpace(trust.CurrentTrainID)
+	if oldID == "" {
+		oldID = strings.TrimSpace(trust.TrainID)
+	}
+	newID := strings.TrimSpace(trust.RevisedTrainID)
+	if newID == "" || newID == oldID {
+		return nil
+	}
+
+	oldKey := utils.BuildActivationKey(oldID)
+	exists, err := rdb.Exists(ctx, oldKey).Result()
+	if err != nil {
+		return fmt.Errorf("failed to look up activation: %w", err)
+	}
+	if exists == 0 {
+		logger.Debugw("no activation found for train", "train_id", oldID)
+		return nil
+	}
+
+	if err := rdb.Rename(ctx, oldKey, utils.BuildActivationKey(newID)).Err(); err != nil {
+		return fmt.Errorf("failed to re-key activation: %w", err)
+	}
+
+	if headcode := utils.HeadcodeFromTrainID(oldID); headcode != "" {
+		rdb.SRem(ctx, utils.BuildHeadcodeKey(headcode), oldID)
+	}
+	if err := storeHeadcode(ctx, rdb, newID); err != nil {
+		return err
+	}
+
+	logger.Infow("recorded change of identity", "train_id", oldID, "revised_train_id", newID)
+	return nil
+}
+
+// processChangeOfLocation moves actuals TRUST reported at the wrong location
+// onto the stop they belong to, and moves their archived records with them.
+// The records are rewritten from the journey even if the actuals had already
+// been moved, so a retry after a failed archive still corrects them.
+func processChangeOfLocation(ctx context.Context, db *pgxpool.Pool, rdb *redis.Client, logger *zap.SugaredLogger, trust *types.TrustBody) error {
+	trainID := strings.TrimSpace(trust.TrainID)
+
+	var from, to int
+	journey, ok, err := updateActivatedJourney(ctx, db, rdb, logger, trust, func(journey *types.TrainJourney) bool {
+		var moved bool
+		from, to, moved = utils.ApplyChangeOfLocation(journey, trust)
+		return moved
+	})
+	if err != nil {
+		return fmt.Errorf("failed to save corrected schedule: %w", err)
+	}
+	if !ok {
+		return nil
+	}
+	if from == -1 || to == -1 || from == to {
+		logger.Debugw("change of location not in schedule",
+			"train_uid", journey.UID,
+			"original_loc_stanox", trust.OriginalLocStanox,
+			"loc_stanox", trust.LocStanox,
+		)
+		return nil
+	}
+
+	logger.Infow("recorded change of location",
+		"train_uid", journey.UID,
+		"train_id", trainID,
+		"original_loc_stanox", trust.OriginalLocStanox,
+		"stanox", trust.LocStanox,
+	)
+
+	// the change is archived before the moved actuals, so replaying the
+	// archive in order finds nothing left to move
+	if err := utils.ArchiveMovement(ctx, db, &types.Movement{
+		TrainUID:        journey.UID,
+		RunDate:         journey.RunDate,
+		TrainID:         trainID,
+		Stanox:          trust.LocStanox,
+		EventType:       types.MovementChangeOfLocation,
+		ActualTimestamp: trust.EventTimestamp,
+		Source:          types.FeedTRUST,
+		OriginalStanox:  trust.OriginalLocStanox,
+	}); err != nil {
+		return err
+	}
+
+	for _, eventType := range []string{types.MovementArrival, types.MovementDeparture} {
+		if err := utils.DeleteArchivedMovement(ctx, db, utils.StopMovement(&journey, from, eventType, trainID)); err != nil {
+			return err
+		}
+		if moved := utils.StopMovement(&journey, to, eventType, trainID); moved.ActualTimestamp != "" {
+			if err := utils.ArchiveMovement(ctx, db, moved); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// pruneMovementArchive drops archived movements older than the retention
+// period once at startup and then daily
+func pruneMovementArchive(ctx context.Context, db *pgxpool.Pool, logger *zap.SugaredLogger) {
+	retention := utils.MovementRetention()
+	for {
+		dropped, err := utils.PruneMovementArchive(ctx, db, retention)
+		if err != nil {
+			logger.Warnw("failed to prune movement archive", "error", err)
+		} else if len(dropped) > 0 {
+			logger.Infow("pruned movement archive", "partitions", dropped, "retention", retention)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(24 * time.Hour):
+		}
+	}
+}
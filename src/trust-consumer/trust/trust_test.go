@@ -0,0 +1,104 @@
+package trust
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/jack-barr3tt/gbr-engine/src/common/testdb"
+	"github.com/jack-barr3tt/gbr-engine/src/common/types"
+	"github.com/jack-barr3tt/gbr-engine/src/common/utils"
+	"github.com/redis/go-redis/v9"
+	"go.uber.org/zap"
+)
+
+func TestLoadActivationAcrossChangeOfIdentity(t *testing.T) {
+	ctx := context.Background()
+	server := miniredis.RunT(t)
+	rdb := redis.NewClient(&redis.Options{Addr: server.Addr()})
+	defer rdb.Close()
+
+	server.Set(utils.BuildActivationKey("451A23MB01"), `{"train_uid":"C12345","run_date":"20260101"}`)
+
+	// reported under the original ID alongside the revised one, before and
+	// after the change of identity has moved the activation
+	movement := &types.TrustBody{TrainID: "451A23MB01", CurrentTrainID: "452B45MB01"}
+	for _, stage := range []string{"before", "after"} {
+		if stage == "after" {
+			if err := processChangeOfIdentity(ctx, rdb, zap.NewNop().Sugar(), &types.TrustBody{
+				TrainID: "451A23MB01", CurrentTrainID: "451A23MB01", RevisedTrainID: "452B45MB01",
+			}); err != nil {
+				t.Fatalf("processChangeOfIdentity() error = %v", err)
+			}
+		}
+
+		activation, err := loadActivation(ctx, rdb, movement)
+		if err != nil {
+			t.Fatalf("loadActivation() %s the change error = %v", stage, err)
+		}
+		if activation.TrainUID != "C12345" {
+			t.Errorf("loadActivation() %s the change = %+v, want C12345", stage, activation)
+		}
+	}
+
+	if _, err := loadActivation(ctx, rdb, &types.TrustBody{TrainID: "459Z99MB01"}); err == nil {
+		t.Error("loadActivation() found an activation for a train never activated")
+	}
+}
+
+func TestProcessMovementRetriesFailedArchive(t *testing.T) {
+	ctx := context.Background()
+	db := testdb.New(t)
+	server := miniredis.RunT(t)
+	rdb := redis.NewClient(&redis.Options{Addr: server.Addr()})
+	defer rdb.Close()
+
+	journey := types.TrainJourney{UID: "C12345", RunDate: "20260101", Stops: []types.Stop{
+		{Stanox: "A", PlannedDep: "10:00"},
+		{Stanox: "C", PlannedArr: "10:30"},
+	}}
+	if err := utils.ReplaceTrainJourney(ctx, rdb, &journey, time.Hour); err != nil {
+		t.Fatalf("ReplaceTrainJourney() error = %v", err)
+	}
+	server.Set(utils.BuildActivationKey("451A23MB01"), `{"train_uid":"C12345","run_date":"20260101"}`)
+
+	_, err := db.Exec(ctx, `
+		CREATE FUNCTION fail_archive() RETURNS trigger AS $$
+		BEGIN
+			RAISE EXCEPTION 'archive unavailable';
+		END
+		$$ LANGUAGE plpgsql;
+		CREATE TRIGGER fail_archive BEFORE INSERT ON movement FOR EACH ROW EXECUTE FUNCTION fail_archive();
+	`)
+	if err != nil {
+		t.Fatalf("failed to create trigger: %v", err)
+	}
+
+	msg := &types.TrustMessage{
+		Header: types.TrustHeader{MsgType: types.TrainMovement, MsgQueueTimestamp: "100"},
+		Body: types.TrustBody{TrainID: "451A23MB01", LocStanox: "A", EventType: "DEPARTURE",
+			ActualTimestamp: "1767261660000"},
+	}
+	logger := zap.NewNop().Sugar()
+
+	// the departure is merged into the journey but fails to archive, so the
+	// message is redelivered and arrives as a duplicate
+	if err := processMovement(ctx, db, rdb, logger, msg); err == nil {
+		t.Fatal("processMovement() succeeded while the archive was failing")
+	}
+	if _, err := db.Exec(ctx, `DROP TRIGGER fail_archive ON movement`); err != nil {
+		t.Fatalf("failed to drop trigger: %v", err)
+	}
+	if err := processMovement(ctx, db, rdb, logger, msg); err != nil {
+		t.Fatalf("processMovement() retry error = %v", err)
+	}
+
+	archived, err := utils.LoadArchivedMovements(ctx, db, "C12345", "20260101")
+	if err != nil {
+		t.Fatalf("LoadArchivedMovements() error = %v", err)
+	}
+	if len(archived) != 1 || archived[0].Stanox != "A" || archived[0].ActualTimestamp != msg.Body.ActualTimestamp {
+		t.Errorf("archived movements = %+v, want the departure from A", archived)
+	}
+}
@@ -0,0 +1,460 @@
+package vstp
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jack-barr3tt/gbr-engine/src/common/bus"
+	"github.com/jack-barr3tt/gbr-engine/src/common/data"
+	"github.com/jack-barr3tt/gbr-engine/src/common/metrics"
+	"github.com/jack-barr3tt/gbr-engine/src/common/types"
+	"github.com/jack-barr3tt/gbr-engine/src/common/utils"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/redis/go-redis/v9"
+	"go.uber.org/zap"
+)
+
+type Connections struct {
+	DB     *pgxpool.Pool
+	Redis  *redis.Client
+	Logger *zap.SugaredLogger
+	Data   *data.DataClient
+}
+
+// Run stores VSTP schedules from the bus until the context is cancelled or the
+// bus stops delivering
+func Run(ctx context.Context, db *pgxpool.Pool, rdb *redis.Client, b bus.Bus) error {
+	log := utils.GetLogger()
+
+	if err := b.DeclareQueue(ctx, bus.VSTPFeed, "vstp", "vstp.#"); err != nil {
+		return fmt.Errorf("failed to declare VSTP queue: %w", err)
+	}
+
+	msgs, err := b.Consume(ctx, "vstp")
+	if err != nil {
+		return fmt.Errorf("failed to consume VSTP queue: %w", err)
+	}
+
+	log.Info("Processing VSTP schedule messages...")
+
+	for msg := range msgs {
+		var vstpMsg types.VSTPMessage
+		if err := json.Unmarshal(msg.Body, &vstpMsg); err != nil {
+			log.Warnw("bad json in VSTP message", "error", err)
+			msg.Reject(ctx, err)
+			continue
+		}
+
+		err := processVSTPMessage(ctx, &Connections{
+			DB:     db,
+			Redis:  rdb,
+			Logger: log,
+			Data:   data.NewDataClient(db, rdb, log),
+		}, &vstpMsg)
+		transactionLabel := normaliseTransactionType(vstpMsg.VSTPCIFMsgV1.Schedule.TransactionType)
+		if transactionLabel == "" {
+			transactionLabel = "unknown"
+		}
+		metrics.VSTPSchedules.WithLabelValues(transactionLabel, metrics.Outcome(err)).Inc()
+		if err != nil {
+			log.Warnw("error processing VSTP message", "error", err)
+			msg.Reject(ctx, err)
+			continue
+		}
+		msg.Ack()
+		log.Infow("processed VSTP schedule", "train_uid", vstpMsg.VSTPCIFMsgV1.Schedule.TrainUID)
+	}
+
+	return nil
+}
+
+// VSTP transaction types. A create or revise replaces any VSTP schedule
+// already stored for the same train UID, start date and STP indicator, and a
+// delete removes it.
+const (
+	transactionCreate = "create"
+	transactionRevise = "revise"
+	transactionDelete = "delete"
+)
+
+// normaliseTransactionType returns the transaction type of a schedule as one
+// of the constants above, or "" if it is none of them
+func normaliseTransactionType(transactionType string) string {
+	switch normalised := strings.ToLower(strings.TrimSpace(transactionType)); normalised {
+	case transactionCreate, transactionRevise, transactionDelete:
+		return normalised
+	default:
+		return ""
+	}
+}
+
+func processVSTPMessage(ctx context.Context, conn *Connections, vstpMsg *types.VSTPMessage) error {
+	schedule := &vstpMsg.VSTPCIFMsgV1.Schedule
+
+	startDate, err := time.Parse("2006-01-02", schedule.ScheduleStartDate)
+	if err != nil {
+		return fmt.Errorf("invalid start date: %v", err)
+	}
+
+	transactionType := normaliseTransactionType(schedule.TransactionType)
+	if transactionType == "" {
+		return fmt.Errorf("unknown transaction type %q", schedule.TransactionType)
+	}
+
+	// a delete only needs to identify the schedule it removes
+	var endDate time.Time
+	if transactionType != transactionDelete {
+		endDate, err = time.Parse("2006-01-02", schedule.ScheduleEndDate)
+		if err != nil {
+			return fmt.Errorf("invalid end date: %v", err)
+		}
+	}
+
+	trainUID := strings.TrimSpace(schedule.TrainUID)
+
+	defer metrics.QueryTimer("store_vstp_schedule").ObserveDuration()
+
+	tx, err := conn.DB.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	// messages for the same train are applied one at a time, however many
+	// consumers are running
+	if _, err := tx.Exec(ctx, `SELECT pg_advisory_xact_lock(hashtext($1))`, "vstp:"+trainUID); err != nil {
+		return fmt.Errorf("error locking schedule: %v", err)
+	}
+
+	replaced, err := deleteSchedule(ctx, tx, trainUID, startDate, schedule.StpIndicator)
+	if err != nil {
+		return fmt.Errorf("error removing previous schedule: %v", err)
+	}
+
+	if transactionType != transactionDelete {
+		if err := insertSchedule(ctx, tx, vstpMsg, trainUID, startDate, endDate); err != nil {
+			return err
+		}
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return err
+	}
+
+	if transactionType == transactionDelete && replaced == 0 {
+		conn.Logger.Debugw("no VSTP schedule to delete", "train_uid", trainUID, "start_date", schedule.ScheduleStartDate, "stp_indicator", schedule.StpIndicator)
+	}
+
+	return updateJourneys(ctx, conn, schedule, transactionType, trainUID, startDate, endDate)
+}
+
+// journeyHorizon is how many days ahead VSTP journeys are cached, taken from
+// VSTP_JOURNEY_HORIZON_DAYS and defaulting to 3 days. Journeys further ahead
+// are built from the timetable once they are needed.
+func journeyHorizon() int {
+	days, err := strconv.Atoi(os.Getenv("VSTP_JOURNEY_HORIZON_DAYS"))
+	if err != nil || days < 0 {
+		days = 3
+	}
+	return days
+}
+
+// updateJourneys caches a journey for every day from yesterday to the
+// horizon that a VSTP schedule runs on, and removes any cached journey for
+// the other days from its start date, so a day the schedule no longer runs on
+// is rebuilt from whatever schedule still applies the next time it is needed.
+// A journey already cached for a day keeps whatever has been recorded against
+// it so far. An STP cancellation has no stops of its own, so instead every
+// stop not yet reached on the journeys it cancels is marked cancelled.
+func updateJourneys(ctx context.Context, conn *Connections, schedule *types.VSTPSchedule, transactionType, trainUID string, startDate, endDate time.Time) error {
+	var stops []types.Stop
+	if transactionType != transactionDelete {
+		stops = buildStops(conn.Data.GetStanoxByTiploc, schedule)
+	}
+
+	runs, skips := journeyDays(schedule.ScheduleDaysRuns, startDate, endDate, utils.UKDate(time.Now()), journeyHorizon())
+	if transactionType == transactionDelete {
+		skips, runs = append(skips, runs...), nil
+	}
+
+	var written, removed int
+	for _, day := range skips {
+		if err := utils.DeleteTrainJourney(ctx, conn.Redis, trainUID, utils.FormatRunDate(day)); err != nil {
+			return fmt.Errorf("failed to remove schedule from Redis: %w", err)
+		}
+		removed++
+	}
+
+	for _, day := range runs {
+		runDate := utils.FormatRunDate(day)
+
+		if schedule.StpIndicator == utils.STPCancellation {
+			_, err := utils.UpdateTrainJourney(ctx, conn.DB, conn.Redis, trainUID, runDate, cancelJourney)
+			if errors.Is(err, utils.ErrJourneyNotFound) {
+				continue
+			}
+			if err != nil {
+				return fmt.Errorf("failed to cancel journey in Redis: %w", err)
+			}
+			written++
+			continue
+		}
+
+		// kept until the day after the train runs, for trains running past
+		// midnight
+		journey := types.TrainJourney{UID: trainUID, RunDate: runDate, Stops: stops}
+		ttl := time.Until(day.AddDate(0, 0, 2))
+		if err := utils.ReplaceTrainJourney(ctx, conn.Redis, &journey, ttl); err != nil {
+			return fmt.Errorf("failed to write schedule to Redis: %w", err)
+		}
+		written++
+	}
+
+	conn.Logger.Infow("updated VSTP journeys in Redis",
+		"train_uid", trainUID,
+		"transaction_type", transactionType,
+		"written", written,
+		"removed", removed,
+	)
+	return nil
+}
+
+// journeyDays lists the days from the day before today to horizon days after
+// it that a schedule covers, split into those it runs on and those from its
+// start date that it does not
+func journeyDays(daysRuns string, startDate, endDate, today time.Time, horizon int) (runs, skips []time.Time) {
+	first := today.AddDate(0, 0, -1)
+	if startDate.After(first) {
+		first = startDate
+	}
+	last := today.AddDate(0, 0, horizon)
+
+	for day := first; !day.After(last); day = day.AddDate(0, 0, 1) {
+		if utils.IsScheduleValidForDate(daysRuns, startDate, endDate, day) {
+			runs = append(runs, day)
+		} else {
+			skips = append(skips, day)
+		}
+	}
+	return runs, skips
+}
+
+// plannedCancellation is the cancellation type recorded on a journey
+// cancelled by an STP cancellation rather than by TRUST
+const plannedCancellation = "PLANNED"
+
+// cancelJourney marks every stop of a journey that has not been reached as
+// cancelled
+func cancelJourney(journey *types.TrainJourney) bool {
+	if journey.Cancellation != nil && journey.Cancellation.Type == plannedCancellation {
+		return false
+	}
+
+	journey.Cancellation = &types.Cancellation{Type: plannedCancellation}
+	for i := range journey.Stops {
+		if !journey.Stops[i].Reached() {
+			journey.Stops[i].Cancelled = true
+		}
+	}
+	return true
+}
+
+// deleteSchedule removes the VSTP schedules stored for a train UID, start
+// date and STP indicator, along with their locations, returning how many were
+// removed. Schedules loaded from the CIF timetable are left alone. The stored
+// UID is trimmed before comparing, since older releases stored VSTP UIDs with
+// the padding they arrived with.
+func deleteSchedule(ctx context.Context, tx pgx.Tx, trainUID string, startDate time.Time, stpIndicator string) (int64, error) {
+	tag, err := tx.Exec(ctx, `
+		DELETE FROM schedule
+		WHERE TRIM(train_uid) = $1
+		  AND schedule_start_date = $2
+		  AND stp_indicator = $3
+		  AND origin_msg_id IS NOT NULL`,
+		trainUID, startDate, stpIndicator,
+	)
+	if err != nil {
+		return 0, err
+	}
+	return tag.RowsAffected(), nil
+}
+
+func insertSchedule(ctx context.Context, tx pgx.Tx, vstpMsg *types.VSTPMessage, trainUID string, startDate, endDate time.Time) error {
+	schedule := &vstpMsg.VSTPCIFMsgV1.Schedule
+
+	// Insert main schedule record
+	for _, segment := range schedule.ScheduleSegment {
+		var scheduleID int
+		err := tx.QueryRow(ctx, `
+			INSERT INTO schedule (
+				train_uid, transaction_type, stp_indicator, bank_holiday_running,
+				applicable_timetable, atoc_code, schedule_days_runs, schedule_start_date,
+				schedule_end_date, train_status, signalling_id, train_category,
+				headcode, course_indicator, train_service_code, business_sector,
+				power_type, timing_load, speed, operating_characteristics,
+				train_class, sleepers, reservations, connection_indicator,
+				catering_code, service_branding, traction_class, uic_code,
+				origin_msg_id, schema_location
+			) VALUES (
+				$1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16,
+				$17, $18, $19, $20, $21, $22, $23, $24, $25, $26, $27, $28, $29, $30
+			) RETURNING id`,
+			trainUID,
+			schedule.TransactionType,
+			schedule.StpIndicator,
+			utils.NullString(schedule.BankHolidayRunning),
+			utils.NullString(schedule.ApplicableTimetable),
+			utils.NullString(segment.AtocCode),
+			schedule.ScheduleDaysRuns,
+			startDate,
+			endDate,
+			schedule.TrainStatus,
+			segment.SignallingId,
+			segment.TrainCategory,
+			segment.Headcode,
+			utils.ParseIntOrZero(segment.CourseIndicator),
+			segment.TrainServiceCode,
+			utils.NullString(segment.BusinessSector),
+			utils.NullString(segment.PowerType),
+			utils.NullString(segment.TimingLoad),
+			utils.NullString(segment.Speed),
+			utils.NullString(segment.OperatingCharacteristics),
+			utils.NullString(segment.TrainClass),
+			utils.NullString(segment.Sleepers),
+			utils.NullString(segment.Reservations),
+			utils.NullString(segment.ConnectionIndicator),
+			utils.NullString(segment.CateringCode),
+			segment.ServiceBranding,
+			utils.NullString(segment.TractionClass),
+			utils.NullString(segment.UicCode),
+			vstpMsg.VSTPCIFMsgV1.OriginMsgId,
+			vstpMsg.VSTPCIFMsgV1.SchemaLocation,
+		).Scan(&scheduleID)
+
+		if err != nil {
+			return fmt.Errorf("error inserting schedule: %v", err)
+		}
+
+		// Insert schedule locations
+		for i, location := range segment.ScheduleLocation {
+			locationType, location := classifyLocation(location, i, len(segment.ScheduleLocation))
+			err = insertScheduleLocation(ctx, tx, scheduleID, locationType, &location, i+1)
+			if err != nil {
+				return fmt.Errorf("error inserting schedule location: %v", err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// buildStops lists the stops of a VSTP schedule at locations with a known
+// stanox, as found by stanoxByTiploc, with the pass time of any point the
+// train only passes so TRUST passes can be matched to it
+func buildStops(stanoxByTiploc func(tiploc string) (string, error), schedule *types.VSTPSchedule) []types.Stop {
+	var stops []types.Stop
+	for _, segment := range schedule.ScheduleSegment {
+		for i, loc := range segment.ScheduleLocation {
+			stanox, err := stanoxByTiploc(loc.Location.Tiploc.TiplocId)
+
+			if err != nil {
+				continue
+			}
+
+			_, loc := classifyLocation(loc, i, len(segment.ScheduleLocation))
+			stops = append(stops, types.Stop{
+				Stanox:      stanox,
+				PlannedArr:  utils.FormatPlannedTime(loc.ScheduledArrivalTime),
+				PlannedDep:  utils.FormatPlannedTime(loc.ScheduledDepartureTime),
+				PlannedPass: utils.FormatPlannedTime(loc.ScheduledPassTime),
+			})
+		}
+	}
+
+	return stops
+}
+
+// CIF location types, which VSTP locations are classified as by their
+// position in the schedule
+const (
+	locationOrigin       = "LO"
+	locationIntermediate = "LI"
+	locationTerminus     = "LT"
+)
+
+// classifyLocation works out the CIF location type of the i'th of count
+// locations in a VSTP schedule segment, returning the location with only the
+// times that apply to that type. VSTP leaves unused times blank or filled
+// with spaces, and an origin only departs and a terminus only arrives, at
+// their pass time if they have no other. An intermediate point with a pass
+// time is only passed, so any arrival or departure alongside it is dropped.
+func classifyLocation(location types.VSTPScheduleLocation, i, count int) (string, types.VSTPScheduleLocation) {
+	location.ScheduledArrivalTime = strings.TrimSpace(location.ScheduledArrivalTime)
+	location.ScheduledDepartureTime = strings.TrimSpace(location.ScheduledDepartureTime)
+	location.ScheduledPassTime = strings.TrimSpace(location.ScheduledPassTime)
+	location.PublicArrivalTime = strings.TrimSpace(location.PublicArrivalTime)
+	location.PublicDepartureTime = strings.TrimSpace(location.PublicDepartureTime)
+
+	switch {
+	case i == 0:
+		if location.ScheduledDepartureTime == "" {
+			location.ScheduledDepartureTime = location.ScheduledPassTime
+		}
+		location.ScheduledArrivalTime, location.PublicArrivalTime = "", ""
+		location.ScheduledPassTime = ""
+		return locationOrigin, location
+	case i == count-1:
+		if location.ScheduledArrivalTime == "" {
+			location.ScheduledArrivalTime = location.ScheduledPassTime
+		}
+		location.ScheduledDepartureTime, location.PublicDepartureTime = "", ""
+		location.ScheduledPassTime = ""
+		return locationTerminus, location
+	case location.ScheduledPassTime != "":
+		location.ScheduledArrivalTime, location.PublicArrivalTime = "", ""
+		location.ScheduledDepartureTime, location.PublicDepartureTime = "", ""
+		return locationIntermediate, location
+	default:
+		return locationIntermediate, location
+	}
+}
+
+func insertScheduleLocation(ctx context.Context, tx pgx.Tx, scheduleID int, locationType string, location *types.VSTPScheduleLocation, order int) error {
+	_, err := tx.Exec(ctx, `
+		INSERT INTO schedule_location (
+			schedule_id, location_type, record_identity, tiploc_code, tiploc_instance,
+			arrival, public_arrival, departure, public_departure, pass,
+			platform, line, path, engineering_allowance, pathing_allowance,
+			performance_allowance, location_order, activity
+		) VALUES (
+			$1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17, $18
+		)`,
+		scheduleID,
+		locationType,
+		locationType,
+		location.Location.Tiploc.TiplocId,
+		nil,
+		utils.ParseTime(location.ScheduledArrivalTime),
+		utils.ParseTime(location.PublicArrivalTime),
+		utils.ParseTime(location.ScheduledDepartureTime),
+		utils.ParseTime(location.PublicDepartureTime),
+		utils.ParseTime(location.ScheduledPassTime),
+		utils.NullString(location.Platform),
+		utils.NullString(location.Line),
+		utils.NullString(location.Path),
+		utils.NullString(location.EngineeringAllowance),
+		utils.NullString(location.PathingAllowance),
+		utils.NullString(location.PerformanceAllowance),
+		order,
+		utils.NullString(location.Activity),
+	)
+
+	return err
+}
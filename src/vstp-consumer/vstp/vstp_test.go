@@ -0,0 +1,428 @@
+package vstp
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/jack-barr3tt/gbr-engine/src/common/data"
+	"github.com/jack-barr3tt/gbr-engine/src/common/testdb"
+	"github.com/jack-barr3tt/gbr-engine/src/common/types"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/redis/go-redis/v9"
+	"go.uber.org/zap"
+)
+
+func newTestConnections(t *testing.T) *Connections {
+	db := testdb.New(t)
+
+	server := miniredis.RunT(t)
+	rdb := redis.NewClient(&redis.Options{Addr: server.Addr()})
+	t.Cleanup(func() { rdb.Close() })
+
+	logger := zap.NewNop().Sugar()
+	return &Connections{DB: db, Redis: rdb, Logger: logger, Data: data.NewDataClient(db, rdb, logger)}
+}
+
+// vstpMessage builds a VSTP message for a schedule in January 2020 calling at
+// each of the given TIPLOCs in turn
+func vstpMessage(transactionType, trainUID string, tiplocs ...string) *types.VSTPMessage {
+	var locations []types.VSTPScheduleLocation
+	for i, tiploc := range tiplocs {
+		at := time.Date(2020, 1, 1, 10, i*10, 0, 0, time.UTC).Format("150405")
+		locations = append(locations, types.VSTPScheduleLocation{
+			ScheduledArrivalTime:   at,
+			ScheduledDepartureTime: at,
+			Location:               types.VSTPLocation{Tiploc: types.VSTPTiploc{TiplocId: tiploc}},
+		})
+	}
+
+	return &types.VSTPMessage{VSTPCIFMsgV1: types.VSTPCIFMsgV1{
+		OriginMsgId: "msg-" + transactionType,
+		Schedule: types.VSTPSchedule{
+			TransactionType:   transactionType,
+			ScheduleStartDate: "2020-01-01",
+			ScheduleEndDate:   "2020-01-31",
+			ScheduleDaysRuns:  "1111111",
+			TrainUID:          trainUID,
+			TrainStatus:       "1",
+			StpIndicator:      "N",
+			ScheduleSegment: []types.VSTPScheduleSegment{{
+				SignallingId:     "1A23",
+				TrainCategory:    "OO",
+				Headcode:         "1A23",
+				CourseIndicator:  "1",
+				TrainServiceCode: "12345678",
+				ScheduleLocation: locations,
+			}},
+		},
+	}}
+}
+
+// storedTiplocs lists the TIPLOCs of every location stored for a train UID's
+// VSTP schedules, in order
+func storedTiplocs(t *testing.T, db *pgxpool.Pool, trainUID string) []string {
+	t.Helper()
+
+	rows, err := db.Query(context.Background(), `
+		SELECT sl.tiploc_code
+		FROM schedule s
+		JOIN schedule_location sl ON sl.schedule_id = s.id
+		WHERE s.train_uid = $1 AND s.origin_msg_id IS NOT NULL
+		ORDER BY s.id, sl.location_order
+	`, trainUID)
+	if err != nil {
+		t.Fatalf("failed to query locations: %v", err)
+	}
+	defer rows.Close()
+
+	var tiplocs []string
+	for rows.Next() {
+		var tiploc string
+		if err := rows.Scan(&tiploc); err != nil {
+			t.Fatalf("failed to scan location: %v", err)
+		}
+		tiplocs = append(tiplocs, tiploc)
+	}
+	return tiplocs
+}
+
+func countSchedules(t *testing.T, db *pgxpool.Pool, trainUID string) (vstp, cif int) {
+	t.Helper()
+
+	err := db.QueryRow(context.Background(), `
+		SELECT count(*) FILTER (WHERE origin_msg_id IS NOT NULL), count(*) FILTER (WHERE origin_msg_id IS NULL)
+		FROM schedule
+		WHERE train_uid = $1
+	`, trainUID).Scan(&vstp, &cif)
+	if err != nil {
+		t.Fatalf("failed to count schedules: %v", err)
+	}
+	return vstp, cif
+}
+
+func equalTiplocs(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestProcessVSTPMessage(t *testing.T) {
+	ctx := context.Background()
+	conns := newTestConnections(t)
+
+	// a CIF schedule for the same train, start date and STP indicator, which
+	// VSTP messages must never touch
+	_, err := conns.DB.Exec(ctx, `
+		INSERT INTO schedule (
+			train_uid, transaction_type, stp_indicator, schedule_days_runs, schedule_start_date,
+			schedule_end_date, train_status, signalling_id, train_category, headcode,
+			course_indicator, train_service_code
+		) VALUES ('Z12345', 'Create', 'N', '1111111', '2020-01-01', '2020-01-31', '1', '1A23', 'OO', '1A23', 1, '12345678')
+	`)
+	if err != nil {
+		t.Fatalf("failed to insert CIF schedule: %v", err)
+	}
+
+	steps := []struct {
+		name        string
+		msg         *types.VSTPMessage
+		wantTiplocs []string
+	}{
+		{
+			name:        "create stores the schedule and its locations",
+			msg:         vstpMessage("Create", "Z12345", "EUSTON", "WATFDJ", "MKNSCEN"),
+			wantTiplocs: []string{"EUSTON", "WATFDJ", "MKNSCEN"},
+		},
+		{
+			name:        "revise replaces the locations",
+			msg:         vstpMessage("Revise", "Z12345", "EUSTON", "MKNSCEN"),
+			wantTiplocs: []string{"EUSTON", "MKNSCEN"},
+		},
+		{
+			name:        "create of a padded train UID replaces the same schedule",
+			msg:         vstpMessage("Create", " Z12345 ", "EUSTON", "BLTCHLY"),
+			wantTiplocs: []string{"EUSTON", "BLTCHLY"},
+		},
+		{
+			name: "delete removes the schedule",
+			msg:  vstpMessage("Delete", "Z12345"),
+		},
+		{
+			name: "delete of a missing schedule is a no-op",
+			msg:  vstpMessage("Delete", "Z12345"),
+		},
+	}
+
+	for _, step := range steps {
+		t.Run(step.name, func(t *testing.T) {
+			if err := processVSTPMessage(ctx, conns, step.msg); err != nil {
+				t.Fatalf("processVSTPMessage() error = %v", err)
+			}
+
+			wantVSTP := 0
+			if len(step.wantTiplocs) > 0 {
+				wantVSTP = 1
+			}
+			vstp, cif := countSchedules(t, conns.DB, "Z12345")
+			if vstp != wantVSTP {
+				t.Errorf("stored %d VSTP schedules, want %d", vstp, wantVSTP)
+			}
+			if cif != 1 {
+				t.Errorf("stored %d CIF schedules, want 1", cif)
+			}
+
+			if got := storedTiplocs(t, conns.DB, "Z12345"); !equalTiplocs(got, step.wantTiplocs) {
+				t.Errorf("stored locations %v, want %v", got, step.wantTiplocs)
+			}
+		})
+	}
+}
+
+func TestJourneyDays(t *testing.T) {
+	date := func(day int) time.Time {
+		return time.Date(2026, 1, day, 0, 0, 0, 0, time.UTC)
+	}
+	// Wednesday 7 January, with the horizon ending on Saturday 10 January
+	today := date(7)
+
+	tests := []struct {
+		name      string
+		daysRuns  string
+		startDate time.Time
+		endDate   time.Time
+		wantRuns  []time.Time
+		wantSkips []time.Time
+	}{
+		{
+			name:      "runs every day",
+			daysRuns:  "1111111",
+			startDate: date(1),
+			endDate:   date(31),
+			wantRuns:  []time.Time{date(6), date(7), date(8), date(9), date(10)},
+		},
+		{
+			name:      "runs on weekdays only",
+			daysRuns:  "1111100",
+			startDate: date(1),
+			endDate:   date(31),
+			wantRuns:  []time.Time{date(6), date(7), date(8), date(9)},
+			wantSkips: []time.Time{date(10)},
+		},
+		{
+			name:      "starts after yesterday",
+			daysRuns:  "1111111",
+			startDate: date(8),
+			endDate:   date(31),
+			wantRuns:  []time.Time{date(8), date(9), date(10)},
+		},
+		{
+			name:      "ends before the horizon",
+			daysRuns:  "1111111",
+			startDate: date(1),
+			endDate:   date(7),
+			wantRuns:  []time.Time{date(6), date(7)},
+			wantSkips: []time.Time{date(8), date(9), date(10)},
+		},
+		{
+			name:      "starts beyond the horizon",
+			daysRuns:  "1111111",
+			startDate: date(20),
+			endDate:   date(31),
+		},
+		{
+			name:      "malformed days run",
+			daysRuns:  "111",
+			startDate: date(1),
+			endDate:   date(31),
+			wantSkips: []time.Time{date(6), date(7), date(8), date(9), date(10)},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			runs, skips := journeyDays(tt.daysRuns, tt.startDate, tt.endDate, today, 3)
+			if !equalDays(runs, tt.wantRuns) {
+				t.Errorf("journeyDays() runs = %v, want %v", runs, tt.wantRuns)
+			}
+			if !equalDays(skips, tt.wantSkips) {
+				t.Errorf("journeyDays() skips = %v, want %v", skips, tt.wantSkips)
+			}
+		})
+	}
+}
+
+func equalDays(a, b []time.Time) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if !a[i].Equal(b[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+func TestNormaliseTransactionType(t *testing.T) {
+	tests := []struct {
+		transactionType string
+		want            string
+	}{
+		{"Create", transactionCreate},
+		{" revise ", transactionRevise},
+		{"DELETE", transactionDelete},
+		{"Amend", ""},
+		{"", ""},
+	}
+
+	for _, tt := range tests {
+		if got := normaliseTransactionType(tt.transactionType); got != tt.want {
+			t.Errorf("normaliseTransactionType(%q) = %q, want %q", tt.transactionType, got, tt.want)
+		}
+	}
+}
+
+func TestCancelJourney(t *testing.T) {
+	journey := types.TrainJourney{
+		UID:     "Z12345",
+		RunDate: "20260107",
+		Stops: []types.Stop{
+			{Stanox: "A", PlannedDep: "10:00", ActualDep: "1"},
+			{Stanox: "B", PlannedArr: "10:30"},
+		},
+	}
+
+	if !cancelJourney(&journey) {
+		t.Fatal("cancelJourney() = false, want true")
+	}
+	if journey.Cancellation == nil || journey.Cancellation.Type != plannedCancellation {
+		t.Errorf("cancellation = %+v, want type %s", journey.Cancellation, plannedCancellation)
+	}
+	if journey.Stops[0].Cancelled {
+		t.Error("reached stop cancelled")
+	}
+	if !journey.Stops[1].Cancelled {
+		t.Error("stop not yet reached left running")
+	}
+
+	if cancelJourney(&journey) {
+		t.Error("cancelJourney() = true for a journey already cancelled")
+	}
+}
+
+func TestClassifyLocation(t *testing.T) {
+	tests := []struct {
+		name     string
+		location types.VSTPScheduleLocation
+		i        int
+		wantType string
+		want     types.VSTPScheduleLocation
+	}{
+		{
+			name:     "origin with only a pass time",
+			location: types.VSTPScheduleLocation{ScheduledPassTime: "100000"},
+			i:        0,
+			wantType: locationOrigin,
+			want:     types.VSTPScheduleLocation{ScheduledDepartureTime: "100000"},
+		},
+		{
+			name:     "origin with a departure",
+			location: types.VSTPScheduleLocation{ScheduledArrivalTime: "095500", ScheduledDepartureTime: "100000", PublicDepartureTime: "100000"},
+			i:        0,
+			wantType: locationOrigin,
+			want:     types.VSTPScheduleLocation{ScheduledDepartureTime: "100000", PublicDepartureTime: "100000"},
+		},
+		{
+			name:     "terminus with only a pass time",
+			location: types.VSTPScheduleLocation{ScheduledPassTime: "110000"},
+			i:        2,
+			wantType: locationTerminus,
+			want:     types.VSTPScheduleLocation{ScheduledArrivalTime: "110000"},
+		},
+		{
+			name:     "intermediate with a pass time and an arrival and departure",
+			location: types.VSTPScheduleLocation{ScheduledArrivalTime: "103000", ScheduledDepartureTime: "103100", PublicArrivalTime: "103000", PublicDepartureTime: "103100", ScheduledPassTime: "103030"},
+			i:        1,
+			wantType: locationIntermediate,
+			want:     types.VSTPScheduleLocation{ScheduledPassTime: "103030"},
+		},
+		{
+			name:     "intermediate call",
+			location: types.VSTPScheduleLocation{ScheduledArrivalTime: "103000", ScheduledDepartureTime: "103100"},
+			i:        1,
+			wantType: locationIntermediate,
+			want:     types.VSTPScheduleLocation{ScheduledArrivalTime: "103000", ScheduledDepartureTime: "103100"},
+		},
+		{
+			name:     "origin with space-padded times",
+			location: types.VSTPScheduleLocation{ScheduledArrivalTime: "      ", ScheduledDepartureTime: "      ", ScheduledPassTime: "100000"},
+			i:        0,
+			wantType: locationOrigin,
+			want:     types.VSTPScheduleLocation{ScheduledDepartureTime: "100000"},
+		},
+		{
+			name:     "intermediate with space-padded times",
+			location: types.VSTPScheduleLocation{ScheduledArrivalTime: "103000 ", ScheduledDepartureTime: " 103100", ScheduledPassTime: "      ", PublicArrivalTime: "      "},
+			i:        1,
+			wantType: locationIntermediate,
+			want:     types.VSTPScheduleLocation{ScheduledArrivalTime: "103000", ScheduledDepartureTime: "103100"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gotType, got := classifyLocation(tt.location, tt.i, 3)
+			if gotType != tt.wantType {
+				t.Errorf("classifyLocation() type = %s, want %s", gotType, tt.wantType)
+			}
+			if got != tt.want {
+				t.Errorf("classifyLocation() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBuildStops(t *testing.T) {
+	stanoxes := map[string]string{"EUSTON": "72410", "WATFDJ": "70001", "MKNSCEN": "72000"}
+	stanoxByTiploc := func(tiploc string) (string, error) {
+		stanox, ok := stanoxes[tiploc]
+		if !ok {
+			return "", sql.ErrNoRows
+		}
+		return stanox, nil
+	}
+
+	schedule := &types.VSTPSchedule{ScheduleSegment: []types.VSTPScheduleSegment{{
+		ScheduleLocation: []types.VSTPScheduleLocation{
+			{ScheduledDepartureTime: "100000", Location: types.VSTPLocation{Tiploc: types.VSTPTiploc{TiplocId: "EUSTON"}}},
+			{ScheduledPassTime: "101500", Location: types.VSTPLocation{Tiploc: types.VSTPTiploc{TiplocId: "WATFDJ"}}},
+			{ScheduledPassTime: "102000", Location: types.VSTPLocation{Tiploc: types.VSTPTiploc{TiplocId: "UNKNOWN"}}},
+			{ScheduledArrivalTime: "110000", Location: types.VSTPLocation{Tiploc: types.VSTPTiploc{TiplocId: "MKNSCEN"}}},
+		},
+	}}}
+
+	want := []types.Stop{
+		{Stanox: "72410", PlannedDep: "10:00"},
+		{Stanox: "70001", PlannedPass: "10:15"},
+		{Stanox: "72000", PlannedArr: "11:00"},
+	}
+
+	got := buildStops(stanoxByTiploc, schedule)
+	if len(got) != len(want) {
+		t.Fatalf("buildStops() = %+v, want %+v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("stop %d = %+v, want %+v", i, got[i], want[i])
+		}
+	}
+}